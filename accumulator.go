@@ -0,0 +1,132 @@
+package hekaanom
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var windowStatistics = []string{"Sum", "Mean", "Min", "Max", "Count", "Last", "StdDev", "Rate", "Distinct"}
+
+const defaultWindowStatistic = "Sum"
+
+// accumulator keeps running summaries of the values added to it, so a
+// window's statistic can be calculated without keeping all of its values.
+type accumulator struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	last  float64
+	mean  float64
+	m2    float64
+
+	// A summary of the values' distribution, for percentile statistics.
+	digest *tDigest
+
+	// An estimate of the number of distinct keys added, for the "Distinct"
+	// statistic.
+	distinct *hyperLogLog
+}
+
+// keepQuantiles makes the accumulator summarize the distribution of the
+// values added from now on, so it can calculate percentile statistics.
+func (a *accumulator) keepQuantiles() {
+	if a.digest == nil {
+		a.digest = newTDigest(defaultCompression)
+	}
+}
+
+func (a *accumulator) Add(v float64) {
+	a.count++
+	a.sum += v
+	if a.count == 1 || v < a.min {
+		a.min = v
+	}
+	if a.count == 1 || v > a.max {
+		a.max = v
+	}
+	a.last = v
+	if a.digest != nil {
+		a.digest.Add(v)
+	}
+
+	// Welford's online algorithm for the variance.
+	delta := v - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (v - a.mean)
+}
+
+// AddDistinct records a key for the "Distinct" statistic.
+func (a *accumulator) AddDistinct(key string) {
+	if a.distinct == nil {
+		a.distinct = newHyperLogLog()
+	}
+	a.distinct.Add(key)
+}
+
+// Value returns the named statistic of the values added so far, over a window
+// lasting d. Every statistic of no values is zero.
+func (a *accumulator) Value(statistic string, d time.Duration) float64 {
+	if a.count == 0 {
+		return 0
+	}
+	if q, ok := statisticQuantile(statistic); ok {
+		if a.digest == nil {
+			return 0
+		}
+		return a.digest.Quantile(q)
+	}
+	switch statistic {
+	case "Mean":
+		return a.mean
+	case "Min":
+		return a.min
+	case "Max":
+		return a.max
+	case "Count":
+		return float64(a.count)
+	case "Last":
+		return a.last
+	case "StdDev":
+		return math.Sqrt(a.m2 / float64(a.count))
+	case "Rate":
+		if d <= 0 {
+			return float64(a.count)
+		}
+		return float64(a.count) / d.Seconds()
+	case "Distinct":
+		if a.distinct == nil {
+			return 0
+		}
+		return math.Floor(a.distinct.Count() + 0.5)
+	default:
+		return a.sum
+	}
+}
+
+// statisticQuantile returns the quantile a percentile statistic, such as
+// "P95" or "P99.9", stands for.
+func statisticQuantile(statistic string) (float64, bool) {
+	if !strings.HasPrefix(statistic, "P") {
+		return 0, false
+	}
+	percentile, err := strconv.ParseFloat(statistic[1:], 64)
+	if err != nil || !(percentile > 0 && percentile < 100) {
+		return 0, false
+	}
+	return percentile / 100, true
+}
+
+func windowStatisticIsKnown(statistic string) bool {
+	if _, ok := statisticQuantile(statistic); ok {
+		return true
+	}
+	for _, v := range windowStatistics {
+		if v == statistic {
+			return true
+		}
+	}
+	return false
+}
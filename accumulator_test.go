@@ -0,0 +1,209 @@
+package hekaanom
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+// spanDistributions returns span values shaped like those of a few kinds of
+// anomaly: steady normed values, a heavy-tailed burst and a single spike.
+func spanDistributions(n int) map[string]stats.Float64Data {
+	r := rand.New(rand.NewSource(1))
+	normal, burst, spike := make(stats.Float64Data, n), make(stats.Float64Data, n), make(stats.Float64Data, n)
+	for i := 0; i < n; i++ {
+		normal[i] = 3 + r.NormFloat64()
+		burst[i] = 3 + r.ExpFloat64()*4
+		spike[i] = 3 + r.Float64()
+	}
+	spike[n/2] = 40
+	return map[string]stats.Float64Data{"normal": normal, "burst": burst, "spike": spike}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]func(stats.Float64Data) (float64, error):
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]stats.Float64Data:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// BenchmarkAggFunctions runs every span statistic over spans of a few sizes
+// and shapes, to help choose a statistic for a workload.
+func BenchmarkAggFunctions(b *testing.B) {
+	for _, n := range []int{16, 256} {
+		distributions := spanDistributions(n)
+		for _, shape := range sortedKeys(distributions) {
+			values := distributions[shape]
+			for _, name := range sortedKeys(aggFunctions) {
+				agg := aggFunctions[name]
+				b.Run(fmt.Sprintf("%s/%s-%d", name, shape, n), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						if _, err := agg(values); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAggFunctions(t *testing.T) {
+	values := stats.Float64Data{1, 2, 3, 4, 100}
+	for _, name := range sortedKeys(aggFunctions) {
+		got, err := aggFunctions[name](values)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if got < 1 || got > 110 || math.IsNaN(got) {
+			t.Errorf("%s: got %v, out of the range of the values", name, got)
+		}
+	}
+}
+
+// exactQuantile returns the q quantile of sorted values.
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestTDigestAccuracy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d := newTDigest(defaultCompression)
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = r.ExpFloat64()
+		d.Add(values[i])
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		want := exactQuantile(values, q)
+		if got := d.Quantile(q); math.Abs(got-want)/want > 0.02 {
+			t.Errorf("P%v: got %v, want %v", q*100, got, want)
+		}
+	}
+}
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	for _, n := range []int{100, 10000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("key-%d", i))
+		}
+		if got := h.Count(); math.Abs(got-float64(n))/float64(n) > 0.05 {
+			t.Errorf("counted %v of %d distinct keys", got, n)
+		}
+	}
+}
+
+// BenchmarkWindowQuantile compares a window's P99 from its t-digest with
+// sorting every value, reporting the digest's relative error. Unlike the
+// values, the digest takes the same memory however many there are.
+func BenchmarkWindowQuantile(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = r.ExpFloat64()
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	want := exactQuantile(sorted, 0.99)
+
+	b.Run("tdigest", func(b *testing.B) {
+		var got float64
+		for i := 0; i < b.N; i++ {
+			var a accumulator
+			a.keepQuantiles()
+			for _, v := range values {
+				a.Add(v)
+			}
+			got = a.Value("P99", time.Minute)
+		}
+		b.ReportMetric(math.Abs(got-want)/want, "rel-err")
+	})
+	b.Run("exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			window := append([]float64(nil), values...)
+			sort.Float64s(window)
+			exactQuantile(window, 0.99)
+		}
+		b.ReportMetric(0, "rel-err")
+	})
+}
+
+// BenchmarkWindowDistinct compares counting a window's distinct keys with a
+// HyperLogLog sketch and with a set, reporting the sketch's relative error.
+func BenchmarkWindowDistinct(b *testing.B) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user-%d", i%5000)
+	}
+
+	b.Run("hyperloglog", func(b *testing.B) {
+		var got float64
+		for i := 0; i < b.N; i++ {
+			var a accumulator
+			for _, key := range keys {
+				a.AddDistinct(key)
+			}
+			a.Add(1)
+			got = a.Value("Distinct", time.Minute)
+		}
+		b.ReportMetric(math.Abs(got-5000)/5000, "rel-err")
+	})
+	b.Run("exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			set := map[string]struct{}{}
+			for _, key := range keys {
+				set[key] = struct{}{}
+			}
+		}
+		b.ReportMetric(0, "rel-err")
+	})
+}
+
+// FuzzParseStatistic checks arbitrary window statistics. A percentile must
+// stand for a quantile strictly between 0 and 1, and every known statistic
+// of some values must be a finite number.
+func FuzzParseStatistic(f *testing.F) {
+	f.Fuzz(func(t *testing.T, statistic string) {
+		q, isQuantile := statisticQuantile(statistic)
+		if isQuantile && !(q > 0 && q < 1) {
+			t.Fatalf("%q stands for quantile %v", statistic, q)
+		}
+		if !windowStatisticIsKnown(statistic) {
+			if isQuantile {
+				t.Fatalf("%q is a percentile but not a known statistic", statistic)
+			}
+			return
+		}
+
+		var a accumulator
+		a.keepQuantiles()
+		for i := 1; i <= 10; i++ {
+			a.Add(float64(i))
+			a.AddDistinct(fmt.Sprint(i))
+		}
+		got := a.Value(statistic, time.Minute)
+		if math.IsNaN(got) || math.IsInf(got, 0) {
+			t.Errorf("%q of 1 to 10 is %v", statistic, got)
+		}
+		if isQuantile && (got < 1 || got > 10) {
+			t.Errorf("%q of 1 to 10 is %v", statistic, got)
+		}
+	})
+}
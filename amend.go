@@ -0,0 +1,76 @@
+package hekaanom
+
+import "time"
+
+// amendableSpan is a copy of a closed span, as it was before it was flushed,
+// that late anomalous rulings can still be added to.
+type amendableSpan struct {
+	span     span
+	reason   string
+	closedAt time.Time
+}
+
+// keepAmendable keeps a copy of a span that's about to be flushed, if closed
+// spans can be amended. The span's shard must be locked.
+func (f *gatherFilter) keepAmendable(shard *spanShard, s *span, reason string) {
+	if f.GatherConfig.AmendLookback <= 0 {
+		return
+	}
+	closedAt, ok := shard.nows[s.key]
+	if !ok || closedAt.Before(s.End) {
+		closedAt = s.End
+	}
+	kept := copySpan(s)
+	shard.amendable[s.key] = &amendableSpan{kept, reason, closedAt}
+}
+
+// amend adds a late anomalous ruling to the recently closed span of its span
+// key, and emits the span again, marked as amended, with the same ID and
+// close reason. It does so only if the ruling is older than the series' time
+// when the span closed, goes in the same direction as the span and falls
+// within the range the span would have been extended by, and the key has no
+// open span. It reports whether the ruling was added. The span's shard must
+// be locked.
+func (f *gatherFilter) amend(shard *spanShard, key string, ruling ruling, value float64, out chan span) bool {
+	a, ok := shard.amendable[key]
+	if !ok {
+		return false
+	}
+	lookback := time.Duration(f.GatherConfig.AmendLookback) * time.Second
+	if ruling.Window.End.After(a.closedAt.Add(lookback)) {
+		// The series has moved on.
+		delete(shard.amendable, key)
+		return false
+	}
+	if !ruling.Anomalous || ruling.Window.End.After(a.closedAt) {
+		return false
+	}
+	if _, open := shard.spans[key]; open {
+		return false
+	}
+	s := &a.span
+	if ruling.Window.Start.After(s.End.Add(f.spanWidth(s.Series))) || (s.Values[0] >= 0) != (value >= 0) {
+		return false
+	}
+
+	f.addValue(s, value, ruling)
+	if ruling.Window.Start.Before(s.Start) {
+		s.Start = ruling.Window.Start
+	}
+	if ruling.Window.End.After(s.End) {
+		s.End = ruling.Window.End
+	}
+	amended := copySpan(s)
+	amended.Amended = true
+	f.flushSpan(&amended, a.reason, out)
+	return true
+}
+
+// copySpan copies a span along with the values that flushing it changes.
+func copySpan(s *span) span {
+	c := *s
+	c.Values = append([]float64(nil), s.Values...)
+	c.Weights = append([]float64(nil), s.Weights...)
+	c.WindowValues = append([]float64(nil), s.WindowValues...)
+	return c
+}
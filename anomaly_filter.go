@@ -2,16 +2,26 @@ package hekaanom
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"os"
 	"strconv"
 	"time"
 
+	"github.com/berkmancenter/hekaanom/anomutil"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
 const timeFormat = time.RFC3339Nano
 
+// schemaVersion is attached to every emitted ruling and span as the
+// "schema_version" field. See the package documentation for the compatibility
+// policy that governs when it changes.
+const schemaVersion = anomutil.SchemaVersion
+
 var (
 	defaultMessageVal    = 1.0
 	defaultMessageSeries = "**all**"
@@ -21,9 +31,10 @@ func init() {
 	pipeline.RegisterPlugin("AnomalyFilter",
 		func() interface{} {
 			return &AnomalyFilter{
-				windower: new(windowFilter),
-				detector: new(detectFilter),
-				gatherer: new(gatherFilter),
+				windower:   new(windowFilter),
+				normalizer: new(normalizeFilter),
+				detector:   new(detectFilter),
+				gatherer:   new(gatherFilter),
 			}
 		})
 }
@@ -35,10 +46,37 @@ type AnomalyConfig struct {
 	// as an array.
 	SeriesFields []string `toml:"series_fields"`
 
+	// Fields of the incoming message to carry through as the metric's tags, on
+	// every window, ruling and span emitted for it, so outputs can filter and
+	// group on them. The window stage can also use them to build series keys.
+	// They shouldn't repeat any of SeriesFields, which are carried through
+	// already.
+	TagFields []string `toml:"tag_fields"`
+
 	// The name of the field in the incoming message that contains the numeric
 	// value that should be used to create the time series.
 	ValueField string `toml:"value_field"`
 
+	// The name of the field in the incoming message whose distinct values
+	// (e.g. client IDs) the "Distinct" window statistic counts.
+	DistinctField string `toml:"distinct_field"`
+
+	// The unit of the values (e.g. "requests/s") and the kind of quantity they
+	// measure (e.g. "throughput"). These are carried through to every emitted
+	// ruling and span. If the value field has a representation, it is used as
+	// the unit instead.
+	Unit string `toml:"unit"`
+	Kind string `toml:"kind"`
+
+	// The type of the values: "gauge" (the default), "counter" or "delta".
+	// Counters are running totals, which the window stage turns into
+	// per-second rates, allowing for resets, rather than aggregating the
+	// totals themselves. MetricTypeField names a field of the incoming
+	// message that gives the type of each message's value instead; messages
+	// without a valid type in it fall back to MetricType.
+	MetricType      string `toml:"metric_type"`
+	MetricTypeField string `toml:"metric_type_field"`
+
 	// Is this filter running against realtime data? i.e. is data going to keep
 	// coming in forever?
 	Realtime bool `toml:"realtime"`
@@ -48,6 +86,10 @@ type AnomalyConfig struct {
 	// constituent metric values.
 	WindowConfig *WindowConfig `toml:"window"`
 
+	// The configuration for the optional stage that normalizes window values
+	// against their series' previous windows before detection.
+	NormalizeConfig *NormalizeConfig `toml:"normalize"`
+
 	// The configuration for the filter that detects anomalies in a time series
 	// made of windows.
 	DetectConfig *DetectConfig `toml:"detect"`
@@ -58,27 +100,121 @@ type AnomalyConfig struct {
 
 	// Output debugging information.
 	Debug bool `toml:"debug"`
+
+	// A file path or HTTP(S) URL of a catalog of per-series settings, as a JSON
+	// array or a CSV file with a header row. Entries are matched against series
+	// codes by their "series" regular expression and can override
+	// "window_width" and "span_width", as well as describe the series' "owner",
+	// "tier", "runbook" and "route".
+	Catalog string `toml:"catalog"`
+
+	// How often, in seconds, the catalog is checked for changes and reloaded.
+	// Zero disables reloading.
+	CatalogReloadInterval int64 `toml:"catalog_reload_interval"`
+
+	// Watch the filter's own ingest rate, ruling rate, span rate and queue
+	// depth on every tick, and inject an "anom.health" message whenever one of
+	// them deviates from its recent average by more than HealthThreshold
+	// standard deviations, or ingestion stops entirely.
+	HealthCheck     bool    `toml:"health_check"`
+	HealthThreshold float64 `toml:"health_threshold"`
+
+	// The number of ticks to observe before health alerts are emitted.
+	HealthWarmup int `toml:"health_warmup"`
+
+	// For horizontally scaled deployments, the total number of instances
+	// sharing the series, and which of them this is (counting from zero). Each
+	// instance only processes the series SeriesShard assigns to it and ignores
+	// the rest.
+	ShardID     int `toml:"shard_id"`
+	TotalShards int `toml:"total_shards"`
+
+	// Group spans that overlap in time and share a route (or owner) in the
+	// catalog into incidents, injected as "anom.incident" messages. A span
+	// joins an open incident if it starts no more than IncidentGap seconds
+	// after the incident's end.
+	Incidents   bool  `toml:"incidents"`
+	IncidentGap int64 `toml:"incident_gap"`
+
+	// Inject an "anom.latency" message for each pipeline stage on every tick,
+	// summarizing the distribution of how long recent items spent in it.
+	LatencyReport bool `toml:"latency_report"`
+
+	// The most distinct series the filter tracks at once, so that an upstream
+	// bug that explodes the number of series can't exhaust memory. Once the
+	// limit is reached, SeriesOverflow says what happens to the metrics of new
+	// series: "drop" (the default) drops them, "evict" forgets the least
+	// recently seen series to make room, and "other" aggregates them into a
+	// single "_other" series. Zero, the default, sets no limit.
+	MaxSeries      int    `toml:"max_series"`
+	SeriesOverflow string `toml:"series_overflow"`
+
+	// Where to load history from at startup to train detector baselines, so
+	// that detection doesn't have to wait for the baselines to fill up.
+	Bootstrap *BootstrapConfig `toml:"bootstrap"`
+
+	// Series renamed upstream, mapped to their new names as metrics are
+	// ingested, so that their history isn't orphaned under the old names.
+	Renames []RenameConfig `toml:"renames"`
+
+	// Transforms applied to the window values of matching series between the
+	// window and detect stages, such as differencing away a trend. The first
+	// transform whose pattern matches a series is used.
+	Transforms []TransformConfig `toml:"transforms"`
+
+	// A directory taps are written to. If set, an "anom.tap" message with a
+	// "stage" field ("windows", "rulings" or "spans") and a "count" field
+	// copies the next count items out of that stage to a new file in it, as
+	// JSON lines. The filter's message_matcher must match the tap messages.
+	TapDir string `toml:"tap_dir"`
+
+	// A capture file to replay, written to tap_dir by an "anom.capture"
+	// message. Its items are fed into the stage they were captured from, in
+	// the order they were recorded, in place of the stage's live input. The
+	// filter ignores the messages it's sent while replaying.
+	Replay string `toml:"replay"`
 }
 
 type AnomalyFilter struct {
 	runner pipeline.FilterRunner
 	helper pipeline.PluginHelper
 	*AnomalyConfig
-	windower   windower
-	detector   detector
-	gatherer   gatherer
-	metrics    chan metric
-	spans      chan span
-	processing bool
+	windower    windower
+	transformer *transformer
+	normalizer  normalizer
+	detector    detector
+	gatherer    gatherer
+	metrics     chan metric
+	rawWindows  chan window
+	spans       chan span
+	processing  bool
+	catalog     *catalog
+	lastReload  time.Time
+	health      *healthMonitor
+	latency     *latencyTracker
+	incidenter  *incidentGatherer
+	incidents   chan incident
+	// The configured renames, and the old series whose state has been
+	// transferred.
+	renames     []seriesRename
+	transferred map[string]bool
+	limiter     *seriesLimiter
+	taps        *tapper
+	captures    *capturer
+	replay      *replay
 }
 
 // ConfigStruct implements Heka's HasConfigStruct interface.
 func (f *AnomalyFilter) ConfigStruct() interface{} {
 	return &AnomalyConfig{
-		WindowConfig: f.windower.ConfigStruct().(*WindowConfig),
-		DetectConfig: f.detector.ConfigStruct().(*DetectConfig),
-		GatherConfig: f.gatherer.ConfigStruct().(*GatherConfig),
-		Debug:        false,
+		WindowConfig:          f.windower.ConfigStruct().(*WindowConfig),
+		NormalizeConfig:       f.normalizer.ConfigStruct().(*NormalizeConfig),
+		DetectConfig:          f.detector.ConfigStruct().(*DetectConfig),
+		GatherConfig:          f.gatherer.ConfigStruct().(*GatherConfig),
+		Debug:                 false,
+		CatalogReloadInterval: 60,
+		HealthThreshold:       4,
+		HealthWarmup:          10,
 	}
 }
 
@@ -90,32 +226,243 @@ func (f *AnomalyFilter) Init(config interface{}) error {
 	if err := f.windower.Init(f.AnomalyConfig.WindowConfig); err != nil {
 		return err
 	}
+	if err := f.normalizer.Init(f.AnomalyConfig.NormalizeConfig); err != nil {
+		return err
+	}
 	if err := f.detector.Init(f.AnomalyConfig.DetectConfig); err != nil {
 		return err
 	}
 	if err := f.gatherer.Init(f.AnomalyConfig.GatherConfig); err != nil {
 		return err
 	}
+	f.normalizer.UseExclusions(f.detector.IsExcluded)
+
+	if f.AnomalyConfig.Catalog != "" {
+		c, err := newCatalog(f.AnomalyConfig.Catalog)
+		if err != nil {
+			return err
+		}
+		f.catalog = c
+		f.lastReload = time.Now()
+		f.windower.UseCatalog(c)
+		f.detector.UseCatalog(c)
+		f.gatherer.UseCatalog(c)
+	}
+
+	if f.AnomalyConfig.WindowConfig.WindowStatistic == "Distinct" && f.AnomalyConfig.DistinctField == "" {
+		return errors.New("The \"Distinct\" 'window_statistic' requires a 'distinct_field'.")
+	}
+
+	metricType, err := validateMetricType(f.AnomalyConfig.MetricType)
+	if err != nil {
+		return err
+	}
+	f.AnomalyConfig.MetricType = metricType
+
+	tagFields := map[string]bool{}
+	for _, name := range f.AnomalyConfig.TagFields {
+		tagFields[name] = true
+	}
+	for _, name := range f.AnomalyConfig.WindowConfig.SeriesTags {
+		if !tagFields[name] {
+			return fmt.Errorf("Series tag %q must also be one of 'tag_fields'.", name)
+		}
+	}
+
+	if f.AnomalyConfig.TotalShards < 0 {
+		return errors.New("'total_shards' must not be negative.")
+	}
+	if f.AnomalyConfig.TotalShards > 1 &&
+		(f.AnomalyConfig.ShardID < 0 || f.AnomalyConfig.ShardID >= f.AnomalyConfig.TotalShards) {
+		return errors.New("'shard_id' must be between zero and 'total_shards' - 1.")
+	}
+
+	if f.AnomalyConfig.Incidents {
+		if f.AnomalyConfig.GatherConfig.Disabled {
+			return errors.New("'incidents' requires the gather stage to be enabled.")
+		}
+		if f.AnomalyConfig.IncidentGap < 0 {
+			return errors.New("'incident_gap' must not be negative.")
+		}
+		gap := time.Duration(f.AnomalyConfig.IncidentGap) * time.Second
+		f.incidenter = newIncidentGatherer(gap, f.catalog)
+	}
+
+	if f.AnomalyConfig.HealthCheck {
+		if f.AnomalyConfig.HealthThreshold <= 0 {
+			return errors.New("'health_threshold' must be greater than zero.")
+		}
+		f.health = newHealthMonitor(f.AnomalyConfig.HealthThreshold, f.AnomalyConfig.HealthWarmup)
+	}
+
+	if f.AnomalyConfig.LatencyReport {
+		f.latency = newLatencyTracker()
+	}
+
+	if f.AnomalyConfig.MaxSeries < 0 {
+		return errors.New("'max_series' must not be negative.")
+	}
+	switch f.AnomalyConfig.SeriesOverflow {
+	case "":
+		f.AnomalyConfig.SeriesOverflow = overflowDrop
+	case overflowDrop, overflowEvict, overflowOther:
+	default:
+		return errors.New("'series_overflow' must be \"drop\", \"evict\" or \"other\".")
+	}
+	f.limiter = nil
+	if f.AnomalyConfig.MaxSeries > 0 {
+		f.limiter = newSeriesLimiter(f.AnomalyConfig.MaxSeries, f.AnomalyConfig.SeriesOverflow)
+	}
+
+	if f.transformer, err = newTransformer(f.AnomalyConfig.Transforms, f.windower.Width); err != nil {
+		return err
+	}
+
+	renames, err := newSeriesRenames(f.AnomalyConfig.Renames)
+	if err != nil {
+		return err
+	}
+	f.renames = renames
+	f.transferred = map[string]bool{}
+
+	f.taps, f.captures = nil, nil
+	if f.AnomalyConfig.TapDir != "" {
+		info, err := os.Stat(f.AnomalyConfig.TapDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errors.New("'tap_dir' must be a directory.")
+		}
+		f.taps = newTapper(f.AnomalyConfig.TapDir)
+		f.captures = newCapturer(f.AnomalyConfig.TapDir)
+	}
+
+	f.replay = nil
+	if f.AnomalyConfig.Replay != "" {
+		windowInput := f.AnomalyConfig.WindowConfig.Input == inputWindows
+		if f.replay, err = loadReplay(f.AnomalyConfig.Replay, windowInput); err != nil {
+			return err
+		}
+		if f.replay.stage == captureGather && f.AnomalyConfig.GatherConfig.Disabled {
+			return errors.New("A gather stage capture can't be replayed with the gather stage disabled.")
+		}
+	}
+
+	if f.AnomalyConfig.Bootstrap != nil {
+		if f.AnomalyConfig.WindowConfig.Input == inputWindows {
+			return errors.New("'bootstrap' can't be used with windows as input.")
+		}
+		if err := f.AnomalyConfig.Bootstrap.validate(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// EffectiveConfig returns the settings the filter is actually running with,
+// i.e. with defaults applied, durations normalized and dates resolved.
+func (f *AnomalyFilter) EffectiveConfig() map[string]interface{} {
+	reload := time.Duration(f.AnomalyConfig.CatalogReloadInterval) * time.Second
+	return map[string]interface{}{
+		"series_fields":           f.AnomalyConfig.SeriesFields,
+		"tag_fields":              f.AnomalyConfig.TagFields,
+		"value_field":             f.AnomalyConfig.ValueField,
+		"distinct_field":          f.AnomalyConfig.DistinctField,
+		"unit":                    f.AnomalyConfig.Unit,
+		"kind":                    f.AnomalyConfig.Kind,
+		"metric_type":             f.AnomalyConfig.MetricType,
+		"metric_type_field":       f.AnomalyConfig.MetricTypeField,
+		"realtime":                f.AnomalyConfig.Realtime,
+		"debug":                   f.AnomalyConfig.Debug,
+		"catalog":                 f.AnomalyConfig.Catalog,
+		"catalog_reload_interval": reload.String(),
+		"health_check":            f.AnomalyConfig.HealthCheck,
+		"health_threshold":        f.AnomalyConfig.HealthThreshold,
+		"health_warmup":           f.AnomalyConfig.HealthWarmup,
+		"shard_id":                f.AnomalyConfig.ShardID,
+		"total_shards":            f.AnomalyConfig.TotalShards,
+		"incidents":               f.AnomalyConfig.Incidents,
+		"incident_gap":            (time.Duration(f.AnomalyConfig.IncidentGap) * time.Second).String(),
+		"latency_report":          f.AnomalyConfig.LatencyReport,
+		"bootstrap":               f.AnomalyConfig.Bootstrap,
+		"renames":                 f.AnomalyConfig.Renames,
+		"transforms":              f.AnomalyConfig.Transforms,
+		"max_series":              f.AnomalyConfig.MaxSeries,
+		"series_overflow":         f.AnomalyConfig.SeriesOverflow,
+		"tap_dir":                 f.AnomalyConfig.TapDir,
+		"replay":                  f.AnomalyConfig.Replay,
+		"window":                  f.windower.EffectiveConfig(),
+		"normalize":               f.normalizer.EffectiveConfig(),
+		"detect":                  f.detector.EffectiveConfig(),
+		"gather":                  f.gatherer.EffectiveConfig(),
+	}
+}
+
 // Prepare implements Heka's Filter interface.
 func (f *AnomalyFilter) Prepare(fr pipeline.FilterRunner, h pipeline.PluginHelper) error {
 	f.runner = fr
 	f.helper = h
 	f.metrics = make(chan metric)
+	f.rawWindows = make(chan window)
+
+	effective, err := json.Marshal(f.EffectiveConfig())
+	if err != nil {
+		return err
+	}
+	f.runner.LogMessage("Effective configuration: " + string(effective))
+
+	if f.AnomalyConfig.Bootstrap != nil {
+		f.bootstrap()
+	}
 
-	windows := f.windower.Connect(f.metrics)
-	rulings := f.detector.Connect(windows)
+	replayed := func() {
+		f.runner.LogMessage("Replay finished.")
+	}
+
+	var windows chan window
+	if f.AnomalyConfig.WindowConfig.Input == inputWindows {
+		windows = f.windower.ConnectWindows(f.rawWindows)
+		if f.replay != nil && f.replay.stage == captureWindow {
+			f.replay.Windows(f.rawWindows, false, replayed)
+		}
+	} else {
+		windows = f.windower.Connect(f.metrics)
+		if f.replay != nil && f.replay.stage == captureWindow {
+			f.replay.Metrics(f.metrics, false, replayed)
+		}
+	}
+	windows = f.taps.Connect(f.normalizer.Connect(f.transformer.Connect(windows)))
+	// A detect or gather stage replay stands in for the stages before it, so
+	// its end is the end of the stream: closing its channel flushes the
+	// stages after it, as shutting down would. The window stage's input
+	// channels are closed by CleanUp instead.
+	if f.replay != nil && f.replay.stage == captureDetect {
+		windows = make(chan window)
+		f.replay.Windows(windows, true, replayed)
+	}
+	rulings := f.detector.Connect(f.captures.ConnectWindows(windows))
 
 	if f.AnomalyConfig.GatherConfig.Disabled {
 		f.publishRulings(rulings)
 	} else {
 		rulingChans := broadcastRuling(rulings, 2)
 		f.publishRulings(rulingChans[0])
-		f.spans = f.gatherer.Connect(rulingChans[1])
-		f.publishSpans(f.spans)
+		gatherRulings := rulingChans[1]
+		if f.replay != nil && f.replay.stage == captureGather {
+			gatherRulings = make(chan []ruling)
+			f.replay.Rulings(gatherRulings, true, replayed)
+		}
+		f.spans = f.gatherer.Connect(f.captures.ConnectRulings(gatherRulings))
+		if f.incidenter != nil {
+			spanChans := broadcastSpan(f.spans, 2)
+			f.publishSpans(spanChans[0])
+			f.incidents = f.incidenter.Connect(spanChans[1])
+			f.publishIncidents(f.incidents)
+		} else {
+			f.publishSpans(f.spans)
+		}
 	}
 
 	return nil
@@ -123,8 +470,72 @@ func (f *AnomalyFilter) Prepare(fr pipeline.FilterRunner, h pipeline.PluginHelpe
 
 // ProcessMessage implements Heka's MessageProcessor interface.
 func (f *AnomalyFilter) ProcessMessage(pack *pipeline.PipelinePack) error {
-	metric := f.metricFromMessage(pack.Message)
-	f.metrics <- metric
+	if f.taps != nil && pack.Message.GetType() == tapMessageType {
+		path, err := f.taps.StartFromMessage(pack.Message)
+		f.runner.UpdateCursor(pack.QueueCursor)
+		if err != nil {
+			return err
+		}
+		f.runner.LogMessage("Tapping into " + path)
+		return nil
+	}
+	if f.captures != nil && pack.Message.GetType() == captureMessageType {
+		path, err := f.captures.StartFromMessage(pack.Message)
+		f.runner.UpdateCursor(pack.QueueCursor)
+		if err != nil {
+			return err
+		}
+		f.runner.LogMessage("Capturing into " + path)
+		return nil
+	}
+	if f.replay != nil {
+		f.runner.UpdateCursor(pack.QueueCursor)
+		return nil
+	}
+	if f.AnomalyConfig.WindowConfig.Input == inputWindows {
+		win, err := windowFromMessage(pack.Message)
+		if err != nil {
+			f.runner.UpdateCursor(pack.QueueCursor)
+			return err
+		}
+		win.Series = f.renameSeries(win.Series)
+		win.Passthrough = f.getMessagePassthrough(pack.Message)
+		win.Tags = f.getMessageTags(pack.Message)
+		if win.Unit == "" {
+			win.Unit = f.AnomalyConfig.Unit
+		}
+		if win.Kind == "" {
+			win.Kind = f.AnomalyConfig.Kind
+		}
+		if !f.ownsSeries(win.Series) {
+			f.runner.UpdateCursor(pack.QueueCursor)
+			return nil
+		}
+		var ok bool
+		if win.Series, ok = f.limitSeries(win.Series); !ok {
+			f.runner.UpdateCursor(pack.QueueCursor)
+			return nil
+		}
+		f.captures.Record(captureWindow, win)
+		f.rawWindows <- win
+	} else {
+		metric := f.metricFromMessage(pack.Message)
+		metric.Series = f.windower.SeriesKey(metric)
+		if !f.ownsSeries(metric.Series) {
+			f.runner.UpdateCursor(pack.QueueCursor)
+			return nil
+		}
+		var ok bool
+		if metric.Series, ok = f.limitSeries(metric.Series); !ok {
+			f.runner.UpdateCursor(pack.QueueCursor)
+			return nil
+		}
+		f.captures.Record(captureWindow, metric)
+		f.metrics <- metric
+	}
+	if f.health != nil {
+		f.health.Ingested()
+	}
 	f.runner.UpdateCursor(pack.QueueCursor)
 	if !f.processing {
 		f.processing = true
@@ -133,20 +544,70 @@ func (f *AnomalyFilter) ProcessMessage(pack *pipeline.PipelinePack) error {
 	return nil
 }
 
+// bootstrap trains the detector on the history of each configured series.
+// Series whose history can't be loaded are logged and left to warm up as
+// usual.
+func (f *AnomalyFilter) bootstrap() {
+	conf := f.AnomalyConfig.Bootstrap
+	now := time.Now()
+	for series, query := range conf.Series {
+		if !f.ownsSeries(series) {
+			continue
+		}
+		windows, err := conf.history(series, query, f.windower.Width(series), now)
+		if err != nil {
+			f.runner.LogError(err)
+			continue
+		}
+		for _, win := range windows {
+			win.Unit = f.AnomalyConfig.Unit
+			win.Kind = f.AnomalyConfig.Kind
+			if !f.transformer.Transform(&win) {
+				continue
+			}
+			f.normalizer.Normalize(&win)
+			f.detector.Train(win)
+		}
+		f.runner.LogMessage(fmt.Sprintf("Trained %s on %d historical windows", series, len(windows)))
+	}
+}
+
+// ownsSeries reports whether this instance's shard is responsible for a
+// series.
+func (f *AnomalyFilter) ownsSeries(series string) bool {
+	if f.AnomalyConfig.TotalShards <= 1 {
+		return true
+	}
+	return SeriesShard(series, f.AnomalyConfig.TotalShards) == f.AnomalyConfig.ShardID
+}
+
 // TimerEvent implements Heka's TicketPlugin interface.
 func (f *AnomalyFilter) TimerEvent() error {
 	if f.AnomalyConfig.Debug {
+		f.windower.PrintIntervals()
 		f.detector.PrintQs()
 		f.gatherer.PrintSpansInMem()
+		f.gatherer.PrintScoreQuantiles()
+		f.gatherer.PrintLockContention()
 	}
 
 	// We should only be keeping track of the real "now" if we're doing realtime
 	// analysis.
 	if f.AnomalyConfig.Realtime {
 		now := time.Now()
+		f.windower.FlushIdleWindows(now)
+		f.windower.FlushExpiredWindows(now)
 		f.gatherer.FlushExpiredSpans(now, f.spans)
+		if f.incidenter != nil {
+			f.incidenter.FlushExpiredIncidents(now, f.incidents)
+		}
 	}
 
+	f.captures.Expire(time.Now())
+	f.reloadCatalog()
+	f.checkHealth()
+	f.reportLatency()
+
 	if f.processing && f.detector.QueuesEmpty() {
 		f.runner.LogMessage("All queues emptied.")
 		f.processing = false
@@ -154,13 +615,59 @@ func (f *AnomalyFilter) TimerEvent() error {
 	return nil
 }
 
+func (f *AnomalyFilter) reloadCatalog() {
+	interval := time.Duration(f.AnomalyConfig.CatalogReloadInterval) * time.Second
+	if f.catalog == nil || interval <= 0 || time.Since(f.lastReload) < interval {
+		return
+	}
+	f.lastReload = time.Now()
+	reloaded, err := f.catalog.Reload()
+	if err != nil {
+		f.runner.LogError(err)
+		return
+	}
+	if reloaded {
+		f.runner.LogMessage("Catalog reloaded.")
+	}
+}
+
 // CleanUp implements Heka's Filter interface.
 func (f *AnomalyFilter) CleanUp() {
+	f.replay.Stop()
 	close(f.metrics)
+	close(f.rawWindows)
+	f.taps.Close()
+	f.captures.Close()
 }
 
+// ReportMsg implements Heka's ReportingPlugin interface, adding the window and
+// gather stages' counters, and the series limit's, to Heka's plugin reports.
+func (f *AnomalyFilter) ReportMsg(msg *message.Message) error {
+	if err := f.windower.ReportMsg(msg); err != nil {
+		return err
+	}
+	if err := f.gatherer.ReportMsg(msg); err != nil {
+		return err
+	}
+	if f.limiter == nil {
+		return nil
+	}
+	dropped, evicted, aggregated := f.limiter.Counts()
+	if err := message.NewInt64Field(msg, "OverflowMetricsDropped", dropped, "count"); err != nil {
+		return err
+	}
+	if err := message.NewInt64Field(msg, "OverflowSeriesEvicted", evicted, "count"); err != nil {
+		return err
+	}
+	return message.NewInt64Field(msg, "OverflowMetricsAggregated", aggregated, "count")
+}
+
+// publishSpans injects span messages. Each carries a "sequence" field that
+// counts up from 1 across the span messages of its series, so consumers can
+// put a series' span messages back in order if they arrive out of it.
 func (f *AnomalyFilter) publishSpans(in chan span) error {
 	go func() {
+		sequences := map[string]int64{}
 		for span := range in {
 			newPack, err := f.helper.PipelinePack(0)
 			if err != nil {
@@ -169,29 +676,51 @@ func (f *AnomalyFilter) publishSpans(in chan span) error {
 				continue
 			}
 			msg := newPack.Message
-			msg.SetType("anom.span")
+			if span.StateChanged {
+				msg.SetType(anomutil.TypeSpanState)
+			} else {
+				msg.SetType(anomutil.TypeSpan)
+			}
 			if err = span.FillMessage(msg); err != nil {
 				fmt.Println(err)
 				continue
 			}
+			if err = f.catalog.FillMessage(span.Series, msg); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			sequences[span.Series]++
+			sequence, err := message.NewField("sequence", sequences[span.Series], "")
+			if err != nil {
+				fmt.Println("Could not create 'sequence' field")
+				continue
+			}
+			msg.AddField(sequence)
 			f.runner.Inject(newPack)
+			f.taps.Observe(tapSpans, span)
+			if f.health != nil {
+				f.health.Spanned()
+			}
+			if f.latency != nil && !span.StateChanged {
+				f.latency.Observe(stageGather, time.Since(span.lastRuled))
+			}
 		}
 	}()
 	return nil
 }
 
-func (f *AnomalyFilter) publishRulings(in chan ruling) error {
+func (f *AnomalyFilter) publishIncidents(in chan incident) error {
 	go func() {
-		for ruling := range in {
+		for incident := range in {
 			newPack, err := f.helper.PipelinePack(0)
 			if err != nil {
-				fmt.Println("Could not create new ruling message")
+				fmt.Println("Could not create new incident message")
 				fmt.Println(err)
 				continue
 			}
 			msg := newPack.Message
-			msg.SetType("anom.ruling")
-			if err = ruling.FillMessage(msg); err != nil {
+			msg.SetType(anomutil.TypeIncident)
+			if err = incident.FillMessage(msg); err != nil {
 				fmt.Println(err)
 				continue
 			}
@@ -201,13 +730,128 @@ func (f *AnomalyFilter) publishRulings(in chan ruling) error {
 	return nil
 }
 
+func (f *AnomalyFilter) publishRulings(in chan []ruling) error {
+	go func() {
+		for batch := range in {
+			for _, ruling := range batch {
+				newPack, err := f.helper.PipelinePack(0)
+				if err != nil {
+					fmt.Println("Could not create new ruling message")
+					fmt.Println(err)
+					continue
+				}
+				msg := newPack.Message
+				msg.SetType(anomutil.TypeRuling)
+				if err = ruling.FillMessage(msg); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				if err = f.catalog.FillMessage(ruling.Window.Series, msg); err != nil {
+					fmt.Println(err)
+					continue
+				}
+				f.runner.Inject(newPack)
+				f.taps.Observe(tapRulings, ruling)
+				if f.health != nil {
+					f.health.Ruled()
+				}
+				if f.latency != nil && !ruling.Window.flushed.IsZero() {
+					f.latency.Observe(stageWindow, ruling.Window.flushed.Sub(ruling.Window.End))
+					f.latency.Observe(stageDetect, time.Since(ruling.Window.flushed))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (f *AnomalyFilter) checkHealth() {
+	if f.health == nil {
+		return
+	}
+	depth := 0
+	for _, length := range f.detector.QueueLengths() {
+		depth += length
+	}
+	for _, alert := range f.health.Tick(depth) {
+		newPack, err := f.helper.PipelinePack(0)
+		if err != nil {
+			fmt.Println("Could not create new health message")
+			fmt.Println(err)
+			continue
+		}
+		msg := newPack.Message
+		msg.SetType(anomutil.TypeHealth)
+		msg.SetTimestamp(time.Now().UnixNano())
+		if err = alert.FillMessage(msg); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		f.runner.Inject(newPack)
+	}
+}
+
+func (f *AnomalyFilter) reportLatency() {
+	if f.latency == nil {
+		return
+	}
+	reports := f.latency.Reports()
+	if f.AnomalyConfig.Debug {
+		printLatencies(reports)
+	}
+	for _, report := range reports {
+		newPack, err := f.helper.PipelinePack(0)
+		if err != nil {
+			fmt.Println("Could not create new latency message")
+			fmt.Println(err)
+			continue
+		}
+		msg := newPack.Message
+		msg.SetType(anomutil.TypeLatency)
+		msg.SetTimestamp(time.Now().UnixNano())
+		if err = report.FillMessage(msg); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		f.runner.Inject(newPack)
+	}
+}
+
 func (f *AnomalyFilter) metricFromMessage(msg *message.Message) metric {
 	return metric{
-		time.Unix(0, msg.GetTimestamp()),
-		f.getMessageSeries(msg),
-		f.getMessageValue(msg),
-		f.getMessagePassthrough(msg),
+		Timestamp:   time.Unix(0, msg.GetTimestamp()),
+		Series:      f.renameSeries(f.getMessageSeries(msg)),
+		Value:       f.getMessageValue(msg),
+		Passthrough: f.getMessagePassthrough(msg),
+		Tags:        f.getMessageTags(msg),
+		Unit:        f.getMessageUnit(msg),
+		Kind:        f.AnomalyConfig.Kind,
+		Type:        f.getMessageMetricType(msg),
+		Distinct:    f.getMessageDistinct(msg),
+	}
+}
+
+// getMessageDistinct returns the value of a message's distinct field, if it
+// has one.
+func (f *AnomalyFilter) getMessageDistinct(msg *message.Message) string {
+	if f.AnomalyConfig.DistinctField == "" {
+		return ""
 	}
+	value, ok := msg.GetFieldValue(f.AnomalyConfig.DistinctField)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func (f *AnomalyFilter) getMessageUnit(msg *message.Message) string {
+	if f.AnomalyConfig.ValueField != "" {
+		field := msg.FindFirstField(f.AnomalyConfig.ValueField)
+		if field != nil && field.GetRepresentation() != "" {
+			return field.GetRepresentation()
+		}
+	}
+	return f.AnomalyConfig.Unit
 }
 
 func (f *AnomalyFilter) getMessageSeries(msg *message.Message) string {
@@ -268,10 +912,10 @@ func broadcastSpan(in chan span, numOut int) []chan span {
 	return out
 }
 
-func broadcastRuling(in chan ruling, numOut int) []chan ruling {
-	out := make([]chan ruling, numOut)
+func broadcastRuling(in chan []ruling, numOut int) []chan []ruling {
+	out := make([]chan []ruling, numOut)
 	for i := 0; i < numOut; i++ {
-		out[i] = make(chan ruling)
+		out[i] = make(chan []ruling)
 	}
 	go func() {
 		defer func() {
@@ -296,8 +940,23 @@ func (f *AnomalyFilter) getMessageValue(msg *message.Message) float64 {
 	if !ok {
 		return defaultMessageVal
 	}
-	floatVal, err := strconv.ParseFloat(value.(string), 64)
-	if err != nil {
+	var floatVal float64
+	switch v := value.(type) {
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return defaultMessageVal
+		}
+		floatVal = parsed
+	case float64:
+		floatVal = v
+	case int64:
+		floatVal = float64(v)
+	default:
+		return defaultMessageVal
+	}
+	// NaN and infinite values would poison every statistic they touch.
+	if math.IsNaN(floatVal) || math.IsInf(floatVal, 0) {
 		return defaultMessageVal
 	}
 	return floatVal
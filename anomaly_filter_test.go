@@ -0,0 +1,143 @@
+package hekaanom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// FuzzDecodeMetric decodes messages with arbitrary field values into metrics,
+// which must always come out with a finite value and a known type.
+func FuzzDecodeMetric(f *testing.F) {
+	f.Fuzz(func(t *testing.T, timestamp int64, host, value string, number float64, region, metricType string) {
+		a := &AnomalyFilter{AnomalyConfig: &AnomalyConfig{
+			SeriesFields:    []string{"host"},
+			TagFields:       []string{"region"},
+			ValueField:      "value",
+			MetricTypeField: "type",
+			MetricType:      metricGauge,
+		}}
+		msg := &message.Message{}
+		msg.SetTimestamp(timestamp)
+		fields := map[string]interface{}{"host": host, "region": region, "type": metricType}
+		if value != "" {
+			fields["value"] = value
+		} else {
+			fields["value"] = number
+		}
+		for _, name := range []string{"host", "region", "type", "value"} {
+			field, err := message.NewField(name, fields[name], "")
+			if err != nil {
+				t.Skip(err)
+			}
+			msg.AddField(field)
+		}
+
+		m := a.metricFromMessage(msg)
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			t.Errorf("decoded a value of %v", m.Value)
+		}
+		if m.Timestamp.UnixNano() != timestamp {
+			t.Errorf("got timestamp %d, want %d", m.Timestamp.UnixNano(), timestamp)
+		}
+		wantSeries := host
+		if wantSeries == "" {
+			wantSeries = defaultMessageSeries
+		}
+		if m.Series != wantSeries {
+			t.Errorf("got series %q, want %q", m.Series, wantSeries)
+		}
+		if m.Tags["region"] != region {
+			t.Errorf("got region tag %q, want %q", m.Tags["region"], region)
+		}
+		switch m.Type {
+		case metricGauge, metricCounter, metricDelta:
+		default:
+			t.Errorf("decoded a metric type of %q", m.Type)
+		}
+	})
+}
+
+// newTestAnomalyFilter returns a prepared filter keying metrics by their host
+// and region.
+func newTestAnomalyFilter(t *testing.T, configure func(*AnomalyConfig)) (*AnomalyFilter, error) {
+	f := &AnomalyFilter{
+		windower:   new(windowFilter),
+		normalizer: new(normalizeFilter),
+		detector:   new(detectFilter),
+		gatherer:   new(gatherFilter),
+	}
+	conf := f.ConfigStruct().(*AnomalyConfig)
+	conf.SeriesFields = []string{"host"}
+	conf.TagFields = []string{"region"}
+	conf.ValueField = "value"
+	conf.WindowConfig.WindowWidth = "1m"
+	conf.WindowConfig.SeriesTags = []string{"region"}
+	conf.DetectConfig.Algorithm = "EWMA"
+	conf.DetectConfig.DetectorConfig = map[string]interface{}{}
+	conf.GatherConfig.SpanWidth = "1h"
+	conf.GatherConfig.LastDate = "2100-01-01T00:00:00Z"
+	if configure != nil {
+		configure(conf)
+	}
+	if err := f.Init(conf); err != nil {
+		return nil, err
+	}
+	if err := f.Prepare(&fakeRunner{injected: map[string]int{}}, fakeHelper{}); err != nil {
+		t.Fatal(err)
+	}
+	return f, nil
+}
+
+func TestShardBySeriesKey(t *testing.T) {
+	f, err := newTestAnomalyFilter(t, func(conf *AnomalyConfig) {
+		conf.TotalShards = 2
+		conf.MaxSeries = 100
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.CleanUp()
+
+	want := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		region := fmt.Sprintf("region-%d", i)
+		if key := "web|" + region; SeriesShard(key, 2) == 0 {
+			want[key] = true
+		}
+		msg := &message.Message{}
+		for name, value := range map[string]interface{}{"host": "web", "region": region, "value": 1.0} {
+			field, err := message.NewField(name, value, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.AddField(field)
+		}
+		if err := f.ProcessMessage(&pipeline.PipelinePack{Message: msg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same host's metrics are spread across shards by region.
+	if len(f.limiter.series) != len(want) {
+		t.Errorf("admitted %d series, want %d", len(f.limiter.series), len(want))
+	}
+	for key := range f.limiter.series {
+		if !want[key] {
+			t.Errorf("admitted %q, which belongs to the other shard", key)
+		}
+	}
+}
+
+func TestSeriesTagsValidated(t *testing.T) {
+	for _, tags := range [][]string{{""}, {"region", "region"}, {"zone"}} {
+		if _, err := newTestAnomalyFilter(t, func(conf *AnomalyConfig) {
+			conf.WindowConfig.SeriesTags = tags
+		}); err == nil {
+			t.Errorf("series tags %q should be an error", tags)
+		}
+	}
+}
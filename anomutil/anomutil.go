@@ -0,0 +1,82 @@
+/*
+Package anomutil holds the constants and helpers the hekaanom filter is built
+on, for code that works alongside it, such as custom detectors registered with
+hekaanom.RegisterDetector, routers in front of sharded filters and consumers of
+its messages. The filter uses these same functions, so code built on them
+agrees with it exactly.
+*/
+package anomutil
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// SchemaVersion is attached to every ruling and span the filter emits as the
+// "schema_version" field. See the hekaanom package documentation for the
+// compatibility policy that governs when it changes.
+const SchemaVersion = 1
+
+// The types of the messages the filter injects.
+const (
+	TypeRuling    = "anom.ruling"
+	TypeSpan      = "anom.span"
+	TypeSpanState = "anom.span.state"
+	TypeIncident  = "anom.incident"
+	TypeHealth    = "anom.health"
+	TypeLatency   = "anom.latency"
+)
+
+// The reasons a span can be closed for, given as its "close_reason" field.
+const (
+	// No anomalous ruling extended the span within the span width.
+	CloseExpired = "expired"
+	// The span can't expire naturally before the last date of the data.
+	CloseStuck = "stuck"
+	// An anomalous ruling with the opposite sign started a new span.
+	CloseSignFlip = "sign_flip"
+	// Enough consecutive normal rulings arrived to close the span early.
+	CloseNormal = "normal"
+	// The filter shut down while the span was open.
+	CloseShutdown = "shutdown"
+)
+
+// SeriesShard returns the shard, in [0, totalShards), that owns a series. It
+// uses a 32-bit FNV-1a hash of the series code, so every instance (and any
+// external router) assigns a series to the same shard.
+func SeriesShard(series string, totalShards int) int {
+	if totalShards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(series))
+	return int(h.Sum32() % uint32(totalShards))
+}
+
+// BinStart returns the start of the aligned window, or bin, of the given
+// width that a time falls in. Bins are aligned to the zero time, so bins
+// whose width divides a day start at UTC midnight.
+func BinStart(t time.Time, width time.Duration) time.Time {
+	return t.Truncate(width)
+}
+
+// SpanExpiresAt returns the time after which a span ending at end expires,
+// given the span width and the date of the last data expected. It returns the
+// zero time if the span would expire on or after the last date, i.e. it will
+// never get enough data to expire naturally, and so is due immediately.
+func SpanExpiresAt(end time.Time, width time.Duration, lastDate time.Time) time.Time {
+	willExpireAt := end.Add(width)
+	if !willExpireAt.Before(lastDate) {
+		return time.Time{}
+	}
+	return willExpireAt
+}
+
+// SpanExpired reports whether a span ending at end has expired by now, given
+// the span width and the date of the last data expected: either nothing has
+// extended it for a span width, or it will never get enough data to expire
+// naturally.
+func SpanExpired(end time.Time, width time.Duration, lastDate, now time.Time) bool {
+	expiresAt := SpanExpiresAt(end, width, lastDate)
+	return expiresAt.IsZero() || now.After(expiresAt)
+}
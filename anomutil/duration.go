@@ -0,0 +1,48 @@
+package anomutil
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration parses a duration setting, given either as a Go duration
+// string (e.g. "500ms", "15m" or "6h"), a number of days (e.g. "7d") or, as
+// it always used to be, a number of seconds. Nil is zero. The name is used in
+// the error, which is written in the style of hekaanom's configuration errors.
+func ParseDuration(name string, value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return secondsDuration(name, float64(v))
+	case int64:
+		return secondsDuration(name, float64(v))
+	case float64:
+		return secondsDuration(name, v)
+	case string:
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return secondsDuration(name, float64(seconds))
+		}
+		if days, err := strconv.ParseFloat(strings.TrimSuffix(v, "d"), 64); err == nil && strings.HasSuffix(v, "d") {
+			return secondsDuration(name, days*24*60*60)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, errors.New("'" + name + "' must be a number of seconds or a duration such as \"15m\".")
+		}
+		return d, nil
+	}
+	return 0, errors.New("'" + name + "' must be a number of seconds or a duration such as \"15m\".")
+}
+
+// secondsDuration converts a number of seconds to a duration, rejecting
+// numbers that aren't finite or that a duration can't hold (about 292 years).
+func secondsDuration(name string, seconds float64) (time.Duration, error) {
+	if math.IsNaN(seconds) || math.Abs(seconds) >= float64(math.MaxInt64)/float64(time.Second) {
+		return 0, errors.New("'" + name + "' is out of range.")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,34 @@
+package anomutil
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FuzzParseDuration parses arbitrary duration settings, given as strings and
+// as numbers of seconds. Whole numbers of seconds must parse exactly, and
+// errors must name the setting.
+func FuzzParseDuration(f *testing.F) {
+	f.Fuzz(func(t *testing.T, value string, seconds float64) {
+		for _, setting := range []interface{}{value, seconds} {
+			d, err := ParseDuration("span_width", setting)
+			if err != nil {
+				if !strings.Contains(err.Error(), "'span_width'") {
+					t.Errorf("the error for %#v doesn't name the setting: %s", setting, err)
+				}
+				continue
+			}
+			if s, ok := setting.(float64); ok && math.Abs(d.Seconds()-s) > math.Max(1e-6, math.Abs(s)*1e-9) {
+				t.Errorf("%v seconds parsed as %v", s, d)
+			}
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > -1e9 && n < 1e9 {
+			if d, err := ParseDuration("span_width", value); err != nil || d != time.Duration(n)*time.Second {
+				t.Errorf("%q parsed as %v, %v; want %d seconds", value, d, err, n)
+			}
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// The least posterior probability a run length is kept with.
+const bocpdMinRunProbability = 1e-8
+
+// bocpdDetector is a Bayesian online change-point detector, after Adams and
+// MacKay. It keeps, for each series, a posterior over how many windows it's
+// been since the series last changed regime (the run length), modelling each
+// regime as normally distributed with an unknown mean and variance. The
+// change probability is the posterior probability that the run is shorter
+// than lag windows, i.e. that the series changed regime within them. A window
+// is anomalous when the change probability first rises past the threshold,
+// which catches a change in level or spread that's too gradual for an outlier
+// test to notice.
+type bocpdDetector struct {
+	hazard    float64
+	lag       int
+	threshold float64
+	warmup    int
+	maxRun    int
+	series    map[string]*bocpdState
+}
+
+// bocpdState is a series' run length posterior. probs[r] is the probability
+// that the run is r windows long, and the rest hold the Normal-Gamma posterior
+// of the regime's mean and variance given those windows. Until the series has
+// been seen for warmup windows, its windows are added to acc to set the prior
+// from instead.
+type bocpdState struct {
+	acc    accumulator
+	probs  []float64
+	mu     []float64
+	kappa  []float64
+	alpha  []float64
+	beta   []float64
+	above  bool
+	prior  bocpdPrior
+	primed bool
+}
+
+type bocpdPrior struct {
+	mu, kappa, alpha, beta float64
+}
+
+func (d *bocpdDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	expectedRun, err := configFloat(conf, "expected_run", 250)
+	if err != nil {
+		return err
+	}
+	if expectedRun < 1 {
+		return errors.New("'expected_run' must be at least 1")
+	}
+	d.hazard = 1 / expectedRun
+
+	if d.threshold, err = configFloat(conf, "threshold", 0.5); err != nil {
+		return err
+	}
+	if d.threshold <= 0 || d.threshold >= 1 {
+		return errors.New("'threshold' must be between zero and one")
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+		def   int
+		min   int
+	}{
+		{"lag", &d.lag, 10, 1},
+		{"warmup", &d.warmup, 20, 2},
+		{"max_run_length", &d.maxRun, 1000, 2},
+	} {
+		*param.value = param.def
+		if v, ok := conf[param.name]; ok {
+			i, ok := v.(int64)
+			if !ok || int(i) < param.min {
+				return fmt.Errorf("'%s' must be an integer of at least %d", param.name, param.min)
+			}
+			*param.value = int(i)
+		}
+	}
+	if d.lag >= d.maxRun {
+		return errors.New("'lag' must be less than 'max_run_length'")
+	}
+
+	d.series = map[string]*bocpdState{}
+	return nil
+}
+
+func (d *bocpdDetector) Train(win window) {
+	state := d.state(win.Series)
+	if !d.learn(state, win.Value) {
+		d.keep(state, d.update(state, win.Value))
+	}
+}
+
+func (d *bocpdDetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	state, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	d.series[new] = state
+}
+
+func (d *bocpdDetector) Forget(series string) {
+	delete(d.series, series)
+}
+
+// Detect rules on a window once its series' prior has been set. An excluded
+// window is ruled on without being added to the posterior.
+func (d *bocpdDetector) Detect(win window, out chan ruling) {
+	state := d.state(win.Series)
+	if !state.primed {
+		if !win.Excluded {
+			d.learn(state, win.Value)
+		}
+		return
+	}
+
+	direction := win.Value - d.predictedMean(state)
+	next := d.update(state, win.Value)
+	change := 0.0
+	for r := 0; r < d.lag && r < len(next.probs); r++ {
+		change += next.probs[r]
+	}
+	above := change > d.threshold
+	out <- ruling{
+		Window:        win,
+		Anomalous:     above && !state.above,
+		Anomalousness: change,
+		Normed:        math.Copysign(change, direction),
+		Confidence:    math.Min(1, change),
+		Passthrough:   win.Passthrough,
+	}
+	if !win.Excluded {
+		next.above = above
+		d.keep(state, next)
+	}
+}
+
+func (d *bocpdDetector) state(series string) *bocpdState {
+	state, ok := d.series[series]
+	if !ok {
+		state = &bocpdState{}
+		d.series[series] = state
+	}
+	return state
+}
+
+// learn adds a value to the windows a series' prior is set from, if it's not
+// been set yet, reporting whether it was added. The prior expects a regime's
+// mean and variance to be around those of the series' first windows.
+func (d *bocpdDetector) learn(state *bocpdState, value float64) bool {
+	if state.primed {
+		return false
+	}
+	state.acc.Add(value)
+	if state.acc.count < d.warmup {
+		return true
+	}
+	variance := math.Pow(state.acc.Value("StdDev", 0), 2)
+	if variance == 0 || math.IsNaN(variance) {
+		variance = 1
+	}
+	state.prior = bocpdPrior{mu: state.acc.Value("Mean", 0), kappa: 1, alpha: 1, beta: variance}
+	p := state.prior
+	state.probs = []float64{1}
+	state.mu, state.kappa = []float64{p.mu}, []float64{p.kappa}
+	state.alpha, state.beta = []float64{p.alpha}, []float64{p.beta}
+	// The posterior starts out sure the run is short, which isn't a change.
+	state.above = true
+	state.primed = true
+	return true
+}
+
+// predictedMean returns the posterior mean of a series' next value.
+func (d *bocpdDetector) predictedMean(state *bocpdState) float64 {
+	mean := 0.0
+	for r, p := range state.probs {
+		mean += p * state.mu[r]
+	}
+	return mean
+}
+
+// update returns a series' run length posterior with a value added, without
+// changing the series.
+func (d *bocpdDetector) update(state *bocpdState, value float64) *bocpdState {
+	n := len(state.probs)
+	next := &bocpdState{
+		probs: make([]float64, n+1),
+		mu:    make([]float64, n+1),
+		kappa: make([]float64, n+1),
+		alpha: make([]float64, n+1),
+		beta:  make([]float64, n+1),
+		prior: state.prior,
+	}
+
+	// Each run either grows by one window or ends here, weighted by how well
+	// it predicted the value.
+	total := 0.0
+	for r, p := range state.probs {
+		predicted := p * studentTPDF(value, state.mu[r], state.kappa[r], state.alpha[r], state.beta[r])
+		next.probs[r+1] = predicted * (1 - d.hazard)
+		next.probs[0] += predicted * d.hazard
+	}
+	for _, p := range next.probs {
+		total += p
+	}
+	if total == 0 || math.IsNaN(total) {
+		// No run could have produced the value, so a new one has started.
+		for r := range next.probs {
+			next.probs[r] = 0
+		}
+		next.probs[0], total = 1, 1
+	}
+	for r := range next.probs {
+		next.probs[r] /= total
+	}
+
+	p := state.prior
+	next.mu[0], next.kappa[0], next.alpha[0], next.beta[0] = p.mu, p.kappa, p.alpha, p.beta
+	for r := 0; r < n; r++ {
+		mu, kappa := state.mu[r], state.kappa[r]
+		next.mu[r+1] = (kappa*mu + value) / (kappa + 1)
+		next.kappa[r+1] = kappa + 1
+		next.alpha[r+1] = state.alpha[r] + 0.5
+		next.beta[r+1] = state.beta[r] + kappa*(value-mu)*(value-mu)/(2*(kappa+1))
+	}
+
+	d.truncate(next)
+	return next
+}
+
+// truncate drops the longest run lengths while they're too unlikely to
+// matter, or too long to keep.
+func (d *bocpdDetector) truncate(state *bocpdState) {
+	n := len(state.probs)
+	for n > d.lag && (n > d.maxRun || state.probs[n-1] < bocpdMinRunProbability) {
+		n--
+	}
+	state.probs, state.mu, state.kappa = state.probs[:n], state.mu[:n], state.kappa[:n]
+	state.alpha, state.beta = state.alpha[:n], state.beta[:n]
+}
+
+// keep replaces a series' posterior with an updated one.
+func (d *bocpdDetector) keep(state, next *bocpdState) {
+	state.probs, state.mu, state.kappa = next.probs, next.mu, next.kappa
+	state.alpha, state.beta = next.alpha, next.beta
+	state.above = next.above
+}
+
+// studentTPDF returns the density at x of the Normal-Gamma posterior
+// predictive distribution, a Student's t-distribution.
+func studentTPDF(x, mu, kappa, alpha, beta float64) float64 {
+	df := 2 * alpha
+	scale2 := beta * (kappa + 1) / (alpha * kappa)
+	z := (x - mu) * (x - mu) / (df * scale2)
+	lgammaHalf, _ := math.Lgamma((df + 1) / 2)
+	lgamma, _ := math.Lgamma(df / 2)
+	logPDF := lgammaHalf - lgamma - 0.5*math.Log(df*math.Pi*scale2) - (df+1)/2*math.Log1p(z)
+	return math.Exp(logPDF)
+}
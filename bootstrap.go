@@ -0,0 +1,174 @@
+package hekaanom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BootstrapConfig describes where to find the history used to train detector
+// baselines at startup, so that detection starts immediately instead of after
+// a warm-up period.
+type BootstrapConfig struct {
+	// The kind of time series database to query: "graphite" or "prometheus".
+	Source string `toml:"source"`
+
+	// The base URL of the database's HTTP API.
+	URL string `toml:"url"`
+
+	// How many days of history to load.
+	Days int `toml:"days"`
+
+	// A map of series codes to the query that returns their history. Graphite
+	// targets are summed into windows of the configured width. Prometheus
+	// queries are evaluated once per window width and should aggregate
+	// accordingly themselves, e.g. "sum(increase(requests_total[1d]))".
+	Series map[string]string `toml:"series"`
+}
+
+const (
+	bootstrapGraphite   = "graphite"
+	bootstrapPrometheus = "prometheus"
+)
+
+var bootstrapClient = &http.Client{Timeout: time.Minute}
+
+type historyPoint struct {
+	timestamp time.Time
+	value     float64
+}
+
+func (c *BootstrapConfig) validate() error {
+	switch c.Source {
+	case bootstrapGraphite, bootstrapPrometheus:
+	default:
+		return errors.New("Bootstrap 'source' must be either \"graphite\" or \"prometheus\".")
+	}
+	if c.URL == "" {
+		return errors.New("Bootstrap 'url' must be provided.")
+	}
+	if c.Days <= 0 {
+		return errors.New("Bootstrap 'days' must be greater than zero.")
+	}
+	return nil
+}
+
+// history loads the windows of a series from the configured database, oldest
+// first.
+func (c *BootstrapConfig) history(series, query string, width time.Duration, now time.Time) ([]window, error) {
+	from := now.Add(-time.Duration(c.Days) * 24 * time.Hour)
+
+	var points []historyPoint
+	var err error
+	switch c.Source {
+	case bootstrapGraphite:
+		points, err = c.graphiteHistory(query, width, from, now)
+	case bootstrapPrometheus:
+		points, err = c.prometheusHistory(query, width, from, now)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not load history for %s: %s", series, err)
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].timestamp.Before(points[j].timestamp) })
+	windows := make([]window, len(points))
+	for i, point := range points {
+		windows[i] = window{
+			Start:  point.timestamp,
+			End:    point.timestamp.Add(width),
+			Series: series,
+			Value:  point.value,
+		}
+	}
+	return windows, nil
+}
+
+func (c *BootstrapConfig) graphiteHistory(query string, width time.Duration, from, until time.Time) ([]historyPoint, error) {
+	params := url.Values{}
+	params.Set("target", fmt.Sprintf("summarize(%s,\"%ds\",\"sum\",true)", query, int64(width/time.Second)))
+	params.Set("from", strconv.FormatInt(from.Unix(), 10))
+	params.Set("until", strconv.FormatInt(until.Unix(), 10))
+	params.Set("format", "json")
+
+	var result []struct {
+		Datapoints [][2]*float64 `json:"datapoints"`
+	}
+	if err := getJSON(c.URL+"/render?"+params.Encode(), &result); err != nil {
+		return nil, err
+	}
+
+	var points []historyPoint
+	for _, target := range result {
+		for _, dp := range target.Datapoints {
+			if dp[0] == nil || dp[1] == nil {
+				continue
+			}
+			points = append(points, historyPoint{time.Unix(int64(*dp[1]), 0), *dp[0]})
+		}
+	}
+	return points, nil
+}
+
+func (c *BootstrapConfig) prometheusHistory(query string, width time.Duration, from, until time.Time) ([]historyPoint, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(from.Unix(), 10))
+	params.Set("end", strconv.FormatInt(until.Unix(), 10))
+	params.Set("step", strconv.FormatInt(int64(width/time.Second), 10))
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result []struct {
+				Values [][2]interface{} `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := getJSON(c.URL+"/api/v1/query_range?"+params.Encode(), &result); err != nil {
+		return nil, err
+	}
+	if result.Status != "success" {
+		return nil, errors.New(result.Error)
+	}
+
+	var points []historyPoint
+	for _, series := range result.Data.Result {
+		for _, v := range series.Values {
+			ts, ok := v[0].(float64)
+			if !ok {
+				continue
+			}
+			str, ok := v[1].(string)
+			if !ok {
+				continue
+			}
+			val, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				continue
+			}
+			// Prometheus evaluates at the end of each step, so the window
+			// started one width earlier.
+			end := time.Unix(0, int64(ts*float64(time.Second)))
+			points = append(points, historyPoint{end.Add(-width), val})
+		}
+	}
+	return points, nil
+}
+
+func getJSON(u string, v interface{}) error {
+	resp, err := bootstrapClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
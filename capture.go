@@ -0,0 +1,340 @@
+package hekaanom
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/berkmancenter/hekaanom/anomutil"
+	"github.com/mozilla-services/heka/message"
+)
+
+// The stages whose input can be captured and replayed.
+const (
+	// Metrics (or windows, when windows are the input) going into the window
+	// stage.
+	captureWindow = "window"
+	// Windows going into the detect stage.
+	captureDetect = "detect"
+	// Batches of rulings going into the gather stage.
+	captureGather = "gather"
+
+	// The message type that starts a capture.
+	captureMessageType = "anom.capture"
+)
+
+// captureEntry is a line of a capture file: an item that went into a stage,
+// and when it did.
+type captureEntry struct {
+	At    string          `json:"at"`
+	Stage string          `json:"stage"`
+	Item  json.RawMessage `json:"item"`
+}
+
+// activeCapture is a capture file still recording.
+type activeCapture struct {
+	file  *os.File
+	until time.Time
+}
+
+// capturer records the exact sequence of items going into a stage, for a
+// while, to a file in its directory when asked to by an "anom.capture"
+// message, so that it can be replayed to reproduce a problem.
+type capturer struct {
+	sync.Mutex
+	dir    string
+	active map[string]*activeCapture
+}
+
+func newCapturer(dir string) *capturer {
+	return &capturer{dir: dir, active: map[string]*activeCapture{}}
+}
+
+// Start opens a capture of a stage's input for a while, replacing any capture
+// already open on it, and returns the file the input will be written to.
+func (c *capturer) Start(stage string, d time.Duration) (string, error) {
+	switch stage {
+	case captureWindow, captureDetect, captureGather:
+	default:
+		return "", fmt.Errorf("Can't capture unknown stage %q.", stage)
+	}
+	if d <= 0 {
+		return "", errors.New("A capture's 'duration' must be greater than zero.")
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("capture-%s-%d.jsonl", stage, now.UnixNano())
+	path := filepath.Join(c.dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.active[stage]; ok {
+		old.file.Close()
+	}
+	c.active[stage] = &activeCapture{file: file, until: now.Add(d)}
+	return path, nil
+}
+
+// StartFromMessage opens the capture an "anom.capture" message asks for with
+// its "stage" and "duration" fields. The duration is in seconds, or a duration
+// string such as "5m".
+func (c *capturer) StartFromMessage(msg *message.Message) (string, error) {
+	stage, _ := msg.GetFieldValue("stage")
+	stageName, ok := stage.(string)
+	if !ok {
+		return "", errors.New("A capture message needs a string 'stage' field.")
+	}
+	duration, _ := msg.GetFieldValue("duration")
+	d, err := anomutil.ParseDuration("duration", duration)
+	if err != nil {
+		return "", err
+	}
+	return c.Start(stageName, d)
+}
+
+// Record writes an item going into a stage to the stage's capture, if it has
+// one that's still recording.
+func (c *capturer) Record(stage string, item interface{}) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	capture, ok := c.active[stage]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.After(capture.until) {
+		capture.file.Close()
+		delete(c.active, stage)
+		return
+	}
+	encoded, err := json.Marshal(item)
+	if err == nil {
+		entry := captureEntry{At: encodeTime(now), Stage: stage, Item: encoded}
+		if encoded, err = json.Marshal(entry); err == nil {
+			_, err = capture.file.Write(append(encoded, '\n'))
+		}
+	}
+	if err != nil {
+		capture.file.Close()
+		delete(c.active, stage)
+	}
+}
+
+// Expire closes the captures that have finished recording, in case their
+// stages have gone quiet.
+func (c *capturer) Expire(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for stage, capture := range c.active {
+		if now.After(capture.until) {
+			capture.file.Close()
+			delete(c.active, stage)
+		}
+	}
+}
+
+// ConnectWindows passes windows through, recording them as the detect stage's
+// input.
+func (c *capturer) ConnectWindows(in chan window) chan window {
+	if c == nil {
+		return in
+	}
+	out := make(chan window)
+	go func() {
+		defer close(out)
+		for win := range in {
+			if !win.evicted {
+				c.Record(captureDetect, win)
+			}
+			out <- win
+		}
+	}()
+	return out
+}
+
+// ConnectRulings passes batches of rulings through, recording them as the
+// gather stage's input.
+func (c *capturer) ConnectRulings(in chan []ruling) chan []ruling {
+	if c == nil {
+		return in
+	}
+	out := make(chan []ruling)
+	go func() {
+		defer close(out)
+		for batch := range in {
+			c.Record(captureGather, batch)
+			out <- batch
+		}
+	}()
+	return out
+}
+
+// Close closes any captures still open.
+func (c *capturer) Close() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for stage, capture := range c.active {
+		capture.file.Close()
+		delete(c.active, stage)
+	}
+}
+
+// replay holds a capture file's items, to be fed back into their stage in the
+// order they were recorded.
+type replay struct {
+	stage   string
+	metrics []metric
+	windows []window
+	rulings [][]ruling
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// loadReplay reads a capture file. Window stage captures hold windows rather
+// than metrics if windowInput is set.
+func loadReplay(path string, windowInput bool) (*replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := &replay{stop: make(chan struct{})}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry captureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if r.stage == "" {
+			r.stage = entry.Stage
+		} else if entry.Stage != r.stage {
+			return nil, fmt.Errorf("%s:%d: a capture file must hold a single stage's input", path, line)
+		}
+		switch {
+		case entry.Stage == captureWindow && !windowInput:
+			var m metric
+			err = json.Unmarshal(entry.Item, &m)
+			r.metrics = append(r.metrics, m)
+		case entry.Stage == captureWindow, entry.Stage == captureDetect:
+			var win window
+			err = json.Unmarshal(entry.Item, &win)
+			r.windows = append(r.windows, win)
+		case entry.Stage == captureGather:
+			var batch []ruling
+			err = json.Unmarshal(entry.Item, &batch)
+			r.rulings = append(r.rulings, batch)
+		default:
+			err = fmt.Errorf("unknown stage %q", entry.Stage)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if r.stage == "" {
+		return nil, fmt.Errorf("%s: the capture is empty", path)
+	}
+	return r, nil
+}
+
+// Metrics feeds the replayed metrics into a channel, in order, then calls
+// done. If owned is set, the channel is closed once the replay stops sending,
+// whether it's finished or been stopped.
+func (r *replay) Metrics(out chan metric, owned bool, done func()) {
+	r.run(len(r.metrics), func(i int) bool {
+		select {
+		case out <- r.metrics[i]:
+			return true
+		case <-r.stop:
+			return false
+		}
+	}, done, func() {
+		if owned {
+			close(out)
+		}
+	})
+}
+
+// Windows feeds the replayed windows into a channel, in order, then calls
+// done. If owned is set, the channel is closed once the replay stops sending.
+func (r *replay) Windows(out chan window, owned bool, done func()) {
+	r.run(len(r.windows), func(i int) bool {
+		select {
+		case out <- r.windows[i]:
+			return true
+		case <-r.stop:
+			return false
+		}
+	}, done, func() {
+		if owned {
+			close(out)
+		}
+	})
+}
+
+// Rulings feeds the replayed batches of rulings into a channel, in order,
+// then calls done. If owned is set, the channel is closed once the replay
+// stops sending.
+func (r *replay) Rulings(out chan []ruling, owned bool, done func()) {
+	r.run(len(r.rulings), func(i int) bool {
+		select {
+		case out <- r.rulings[i]:
+			return true
+		case <-r.stop:
+			return false
+		}
+	}, done, func() {
+		if owned {
+			close(out)
+		}
+	})
+}
+
+// run sends the items one at a time until they've all been sent, or the
+// replay is stopped, then calls finish.
+func (r *replay) run(n int, send func(i int) bool, done, finish func()) {
+	r.stopped = make(chan struct{})
+	go func() {
+		defer close(r.stopped)
+		defer finish()
+		for i := 0; i < n; i++ {
+			if !send(i) {
+				return
+			}
+		}
+		done()
+	}()
+}
+
+// Stop stops the replay, returning once it's no longer sending.
+func (r *replay) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	if r.stopped != nil {
+		<-r.stopped
+	}
+}
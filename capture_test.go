@@ -0,0 +1,67 @@
+package hekaanom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGatherReplayFlushesOpenSpans(t *testing.T) {
+	start := time.Unix(0, 0)
+	r := &replay{
+		stage: captureGather,
+		rulings: [][]ruling{{{
+			Window:    window{Series: "web", Start: start, End: start.Add(time.Minute)},
+			Anomalous: true,
+			Normed:    5,
+		}}},
+		stop: make(chan struct{}),
+	}
+
+	rulings := make(chan []ruling)
+	finished := make(chan struct{})
+	r.Rulings(rulings, true, func() { close(finished) })
+	spans := newTestGatherFilter(t, nil).Connect(rulings)
+
+	var flushed []span
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case s, ok := <-spans:
+			if !ok {
+				done = true
+				break
+			}
+			flushed = append(flushed, s)
+		case <-timeout:
+			t.Fatal("the end of the replay didn't end the gather stage")
+		}
+	}
+	<-finished
+	if len(flushed) != 1 || flushed[0].CloseReason != closeShutdown {
+		t.Fatalf("got %+v, want the open span closed at the end of the replay", flushed)
+	}
+	r.Stop()
+}
+
+func TestStoppedReplayClosesOnlyOwnedChannels(t *testing.T) {
+	start := time.Unix(0, 0)
+	windows := []window{{Series: "web", Start: start}, {Series: "web", Start: start.Add(time.Minute)}}
+	for _, owned := range []bool{true, false} {
+		r := &replay{stage: captureDetect, windows: windows, stop: make(chan struct{})}
+		out := make(chan window)
+		r.Windows(out, owned, func() { t.Error("a stopped replay shouldn't finish") })
+		<-out
+		r.Stop()
+
+		select {
+		case _, ok := <-out:
+			if ok || !owned {
+				t.Errorf("owned %v: the replay sent a window after it was stopped", owned)
+			}
+		default:
+			if owned {
+				t.Error("the replay's channel wasn't closed when it was stopped")
+			}
+		}
+	}
+}
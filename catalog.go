@@ -0,0 +1,305 @@
+package hekaanom
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// CatalogEntry holds the settings for every series matching its Series
+// pattern. Zero values fall back to the filter's own configuration.
+type CatalogEntry struct {
+	// A regular expression matching the series this entry applies to.
+	Series string `json:"series"`
+
+	// Overrides for the window and gather stages' widths, in seconds.
+	WindowWidth int64 `json:"window_width"`
+	SpanWidth   int64 `json:"span_width"`
+
+	// Descriptive metadata about the series.
+	Owner   string `json:"owner"`
+	Tier    string `json:"tier"`
+	Runbook string `json:"runbook"`
+	Route   string `json:"route"`
+
+	// Whether the series' windows are only added to its baseline, without
+	// being ruled on.
+	ObserveOnly bool `json:"observe_only"`
+
+	re *regexp.Regexp
+}
+
+// The most series whose matching entries a catalog caches. The cache starts
+// over once it's full, so that series that come and go don't grow it forever.
+const catalogMatchLimit = 100000
+
+// catalog is a set of per-series settings loaded from a JSON or CSV file or
+// URL. Entries are matched in order and the first match wins. A nil catalog
+// matches nothing.
+type catalog struct {
+	sync.RWMutex
+	source   string
+	entries  []CatalogEntry
+	matches  map[string]int
+	modTime  time.Time
+	contents []byte
+}
+
+func newCatalog(source string) (*catalog, error) {
+	c := &catalog{source: source}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the catalog if its source has changed, and reports whether
+// it did. The existing entries are kept if the new ones can't be loaded.
+func (c *catalog) Reload() (bool, error) {
+	contents, modTime, err := c.fetch()
+	if err != nil {
+		return false, err
+	}
+	if contents == nil {
+		return false, nil
+	}
+
+	entries, err := parseCatalog(contents)
+	if err != nil {
+		return false, fmt.Errorf("Could not parse catalog %s: %s", c.source, err)
+	}
+
+	c.Lock()
+	c.entries = entries
+	c.matches = map[string]int{}
+	c.modTime = modTime
+	c.contents = contents
+	c.Unlock()
+	return true, nil
+}
+
+// fetch returns the catalog source's contents, or nil if they haven't changed
+// since they were last loaded.
+func (c *catalog) fetch() ([]byte, time.Time, error) {
+	c.RLock()
+	lastMod, lastContents := c.modTime, c.contents
+	c.RUnlock()
+
+	if strings.HasPrefix(c.source, "http://") || strings.HasPrefix(c.source, "https://") {
+		resp, err := http.Get(c.source)
+		if err != nil {
+			return nil, lastMod, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, lastMod, fmt.Errorf("Could not fetch catalog %s: %s", c.source, resp.Status)
+		}
+		contents, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, lastMod, err
+		}
+		if lastContents != nil && bytes.Equal(contents, lastContents) {
+			return nil, lastMod, nil
+		}
+		return contents, time.Now(), nil
+	}
+
+	info, err := os.Stat(c.source)
+	if err != nil {
+		return nil, lastMod, err
+	}
+	if lastContents != nil && info.ModTime().Equal(lastMod) {
+		return nil, lastMod, nil
+	}
+	contents, err := ioutil.ReadFile(c.source)
+	if err != nil {
+		return nil, lastMod, err
+	}
+	return contents, info.ModTime(), nil
+}
+
+// Lookup returns the catalog entry for a series.
+func (c *catalog) Lookup(series string) (CatalogEntry, bool) {
+	if c == nil {
+		return CatalogEntry{}, false
+	}
+
+	c.RLock()
+	i, ok := c.matches[series]
+	if ok {
+		defer c.RUnlock()
+		return c.entry(i)
+	}
+	c.RUnlock()
+
+	c.Lock()
+	defer c.Unlock()
+	i, ok = c.matches[series]
+	if !ok {
+		i = -1
+		for j, entry := range c.entries {
+			if entry.re.MatchString(series) {
+				i = j
+				break
+			}
+		}
+		if len(c.matches) >= catalogMatchLimit {
+			c.matches = map[string]int{}
+		}
+		c.matches[series] = i
+	}
+	return c.entry(i)
+}
+
+// entry returns the entry at an index into the catalog, if it's not negative.
+// The catalog must be locked.
+func (c *catalog) entry(i int) (CatalogEntry, bool) {
+	if i < 0 {
+		return CatalogEntry{}, false
+	}
+	return c.entries[i], true
+}
+
+// Forget drops the cached match of a series.
+func (c *catalog) Forget(series string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.matches, series)
+}
+
+// Group returns the route of a series, or its owner if it has no route. Series
+// that share a group are assumed to be looked after by the same people.
+func (c *catalog) Group(series string) string {
+	entry, _ := c.Lookup(series)
+	if entry.Route != "" {
+		return entry.Route
+	}
+	return entry.Owner
+}
+
+// FillMessage adds the catalog metadata for a series (owner, tier, runbook and
+// route) to a message, so that emitted records are self-describing.
+func (c *catalog) FillMessage(series string, m *message.Message) error {
+	entry, ok := c.Lookup(series)
+	if !ok {
+		return nil
+	}
+	metadata := []struct{ name, value string }{
+		{"owner", entry.Owner},
+		{"tier", entry.Tier},
+		{"runbook", entry.Runbook},
+		{"route", entry.Route},
+	}
+	for _, md := range metadata {
+		if md.value == "" {
+			continue
+		}
+		field, err := message.NewField(md.name, md.value, "")
+		if err != nil {
+			return fmt.Errorf("Could not create '%s' field", md.name)
+		}
+		m.AddField(field)
+	}
+	return nil
+}
+
+// parseCatalog reads a JSON array of entries or a CSV file whose header row
+// names the entry fields.
+func parseCatalog(contents []byte) ([]CatalogEntry, error) {
+	var entries []CatalogEntry
+	trimmed := bytes.TrimSpace(contents)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		records, err := csv.NewReader(bytes.NewReader(trimmed)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+		header := records[0]
+		for _, record := range records[1:] {
+			entry, err := catalogEntryFromRecord(header, record)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for i := range entries {
+		if entries[i].Series == "" {
+			return nil, errors.New("Every catalog entry must have a 'series' pattern.")
+		}
+		re, err := regexp.Compile(entries[i].Series)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].re = re
+	}
+	return entries, nil
+}
+
+func catalogEntryFromRecord(header, record []string) (CatalogEntry, error) {
+	var entry CatalogEntry
+	for i, column := range header {
+		if i >= len(record) {
+			break
+		}
+		name := strings.TrimSpace(column)
+		value := strings.TrimSpace(record[i])
+		switch name {
+		case "series":
+			entry.Series = value
+		case "window_width", "span_width":
+			if value == "" {
+				continue
+			}
+			width, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return entry, fmt.Errorf("Invalid '%s' %q", name, value)
+			}
+			if name == "window_width" {
+				entry.WindowWidth = width
+			} else {
+				entry.SpanWidth = width
+			}
+		case "owner":
+			entry.Owner = value
+		case "tier":
+			entry.Tier = value
+		case "runbook":
+			entry.Runbook = value
+		case "route":
+			entry.Route = value
+		case "observe_only":
+			if value == "" {
+				continue
+			}
+			observeOnly, err := strconv.ParseBool(value)
+			if err != nil {
+				return entry, fmt.Errorf("Invalid '%s' %q", name, value)
+			}
+			entry.ObserveOnly = observeOnly
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,26 @@
+package hekaanom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCatalogMatchesBounded(t *testing.T) {
+	entries, err := parseCatalog([]byte(`[{"series": "^web", "owner": "web-team"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &catalog{entries: entries, matches: map[string]int{}}
+	for i := 0; i <= catalogMatchLimit; i++ {
+		c.Lookup(fmt.Sprintf("series-%d", i))
+	}
+	if len(c.matches) > catalogMatchLimit {
+		t.Errorf("cached %d matches, more than the limit of %d", len(c.matches), catalogMatchLimit)
+	}
+	if entry, ok := c.Lookup("web-1"); !ok || entry.Owner != "web-team" {
+		t.Errorf("got %+v, %v for a matching series", entry, ok)
+	}
+	if entry, ok := c.Lookup("web-1"); !ok || entry.Owner != "web-team" {
+		t.Errorf("got %+v, %v for a cached match", entry, ok)
+	}
+}
@@ -0,0 +1,165 @@
+package hekaanom
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+)
+
+const (
+	chartWidth   = 240
+	chartHeight  = 80
+	chartPadding = 4
+
+	// The most windows drawn either side of a span for context.
+	chartContext = 10
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartAxis       = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	chartBand       = color.RGBA{0xde, 0xeb, 0xf7, 0xff}
+	chartAround     = color.RGBA{0x99, 0x99, 0x99, 0xff}
+	chartLine       = color.RGBA{0xd6, 0x27, 0x28, 0xff}
+)
+
+// renderChart draws a small line chart of a span's window values as a PNG
+// image, between the values of the windows before and after the span, which
+// are drawn in grey. The band behind them spans two standard deviations
+// either side of the mean of the values before the span. The horizontal line
+// marks zero if it falls within the chart's range. Values that aren't finite
+// are skipped.
+func renderChart(before, values, after []float64) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	for x := 0; x < chartWidth; x++ {
+		for y := 0; y < chartHeight; y++ {
+			img.Set(x, y, chartBackground)
+		}
+	}
+
+	all := make([]float64, 0, len(before)+len(values)+len(after))
+	all = append(append(append(all, before...), values...), after...)
+	low, high, banded := baselineBand(before)
+
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, val := range all {
+		if !math.IsNaN(val) && !math.IsInf(val, 0) {
+			min = math.Min(min, val)
+			max = math.Max(max, val)
+		}
+	}
+	if banded {
+		min = math.Min(min, low)
+		max = math.Max(max, high)
+	}
+
+	if min <= max {
+		if max == min {
+			min, max = min-1, max+1
+		}
+
+		plotWidth := float64(chartWidth - 2*chartPadding - 1)
+		plotHeight := float64(chartHeight - 2*chartPadding - 1)
+		toX := func(i int) int {
+			if len(all) == 1 {
+				return chartPadding
+			}
+			return chartPadding + int(math.Round(float64(i)/float64(len(all)-1)*plotWidth))
+		}
+		toY := func(val float64) int {
+			return chartPadding + int(math.Round((max-val)/(max-min)*plotHeight))
+		}
+
+		if banded {
+			for y := toY(high); y <= toY(low); y++ {
+				for x := chartPadding; x < chartWidth-chartPadding; x++ {
+					img.Set(x, y, chartBand)
+				}
+			}
+		}
+
+		if min < 0 && max > 0 {
+			zero := toY(0)
+			for x := chartPadding; x < chartWidth-chartPadding; x++ {
+				img.Set(x, zero, chartAxis)
+			}
+		}
+
+		prevX, prevY := -1, -1
+		for i, val := range all {
+			if math.IsNaN(val) || math.IsInf(val, 0) {
+				continue
+			}
+			c := chartLine
+			if i < len(before) || i >= len(before)+len(values) {
+				c = chartAround
+			}
+			x, y := toX(i), toY(val)
+			if prevX >= 0 {
+				drawLine(img, prevX, prevY, x, y, c)
+			} else {
+				img.Set(x, y, c)
+			}
+			prevX, prevY = x, y
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// baselineBand returns the range two standard deviations either side of the
+// mean of the finite values, and false if there are fewer than two of them.
+func baselineBand(values []float64) (low, high float64, ok bool) {
+	var acc accumulator
+	for _, val := range values {
+		if !math.IsNaN(val) && !math.IsInf(val, 0) {
+			acc.Add(val)
+		}
+	}
+	if acc.count < 2 {
+		return 0, 0, false
+	}
+	mean, stdDev := acc.Value("Mean", 0), acc.Value("StdDev", 0)
+	return mean - 2*stdDev, mean + 2*stdDev, true
+}
+
+// drawLine draws a line between two points using Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
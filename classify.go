@@ -0,0 +1,94 @@
+package hekaanom
+
+import (
+	"math"
+	"sort"
+)
+
+// The shapes a span can be classified as.
+const (
+	classSpike       = "spike"
+	classRamp        = "ramp"
+	classLevelShift  = "level_shift"
+	classOscillation = "oscillation"
+)
+
+// classify labels the shape of a sequence of span values: a "spike" is
+// dominated by a brief peak, a "ramp" climbs or falls steadily, an
+// "oscillation" keeps changing direction, and a "level_shift" stays at a
+// roughly constant level.
+func classify(values []float64) string {
+	n := len(values)
+	if n < 3 {
+		return classSpike
+	}
+
+	min, max, meanAbs := values[0], values[0], 0.0
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		meanAbs += math.Abs(v) / float64(n)
+	}
+
+	// Count how often the direction of change reverses. Reversals only make
+	// an oscillation if they're large compared to the span's level, rather
+	// than noise around a steady level.
+	reversals, prevDir := 0, 0
+	for i := 1; i < n; i++ {
+		dir := 0
+		if d := values[i] - values[i-1]; d > 0 {
+			dir = 1
+		} else if d < 0 {
+			dir = -1
+		}
+		if dir != 0 && prevDir != 0 && dir != prevDir {
+			reversals++
+		}
+		if dir != 0 {
+			prevDir = dir
+		}
+	}
+	if n >= 4 && reversals*2 >= n-1 && max-min > meanAbs/2 {
+		return classOscillation
+	}
+
+	if rSquared(values) >= 0.8 {
+		return classRamp
+	}
+
+	abs := make([]float64, n)
+	for i, v := range values {
+		abs[i] = math.Abs(v)
+	}
+	sort.Float64s(abs)
+	median := abs[n/2]
+	if n%2 == 0 {
+		median = (abs[n/2-1] + abs[n/2]) / 2
+	}
+	if abs[n-1] > 3*median {
+		return classSpike
+	}
+	return classLevelShift
+}
+
+// rSquared returns the coefficient of determination of a least squares line
+// fitted to values against their positions.
+func rSquared(values []float64) float64 {
+	n := float64(len(values))
+	var sumX, sumY, sumXY, sumXX, sumYY float64
+	for i, y := range values {
+		x := float64(i)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+		sumYY += y * y
+	}
+	varX := n*sumXX - sumX*sumX
+	varY := n*sumYY - sumY*sumY
+	if varX == 0 || varY == 0 {
+		return 0
+	}
+	cov := n*sumXY - sumX*sumY
+	return cov * cov / (varX * varY)
+}
@@ -0,0 +1,144 @@
+package hekaanom
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+const cloudEventsSpecVersion = "1.0"
+
+var defaultCloudEventsSource = "hekaanom"
+
+// The fields of the filter's messages that can hold any number of values.
+// They're always encoded as arrays, so that consumers don't have to handle a
+// lone value differently.
+var repeatedFields = map[string]bool{
+	"values":            true,
+	"window_values":     true,
+	"histogram_lower":   true,
+	"histogram_upper":   true,
+	"histogram_weights": true,
+	"point_times":       true,
+	"point_values":      true,
+	"span_series":       true,
+	"span_start":        true,
+	"span_end":          true,
+	"span_score":        true,
+}
+
+func init() {
+	pipeline.RegisterPlugin("AnomalyCloudEventsEncoder",
+		func() interface{} {
+			return new(CloudEventsEncoder)
+		})
+}
+
+type CloudEventsEncoderConfig struct {
+	// The CloudEvents "source" attribute attached to every event, identifying
+	// the context in which the anomalies were detected.
+	Source string `toml:"source"`
+
+	// An optional prefix for the CloudEvents "type" attribute. The Heka message
+	// type (e.g. "anom.span") is appended to it.
+	TypePrefix string `toml:"type_prefix"`
+}
+
+// CloudEventsEncoder is a Heka encoder that turns the ruling and span messages
+// emitted by AnomalyFilter into CloudEvents 1.0 JSON. The series becomes the
+// event's subject and the message fields become its data.
+type CloudEventsEncoder struct {
+	*CloudEventsEncoderConfig
+}
+
+type cloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Subject         string                 `json:"subject,omitempty"`
+	Sequence        string                 `json:"sequence,omitempty"`
+	Time            string                 `json:"time"`
+	DataContentType string                 `json:"datacontenttype"`
+	Data            map[string]interface{} `json:"data"`
+}
+
+// ConfigStruct implements Heka's HasConfigStruct interface.
+func (e *CloudEventsEncoder) ConfigStruct() interface{} {
+	return &CloudEventsEncoderConfig{
+		Source: defaultCloudEventsSource,
+	}
+}
+
+// Init implements Heka's Plugin interface.
+func (e *CloudEventsEncoder) Init(config interface{}) error {
+	e.CloudEventsEncoderConfig = config.(*CloudEventsEncoderConfig)
+	if e.CloudEventsEncoderConfig.Source == "" {
+		e.CloudEventsEncoderConfig.Source = defaultCloudEventsSource
+	}
+	return nil
+}
+
+// Encode implements Heka's Encoder interface.
+func (e *CloudEventsEncoder) Encode(pack *pipeline.PipelinePack) ([]byte, error) {
+	msg := pack.Message
+
+	event := cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              msg.GetUuidString(),
+		Source:          e.CloudEventsEncoderConfig.Source,
+		Type:            e.CloudEventsEncoderConfig.TypePrefix + msg.GetType(),
+		Time:            time.Unix(0, msg.GetTimestamp()).UTC().Format(timeFormat),
+		DataContentType: "application/json",
+		Data:            map[string]interface{}{},
+	}
+
+	for _, field := range msg.GetFields() {
+		event.Data[field.GetName()] = eventValue(field)
+	}
+	if series, ok := event.Data["series"].(string); ok {
+		event.Subject = series
+	}
+	// The sequence extension's values must sort lexicographically.
+	if sequence, ok := event.Data["sequence"].(int64); ok {
+		event.Sequence = fmt.Sprintf("%020d", sequence)
+	}
+
+	output, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return append(output, '\n'), nil
+}
+
+// fieldValue returns a field's value, as a slice if the field has more than
+// one value.
+func fieldValue(field *message.Field) interface{} {
+	values := fieldValues(field)
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+// eventValue returns a field's value for an event's data. Repeated fields are
+// always slices, and numbers that aren't finite are encoded as strings, as
+// they are in serialized windows, rulings and spans.
+func eventValue(field *message.Field) interface{} {
+	values := fieldValues(field)
+	for i, v := range values {
+		if f, ok := v.(float64); ok {
+			values[i] = jsonFloat(f)
+		}
+	}
+	if !repeatedFields[field.GetName()] && len(values) == 1 {
+		return values[0]
+	}
+	if values == nil {
+		return []interface{}{}
+	}
+	return values
+}
@@ -0,0 +1,54 @@
+package hekaanom
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+func TestCloudEventsEncoding(t *testing.T) {
+	e := &CloudEventsEncoder{}
+	if err := e.Init(e.ConfigStruct()); err != nil {
+		t.Fatal(err)
+	}
+	msg := &message.Message{}
+	msg.SetType("anom.span")
+	for name, value := range map[string]interface{}{
+		"series":        "web",
+		"score":         math.NaN(),
+		"window_values": 2.5,
+	} {
+		field, err := message.NewField(name, value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.AddField(field)
+	}
+
+	output, err := e.Encode(&pipeline.PipelinePack{Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Subject string
+		Data    struct {
+			Score        interface{} `json:"score"`
+			WindowValues []float64   `json:"window_values"`
+		}
+	}
+	if err := json.Unmarshal(output, &event); err != nil {
+		t.Fatalf("%s: %s", err, output)
+	}
+	if event.Subject != "web" {
+		t.Errorf("got subject %q, want \"web\"", event.Subject)
+	}
+	if event.Data.Score != "NaN" {
+		t.Errorf("got a score of %v, want \"NaN\"", event.Data.Score)
+	}
+	if len(event.Data.WindowValues) != 1 || event.Data.WindowValues[0] != 2.5 {
+		t.Errorf("got window values %v, want [2.5]", event.Data.WindowValues)
+	}
+}
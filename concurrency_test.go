@@ -0,0 +1,335 @@
+package hekaanom
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/berkmancenter/hekaanom/anomutil"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// These tests are meant to be run with -race. They push thousands of series
+// through the stages while flushing and inspecting them from other
+// goroutines, the way Heka's timer and reporting goroutines do, to hold the
+// stages to their locking contract: anything that may be called while the
+// stages run takes the lock of the state it touches.
+
+const (
+	stressSeries  = 2000
+	stressMinutes = 5
+)
+
+// stressMetrics returns a metric a minute, out of order across series but in
+// order within each, for every stress series.
+func stressMetrics(start time.Time) []metric {
+	r := rand.New(rand.NewSource(1))
+	metrics := make([]metric, 0, stressSeries*stressMinutes)
+	for minute := 0; minute < stressMinutes; minute++ {
+		for _, i := range r.Perm(stressSeries) {
+			metrics = append(metrics, metric{
+				Timestamp: start.Add(time.Duration(minute)*time.Minute + time.Duration(i)*time.Millisecond),
+				Series:    fmt.Sprintf("series-%d", i),
+				Value:     r.ExpFloat64(),
+			})
+		}
+	}
+	return metrics
+}
+
+// untilClosed calls fn over and over in its own goroutine until stop is
+// closed, marking wg done when it returns.
+func untilClosed(stop chan struct{}, wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				fn()
+			}
+		}
+	}()
+}
+
+func TestStagesConcurrency(t *testing.T) {
+	windower := newTestWindowFilter(t, func(conf *WindowConfig) {
+		conf.AlignWindows = true
+		conf.FlushExpired = true
+		conf.Workers = 4
+	})
+	detector := &detectFilter{}
+	detectConf := detector.ConfigStruct().(*DetectConfig)
+	detectConf.Algorithm = "EWMA"
+	detectConf.DetectorConfig = map[string]interface{}{"warmup": int64(1)}
+	detectConf.maxProcs = 4
+	detectConf.BatchSize = 16
+	detectConf.PrioritySeries = []string{"^series-1"}
+	if err := detector.Init(detectConf); err != nil {
+		t.Fatal(err)
+	}
+	gatherer := newTestGatherFilter(t, nil)
+	latency := newLatencyTracker()
+
+	metrics := make(chan metric)
+	spans := gatherer.Connect(detector.Connect(windower.Connect(metrics)))
+
+	// Heka's timer and reporting goroutines flush and inspect the stages
+	// while they run. They have stopped by the time the input ends, as Heka
+	// stops calling TimerEvent before CleanUp.
+	start := time.Unix(0, 0)
+	stop := make(chan struct{})
+	var introspection sync.WaitGroup
+	untilClosed(stop, &introspection, func() {
+		windower.FlushExpiredWindows(start.Add(stressMinutes * time.Minute))
+		gatherer.FlushExpiredSpans(start.Add(2*time.Hour), spans)
+	})
+	untilClosed(stop, &introspection, func() {
+		msg := &message.Message{}
+		if err := windower.ReportMsg(msg); err != nil {
+			t.Error(err)
+		}
+		if err := gatherer.ReportMsg(msg); err != nil {
+			t.Error(err)
+		}
+	})
+	untilClosed(stop, &introspection, func() {
+		gatherer.spanCache.Snapshot()
+		windower.intervals.Intervals()
+		detector.QueueLengths()
+		latency.Reports()
+	})
+
+	go func() {
+		for _, m := range stressMetrics(start) {
+			metrics <- m
+		}
+		close(stop)
+		introspection.Wait()
+		close(metrics)
+	}()
+
+	var flushed int
+	for s := range spans {
+		latency.Observe(stageGather, time.Since(s.lastRuled))
+		flushed++
+	}
+
+	msg := &message.Message{}
+	if err := gatherer.ReportMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if open, _ := msg.GetFieldValue("OpenSpans"); open.(int64) != 0 {
+		t.Errorf("%v spans were left open", open)
+	}
+	if got, _ := msg.GetFieldValue("FlushedSpans"); got.(int64) != int64(flushed) {
+		t.Errorf("the gather stage counted %v flushed spans, but %d were received", got, flushed)
+	}
+	if got := windower.intervals.SeriesCount(); got != stressSeries {
+		t.Errorf("tracked %d series, want %d", got, stressSeries)
+	}
+}
+
+func TestSpanCacheConcurrency(t *testing.T) {
+	f := newTestGatherFilter(t, nil)
+	start := time.Unix(0, 0)
+	out := make(chan span, stressSeries)
+
+	// Gathering, flushing and inspecting each lock a shard at a time, in
+	// whatever order they get to it.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < stressSeries; i += 4 {
+				series := fmt.Sprintf("series-%d", i)
+				shard := f.spanCache.shard(series)
+				shard.lock()
+				f.gather(shard, ruling{
+					Window:    window{Series: series, Start: start, End: start.Add(time.Minute)},
+					Anomalous: true,
+					Normed:    5,
+				}, out)
+				shard.Unlock()
+			}
+		}(g)
+	}
+	stop := make(chan struct{})
+	var introspection sync.WaitGroup
+	untilClosed(stop, &introspection, func() {
+		f.FlushExpiredSpans(start.Add(2*time.Hour), out)
+	})
+	untilClosed(stop, &introspection, func() {
+		f.spanCache.Snapshot()
+		if err := f.ReportMsg(&message.Message{}); err != nil {
+			t.Error(err)
+		}
+	})
+	wg.Wait()
+	close(stop)
+	introspection.Wait()
+
+	// Spans opened after the last sweep are still waiting to expire.
+	f.FlushExpiredSpans(start.Add(2*time.Hour), out)
+	if len(out) != stressSeries {
+		t.Errorf("flushed %d spans, want %d", len(out), stressSeries)
+	}
+	for _, shard := range f.spanCache.shards {
+		if len(shard.spans) != 0 || len(shard.expiries) != 0 {
+			t.Fatalf("a shard has %d open and %d queued spans after they all expired",
+				len(shard.spans), len(shard.expiries))
+		}
+	}
+}
+
+func TestTrackersConcurrency(t *testing.T) {
+	intervals := newIntervalTracker()
+	latency := newLatencyTracker()
+	start := time.Unix(0, 0)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < stressSeries; i++ {
+				series := fmt.Sprintf("series-%d", i%100)
+				intervals.Observe(series, start.Add(time.Duration(i)*time.Second))
+				if i%10 == g {
+					intervals.Forget(series)
+				}
+				latency.Observe(latencyStages[i%len(latencyStages)], time.Duration(i)*time.Millisecond)
+			}
+		}(g)
+	}
+	stop := make(chan struct{})
+	var introspection sync.WaitGroup
+	untilClosed(stop, &introspection, func() {
+		intervals.Intervals()
+		intervals.Interval("series-1")
+		intervals.SeriesCount()
+		latency.Reports()
+	})
+	wg.Wait()
+	close(stop)
+	introspection.Wait()
+
+	if got := intervals.SeriesCount(); got > 100 {
+		t.Errorf("tracking %d series, but only 100 were observed", got)
+	}
+}
+
+// fakeRunner stands in for Heka's filter runner, keeping count of the
+// messages injected of each type. Methods the filter doesn't call are left
+// to the embedded interface.
+type fakeRunner struct {
+	pipeline.FilterRunner
+
+	sync.Mutex
+	injected map[string]int
+}
+
+func (r *fakeRunner) Name() string                    { return "AnomalyFilter" }
+func (r *fakeRunner) LogMessage(msg string)           {}
+func (r *fakeRunner) LogError(err error)              {}
+func (r *fakeRunner) UpdateCursor(queueCursor string) {}
+
+func (r *fakeRunner) Inject(pack *pipeline.PipelinePack) bool {
+	r.Lock()
+	defer r.Unlock()
+	r.injected[pack.Message.GetType()]++
+	return true
+}
+
+func (r *fakeRunner) Injected(msgType string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.injected[msgType]
+}
+
+// fakeHelper stands in for Heka's plugin helper, handing out new packs.
+type fakeHelper struct {
+	pipeline.PluginHelper
+}
+
+func (h fakeHelper) PipelinePack(msgLoopCount uint) (*pipeline.PipelinePack, error) {
+	return &pipeline.PipelinePack{Message: &message.Message{}}, nil
+}
+
+func TestAnomalyFilterConcurrency(t *testing.T) {
+	f := &AnomalyFilter{
+		windower:   new(windowFilter),
+		normalizer: new(normalizeFilter),
+		detector:   new(detectFilter),
+		gatherer:   new(gatherFilter),
+	}
+	conf := f.ConfigStruct().(*AnomalyConfig)
+	conf.SeriesFields = []string{"host"}
+	conf.ValueField = "value"
+	conf.Realtime = true
+	conf.HealthCheck = true
+	conf.LatencyReport = true
+	conf.WindowConfig.WindowWidth = "1m"
+	conf.WindowConfig.FlushExpired = true
+	conf.WindowConfig.Workers = 4
+	conf.DetectConfig.Algorithm = "EWMA"
+	conf.DetectConfig.DetectorConfig = map[string]interface{}{"warmup": int64(1)}
+	conf.GatherConfig.SpanWidth = "1h"
+	conf.GatherConfig.LastDate = "2100-01-01T00:00:00Z"
+	if err := f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	runner := &fakeRunner{injected: map[string]int{}}
+	if err := f.Prepare(runner, fakeHelper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Heka's reporting goroutine calls ReportMsg whenever it likes.
+	stop := make(chan struct{})
+	var reporting sync.WaitGroup
+	untilClosed(stop, &reporting, func() {
+		if err := f.ReportMsg(&message.Message{}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Messages and timer events come from the same goroutine.
+	start := time.Now().Add(-stressMinutes * time.Minute)
+	for i, m := range stressMetrics(start) {
+		msg := &message.Message{}
+		msg.SetTimestamp(m.Timestamp.UnixNano())
+		for name, value := range map[string]interface{}{"host": m.Series, "value": m.Value} {
+			field, err := message.NewField(name, value, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.AddField(field)
+		}
+		if err := f.ProcessMessage(&pipeline.PipelinePack{Message: msg}); err != nil {
+			t.Fatal(err)
+		}
+		if i%1000 == 0 {
+			if err := f.TimerEvent(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Rulings are published as the windows behind them are flushed.
+	for timeout := time.After(5 * time.Second); runner.Injected(anomutil.TypeRuling) == 0; {
+		select {
+		case <-timeout:
+			t.Fatal("no rulings were published")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(stop)
+	reporting.Wait()
+	f.CleanUp()
+}
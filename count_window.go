@@ -0,0 +1,25 @@
+package hekaanom
+
+// countMetric adds a metric to its series' count window, flushing the window
+// once it holds the configured number of metrics.
+func (f *windowFilter) countMetric(m metric, out chan window) {
+	win, ok := f.windows[m.Series]
+	if !ok {
+		win = &window{Series: m.Series}
+		f.windows[m.Series] = win
+	}
+	if win.acc.count == 0 || m.Timestamp.Before(win.Start) {
+		win.Start = m.Timestamp
+	}
+
+	win.Passthrough, win.Tags, win.Unit, win.Kind = m.Passthrough, m.Tags, m.Unit, m.Kind
+	f.accumulate(&win.acc, m)
+	win.addPoint(point{m.Timestamp, m.Value}, f.WindowConfig.RawPoints)
+	if m.Timestamp.After(win.End) {
+		win.End = m.Timestamp
+	}
+
+	if win.acc.count >= f.WindowConfig.WindowCount {
+		f.flushWindow(win, out)
+	}
+}
@@ -0,0 +1,73 @@
+package hekaanom
+
+import (
+	"errors"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// The types of metric values. A gauge is a level sampled at a point in time
+// (e.g. queue depth), a counter a running total that only goes up until it's
+// reset (e.g. requests served since start up), and a delta the change in such
+// a total since the previous metric (e.g. requests served in the last minute).
+const (
+	metricGauge   = "gauge"
+	metricCounter = "counter"
+	metricDelta   = "delta"
+)
+
+// counterSample is the last value a counter series reported.
+type counterSample struct {
+	value     float64
+	timestamp int64
+}
+
+// validateMetricType checks a "metric_type" setting, returning the type to
+// use for it.
+func validateMetricType(metricType string) (string, error) {
+	switch metricType {
+	case "":
+		return metricGauge, nil
+	case metricGauge, metricCounter, metricDelta:
+		return metricType, nil
+	}
+	return "", errors.New("'metric_type' must be \"gauge\", \"counter\" or \"delta\".")
+}
+
+// getMessageMetricType returns the type of a message's value: that named by
+// the message's MetricTypeField, if it names one, or the configured type.
+func (f *AnomalyFilter) getMessageMetricType(msg *message.Message) string {
+	if f.AnomalyConfig.MetricTypeField != "" {
+		if value, ok := msg.GetFieldValue(f.AnomalyConfig.MetricTypeField); ok {
+			switch metricType, _ := value.(string); metricType {
+			case metricGauge, metricCounter, metricDelta:
+				return metricType
+			}
+		}
+	}
+	return f.AnomalyConfig.MetricType
+}
+
+// counterRate turns a counter metric into the per-second rate at which the
+// counter rose since its series' previous metric. A counter that went down
+// is taken to have been reset to zero in between, so its whole value counts
+// as the rise. It returns false if there's no rate yet, because the metric is
+// the first of its series, or if the metric is no later than the previous one.
+func (f *windowFilter) counterRate(m metric) (metric, bool) {
+	timestamp := m.Timestamp.UnixNano()
+	last, ok := f.counters[m.Series]
+	if ok && timestamp <= last.timestamp {
+		return m, false
+	}
+	f.counters[m.Series] = counterSample{m.Value, timestamp}
+	if !ok {
+		return m, false
+	}
+
+	rise := m.Value - last.value
+	if rise < 0 {
+		rise = m.Value
+	}
+	m.Value = rise / (float64(timestamp-last.timestamp) / 1e9)
+	return m, true
+}
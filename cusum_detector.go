@@ -0,0 +1,163 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// cusumDetector is a two-sided CUSUM change-point detector. Once it has
+// learned the mean and standard deviation of a series' first windows, it
+// keeps cumulative sums of how far each later window is above and below that
+// mean, in standard deviations, less a drift allowance. A window is anomalous
+// when either sum crosses the threshold, which a sustained shift too small to
+// stand out in any single window will eventually do. After a change has been
+// flagged, the sums start again from zero and the series' baseline is learned
+// afresh from its next windows, at the new level.
+type cusumDetector struct {
+	drift     float64
+	threshold float64
+	warmup    int
+	series    map[string]*cusumState
+}
+
+// cusumState is a series' baseline and cumulative sums. While the baseline's
+// being learned, its windows are added to acc.
+type cusumState struct {
+	acc    accumulator
+	mean   float64
+	stdDev float64
+	upper  float64
+	lower  float64
+}
+
+func (d *cusumDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if d.drift, err = configFloat(conf, "drift", 0.5); err != nil {
+		return err
+	}
+	if d.drift < 0 {
+		return errors.New("'drift' must not be negative")
+	}
+	if d.threshold, err = configFloat(conf, "threshold", 5); err != nil {
+		return err
+	}
+	if d.threshold <= 0 {
+		return errors.New("'threshold' must be greater than zero")
+	}
+
+	d.warmup = 30
+	if warmup, ok := conf["warmup"]; ok {
+		w, ok := warmup.(int64)
+		if !ok || w < 2 {
+			return errors.New("'warmup' must be an integer of at least 2")
+		}
+		d.warmup = int(w)
+	}
+
+	d.series = map[string]*cusumState{}
+	return nil
+}
+
+func (d *cusumDetector) Train(win window) {
+	state := d.state(win.Series)
+	if !d.learn(state, win.Value) {
+		upper, lower := d.sums(state, win.Value)
+		d.keep(state, upper, lower)
+	}
+}
+
+func (d *cusumDetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	state, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	d.series[new] = state
+}
+
+func (d *cusumDetector) Forget(series string) {
+	delete(d.series, series)
+}
+
+// Detect rules on a window once its series' baseline has been learned. An
+// excluded window is ruled on without its deviation being added to the sums.
+func (d *cusumDetector) Detect(win window, out chan ruling) {
+	state := d.state(win.Series)
+	if state.acc.count < d.warmup {
+		if !win.Excluded {
+			d.learn(state, win.Value)
+		}
+		return
+	}
+
+	upper, lower := d.sums(state, win.Value)
+	normed := upper
+	if lower > upper {
+		normed = -lower
+	}
+	out <- ruling{
+		Window:        win,
+		Anomalous:     math.Abs(normed) > d.threshold,
+		Anomalousness: math.Abs(normed),
+		Normed:        normed,
+		Confidence:    1.0,
+		Passthrough:   win.Passthrough,
+	}
+	if !win.Excluded {
+		d.keep(state, upper, lower)
+	}
+}
+
+func (d *cusumDetector) state(series string) *cusumState {
+	state, ok := d.series[series]
+	if !ok {
+		state = &cusumState{}
+		d.series[series] = state
+	}
+	return state
+}
+
+// learn adds a value to a series' baseline if it's still being learned,
+// reporting whether it was.
+func (d *cusumDetector) learn(state *cusumState, value float64) bool {
+	if state.acc.count >= d.warmup {
+		return false
+	}
+	state.acc.Add(value)
+	if state.acc.count == d.warmup {
+		state.mean = state.acc.Value("Mean", 0)
+		state.stdDev = state.acc.Value("StdDev", 0)
+	}
+	return true
+}
+
+// sums returns what a series' cumulative sums would be with a value added.
+// If the baseline didn't vary at all, deviations are measured in the value's
+// own units.
+func (d *cusumDetector) sums(state *cusumState, value float64) (float64, float64) {
+	scale := state.stdDev
+	if scale == 0 || math.IsNaN(scale) {
+		scale = 1
+	}
+	deviation := (value - state.mean) / scale
+	upper := math.Max(0, state.upper+deviation-d.drift)
+	lower := math.Max(0, state.lower-deviation-d.drift)
+	return upper, lower
+}
+
+// keep stores a series' new cumulative sums, starting the series over if
+// either has crossed the threshold.
+func (d *cusumDetector) keep(state *cusumState, upper, lower float64) {
+	if upper > d.threshold || lower > d.threshold {
+		*state = cusumState{}
+		return
+	}
+	state.upper, state.lower = upper, lower
+}
@@ -4,50 +4,175 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"regexp"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/mozilla-services/heka/pipeline"
 )
 
-var algos = []string{"RPCA"}
+var algos = []string{"RPCA", "MAD", "EWMA", "HoltWinters", "SHESD", "CUSUM", "BOCPD"}
 
 const defaultAlgo = "RPCA"
 
 type detector interface {
 	pipeline.HasConfigStruct
 	pipeline.Plugin
-	Connect(in chan window) chan ruling
+	Connect(in chan window) chan []ruling
+	Train(win window)
+	Rename(old, new string) error
 	PrintQs()
 	QueuesEmpty() bool
+	QueueLengths() []int
+	EffectiveConfig() map[string]interface{}
+	UseCatalog(c *catalog)
+	IsExcluded(win window) bool
 }
 
 type DetectConfig struct {
-	// The algorithm that should be used to detect anomalies. Right now, the only
-	// option is "RPCA".
+	// The algorithm that should be used to detect anomalies: "RPCA", "MAD"
+	// (robust z-scores against a rolling median), "EWMA" (z-scores against an
+	// exponentially weighted moving average), "HoltWinters" (a seasonal
+	// forecast with a confidence band), "SHESD" (Seasonal Hybrid ESD), "CUSUM"
+	// (sustained shifts in level), "BOCPD" (Bayesian online change-point
+	// detection), or the name of one registered with RegisterDetector.
 	Algorithm string `toml:"algorithm"`
 
 	// The configuration for the selected anomaly detection algorithm.
 	DetectorConfig pipeline.PluginConfig `toml:"config"`
 	maxProcs       int                   `toml:"max_procs"`
+
+	// Regular expressions matching series that should be treated as high
+	// priority. Windows for these series skip the shared detection queues and
+	// are handled by a dedicated detector, so they aren't held up when bulk
+	// series saturate the pipeline.
+	PrioritySeries []string `toml:"priority_series"`
+
+	// Regular expressions matching series that are observe-only: their
+	// windows are added to their baselines but never ruled on, so no spans or
+	// alerts come of them. Baselines are then ready as soon as detection is
+	// turned on for a series, by taking it off this list or unsetting
+	// "observe_only" in its catalog entry, which takes effect on reload.
+	ObserveOnly []string `toml:"observe_only"`
+
+	// Time ranges whose windows should be kept out of detector baselines, such
+	// as confirmed incidents. Windows in these ranges are still ruled on.
+	Exclusions []ExclusionConfig `toml:"exclusions"`
+
+	// Rulings are passed downstream in batches of up to BatchSize, with
+	// partial batches sent after at most BatchInterval milliseconds. Batching
+	// cuts down on channel operations and locking in later stages when
+	// windows arrive at a high rate. The default batch size of 1 sends each
+	// ruling on its own.
+	BatchSize     int   `toml:"batch_size"`
+	BatchInterval int64 `toml:"batch_interval"`
+
+	// Keep a compact histogram of each series' recent window values, with
+	// exponentially growing buckets, and rank every window against it.
+	// Rulings then carry a "value_percentile" field, and anomalous ones the
+	// histogram itself, as "histogram_lower", "histogram_upper" and
+	// "histogram_weights" fields, so a UI or alert can show where the
+	// anomalous value sits in the series' distribution. Values count for half
+	// as much after HistogramHalfLife more windows.
+	ValueHistograms   bool `toml:"value_histograms"`
+	HistogramHalfLife int  `toml:"histogram_half_life"`
+
+	// UpperThreshold and LowerThreshold, when set, replace the algorithm's
+	// own judgement of whether a window is anomalous: a window is anomalous
+	// if its normed anomalousness is at least UpperThreshold above zero, or
+	// at least LowerThreshold below it. Setting them differently makes the
+	// stage more sensitive in one direction, e.g. to drops in traffic than
+	// to rises. A zero threshold leaves that direction to the algorithm.
+	UpperThreshold float64 `toml:"upper_threshold"`
+	LowerThreshold float64 `toml:"lower_threshold"`
+
+	// Thresholds override UpperThreshold and LowerThreshold for the series
+	// matching their patterns. The first matching pattern is used.
+	Thresholds []ThresholdConfig `toml:"thresholds"`
+}
+
+// ExclusionConfig describes a time range that should not contaminate the
+// baselines of the series it applies to.
+type ExclusionConfig struct {
+	// A regular expression matching the series the exclusion applies to. An
+	// empty pattern applies to every series.
+	Series string `toml:"series"`
+
+	// The start and end of the excluded range, as RFC3339 timestamps. An empty
+	// end leaves the range open, excluding everything after the start.
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+}
+
+type exclusion struct {
+	series *regexp.Regexp
+	start  time.Time
+	end    time.Time
+}
+
+func (e exclusion) covers(win window) bool {
+	if e.series != nil && !e.series.MatchString(win.Series) {
+		return false
+	}
+	if win.End.Before(e.start) || win.End.Equal(e.start) {
+		return false
+	}
+	return e.end.IsZero() || win.Start.Before(e.end)
 }
 
 type detectAlgo interface {
 	Init(config interface{}) error
 	Detect(win window, out chan ruling)
+
+	// Train adds a historical window to the baseline of its series without
+	// ruling on it.
+	Train(win window)
+
+	// Rename hands the baseline of a series over to a new name, unless the
+	// new name already has one.
+	Rename(old, new string)
+
+	// Forget drops the baseline of a series.
+	Forget(series string)
+}
+
+// connectingAlgo is a detectAlgo that has to be connected to the channel its
+// rulings go to before it's given windows to rule on, and closed after it's
+// been given the last of them.
+type connectingAlgo interface {
+	detectAlgo
+	connect(out chan ruling)
+	Close()
 }
 
 type detectFilter struct {
 	Detectors []detectAlgo
 	*DetectConfig
-	chans     []chan window
-	seriesToI map[string]int
+	chans            []chan window
+	seriesToI        map[string]int
+	priority         []*regexp.Regexp
+	priorityDetector detectAlgo
+	priorityChan     chan window
+	exclusions       []exclusion
+	// Renamed series waiting for their first window, mapped to their old
+	// names.
+	renames            map[string]string
+	renamesLock        sync.Mutex
+	histograms         map[string]*expHistogram
+	histogramsLock     sync.Mutex
+	thresholdsBySeries []seriesThreshold
+	observeOnly        []*regexp.Regexp
+	catalog            *catalog
 }
 
 func (f *detectFilter) ConfigStruct() interface{} {
 	return &DetectConfig{
-		Algorithm: defaultAlgo,
-		maxProcs:  runtime.GOMAXPROCS(0),
+		Algorithm:         defaultAlgo,
+		maxProcs:          runtime.GOMAXPROCS(0),
+		BatchSize:         1,
+		BatchInterval:     100,
+		HistogramHalfLife: 1000,
 	}
 }
 
@@ -60,22 +185,209 @@ func (f *detectFilter) Init(config interface{}) error {
 	if !algoIsKnown(f.DetectConfig.Algorithm) {
 		return errors.New("Unknown algorithm.")
 	}
+	if f.DetectConfig.BatchSize <= 0 {
+		return errors.New("'batch_size' must be greater than zero.")
+	}
+	if f.DetectConfig.BatchSize > 1 && f.DetectConfig.BatchInterval <= 0 {
+		return errors.New("'batch_interval' must be greater than zero.")
+	}
+	if f.DetectConfig.UpperThreshold < 0 || f.DetectConfig.LowerThreshold < 0 {
+		return errors.New("'upper_threshold' and 'lower_threshold' must not be negative.")
+	}
+	f.thresholdsBySeries = nil
+	for _, conf := range f.DetectConfig.Thresholds {
+		threshold, err := newSeriesThreshold(conf)
+		if err != nil {
+			return err
+		}
+		f.thresholdsBySeries = append(f.thresholdsBySeries, threshold)
+	}
+	if f.DetectConfig.ValueHistograms && f.DetectConfig.HistogramHalfLife <= 0 {
+		return errors.New("'histogram_half_life' must be greater than zero.")
+	}
+	f.histograms = map[string]*expHistogram{}
 	f.Detectors = make([]detectAlgo, f.DetectConfig.maxProcs)
-	switch f.DetectConfig.Algorithm {
-	case "RPCA":
-		for i := 0; i < f.DetectConfig.maxProcs; i++ {
-			f.Detectors[i] = new(rPCADetector)
-			if err := f.Detectors[i].Init(f.DetectConfig.DetectorConfig); err != nil {
-				return err
-			}
+	for i := 0; i < f.DetectConfig.maxProcs; i++ {
+		detector, err := f.newDetector()
+		if err != nil {
+			return err
 		}
+		f.Detectors[i] = detector
 	}
 	f.seriesToI = make(map[string]int, f.DetectConfig.maxProcs)
+	f.renames = map[string]string{}
 	f.chans = make([]chan window, f.DetectConfig.maxProcs)
 
+	f.priority = nil
+	for _, pattern := range f.DetectConfig.PrioritySeries {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid 'priority_series' pattern %q: %s", pattern, err)
+		}
+		f.priority = append(f.priority, re)
+	}
+	if len(f.priority) > 0 {
+		detector, err := f.newDetector()
+		if err != nil {
+			return err
+		}
+		f.priorityDetector = detector
+	}
+
+	f.observeOnly = nil
+	for _, pattern := range f.DetectConfig.ObserveOnly {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid 'observe_only' pattern %q: %s", pattern, err)
+		}
+		f.observeOnly = append(f.observeOnly, re)
+	}
+
+	f.exclusions = nil
+	for _, conf := range f.DetectConfig.Exclusions {
+		excl, err := newExclusion(conf)
+		if err != nil {
+			return err
+		}
+		f.exclusions = append(f.exclusions, excl)
+	}
+
+	return nil
+}
+
+func newExclusion(conf ExclusionConfig) (exclusion, error) {
+	var excl exclusion
+	var err error
+	if conf.Series != "" {
+		if excl.series, err = regexp.Compile(conf.Series); err != nil {
+			return excl, fmt.Errorf("Invalid exclusion series pattern %q: %s", conf.Series, err)
+		}
+	}
+	if excl.start, err = time.Parse(time.RFC3339, conf.Start); err != nil {
+		return excl, fmt.Errorf("Invalid exclusion start %q: %s", conf.Start, err)
+	}
+	if conf.End != "" {
+		if excl.end, err = time.Parse(time.RFC3339, conf.End); err != nil {
+			return excl, fmt.Errorf("Invalid exclusion end %q: %s", conf.End, err)
+		}
+		if !excl.end.After(excl.start) {
+			return excl, errors.New("Exclusion end must be after its start.")
+		}
+	}
+	return excl, nil
+}
+
+// IsExcluded reports whether a window falls in one of the exclusions.
+func (f *detectFilter) IsExcluded(win window) bool {
+	for _, excl := range f.exclusions {
+		if excl.covers(win) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *detectFilter) newDetector() (detectAlgo, error) {
+	var detector detectAlgo
+	switch f.DetectConfig.Algorithm {
+	case "RPCA":
+		detector = new(rPCADetector)
+	case "MAD":
+		detector = new(madDetector)
+	case "EWMA":
+		detector = new(ewmaDetector)
+	case "HoltWinters":
+		detector = new(holtWintersDetector)
+	case "SHESD":
+		detector = new(shesdDetector)
+	case "CUSUM":
+		detector = new(cusumDetector)
+	case "BOCPD":
+		detector = new(bocpdDetector)
+	default:
+		factory, _ := registeredDetector(f.DetectConfig.Algorithm)
+		detector = newRegisteredAlgo(factory())
+	}
+	if err := detector.Init(f.DetectConfig.DetectorConfig); err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+func (f *detectFilter) isPriority(series string) bool {
+	for _, re := range f.priority {
+		if re.MatchString(series) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rename arranges for the baseline of a series to be handed over to its new
+// name. The new name is assigned to the old one's detector, which makes the
+// handover when the new name's first window reaches it. Priority series have
+// a detector of their own, so a baseline can't be handed over between a
+// priority series and a bulk one.
+func (f *detectFilter) Rename(old, new string) error {
+	if f.priorityDetector != nil && f.isPriority(old) != f.isPriority(new) {
+		return fmt.Errorf("Can't hand the baseline of %q over to %q, as only one of them is a priority series.", old, new)
+	}
+	f.renamesLock.Lock()
+	defer f.renamesLock.Unlock()
+	f.renames[new] = old
 	return nil
 }
 
+// renamedFrom returns the old name of a series awaiting a handover, if any,
+// forgetting it.
+func (f *detectFilter) renamedFrom(series string) string {
+	f.renamesLock.Lock()
+	defer f.renamesLock.Unlock()
+	old, ok := f.renames[series]
+	if ok {
+		delete(f.renames, series)
+	}
+	return old
+}
+
+// Train adds a historical window to the baseline of the detector its series
+// is assigned to, unless it falls in an exclusion. It must be called before
+// Connect.
+func (f *detectFilter) Train(win window) {
+	win.Excluded = f.IsExcluded(win)
+	if win.Excluded {
+		return
+	}
+	if f.priorityDetector != nil && f.isPriority(win.Series) {
+		f.priorityDetector.Train(win)
+		return
+	}
+	i, ok := f.seriesToI[win.Series]
+	if !ok {
+		i = iFromHash(win.Series, f.DetectConfig.maxProcs-1)
+		f.seriesToI[win.Series] = i
+	}
+	f.Detectors[i].Train(win)
+}
+
+func (f *detectFilter) EffectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"algorithm":           f.DetectConfig.Algorithm,
+		"max_procs":           f.DetectConfig.maxProcs,
+		"config":              f.DetectConfig.DetectorConfig,
+		"priority_series":     f.DetectConfig.PrioritySeries,
+		"observe_only":        f.DetectConfig.ObserveOnly,
+		"exclusions":          f.DetectConfig.Exclusions,
+		"batch_size":          f.DetectConfig.BatchSize,
+		"batch_interval":      (time.Duration(f.DetectConfig.BatchInterval) * time.Millisecond).String(),
+		"value_histograms":    f.DetectConfig.ValueHistograms,
+		"histogram_half_life": f.DetectConfig.HistogramHalfLife,
+		"upper_threshold":     f.DetectConfig.UpperThreshold,
+		"lower_threshold":     f.DetectConfig.LowerThreshold,
+		"thresholds":          f.DetectConfig.Thresholds,
+	}
+}
+
 func (f *detectFilter) QueuesEmpty() bool {
 	for _, length := range f.QueueLengths() {
 		if length > 0 {
@@ -90,6 +402,9 @@ func (f *detectFilter) QueueLengths() []int {
 	for i, ch := range f.chans {
 		lengths[i] = len(ch)
 	}
+	if f.priorityChan != nil {
+		lengths = append(lengths, len(f.priorityChan))
+	}
 	return lengths
 }
 
@@ -100,37 +415,211 @@ func (f *detectFilter) PrintQs() {
 	fmt.Println()
 }
 
-func (f *detectFilter) Connect(in chan window) chan ruling {
+// Connect starts the detectors on the windows from in. Windows of priority
+// series are split off as soon as they're read, so that they never wait
+// behind a bulk window stuck on a full detector queue, and their rulings are
+// sent on as soon as they're made instead of waiting to fill a batch.
+func (f *detectFilter) Connect(in chan window) chan []ruling {
 	var wg sync.WaitGroup
 	out := make(chan ruling)
 	wg.Add(f.DetectConfig.maxProcs)
 
-	detect := func(detector detectAlgo, in chan window, out chan ruling) {
+	detect := func(wg *sync.WaitGroup, detector detectAlgo, in chan window, out chan ruling) {
+		defer wg.Done()
+		if c, ok := detector.(connectingAlgo); ok {
+			c.connect(out)
+			defer c.Close()
+		}
 		for window := range in {
+			if window.evicted {
+				detector.Forget(window.Series)
+				// The series' histogram goes once its rulings are ranked.
+				out <- ruling{Window: window}
+				continue
+			}
+			if window.renamedFrom != "" {
+				detector.Rename(window.renamedFrom, window.Series)
+			}
+			if window.observeOnly {
+				if !window.Excluded {
+					detector.Train(window)
+				}
+				continue
+			}
 			detector.Detect(window, out)
 		}
-		wg.Done()
 	}
 
 	for i := 0; i < f.DetectConfig.maxProcs; i++ {
 		f.chans[i] = make(chan window, 10000)
-		go detect(f.Detectors[i], f.chans[i], out)
+		go detect(&wg, f.Detectors[i], f.chans[i], out)
+	}
+
+	bulk := in
+	var priorityOut chan ruling
+	if f.priorityDetector != nil {
+		var priorityWG sync.WaitGroup
+		priorityWG.Add(1)
+		f.priorityChan = make(chan window, 10000)
+		priorityOut = make(chan ruling)
+		go detect(&priorityWG, f.priorityDetector, f.priorityChan, priorityOut)
+		go func() {
+			priorityWG.Wait()
+			close(priorityOut)
+		}()
+
+		// Bulk windows get a queue of their own, which only holds up the
+		// priority windows behind them once it's full too.
+		bulk = make(chan window, 10000)
+		go func() {
+			defer close(bulk)
+			defer close(f.priorityChan)
+			for window := range in {
+				if !f.isPriority(window.Series) {
+					bulk <- window
+					continue
+				}
+				if window.evicted {
+					f.priorityChan <- window
+					continue
+				}
+				window.Excluded = f.IsExcluded(window)
+				window.observeOnly = f.isObserveOnly(window.Series)
+				window.renamedFrom = f.renamedFrom(window.Series)
+				f.priorityChan <- window
+			}
+		}()
 	}
 
 	go func() {
 		defer close(out)
-		for window := range in {
+		for window := range bulk {
+			if window.evicted {
+				i, ok := f.seriesToI[window.Series]
+				if !ok {
+					i = iFromHash(window.Series, f.DetectConfig.maxProcs-1)
+				}
+				delete(f.seriesToI, window.Series)
+				f.chans[i] <- window
+				continue
+			}
+			window.Excluded = f.IsExcluded(window)
+			window.observeOnly = f.isObserveOnly(window.Series)
 			i, ok := f.seriesToI[window.Series]
 			if !ok {
-				i = f.seriesIndex(window.Series, f.DetectConfig.maxProcs-1)
+				window.renamedFrom = f.renamedFrom(window.Series)
+				if old, renamed := f.seriesToI[window.renamedFrom]; renamed {
+					i = old
+				} else {
+					i = f.seriesIndex(window.Series, f.DetectConfig.maxProcs-1)
+				}
 				f.seriesToI[window.Series] = i
 			}
 			f.chans[i] <- window
 		}
+		for _, ch := range f.chans {
+			close(ch)
+		}
 		wg.Wait()
 		return
 	}()
 
+	batches := f.batch(out)
+	if priorityOut == nil {
+		return batches
+	}
+	return f.mergePriority(batches, priorityOut)
+}
+
+// mergePriority passes on bulk batches along with each priority ruling, in a
+// batch of its own, as soon as it's made. It closes the returned channel once
+// both inputs are closed.
+func (f *detectFilter) mergePriority(batches chan []ruling, priority chan ruling) chan []ruling {
+	out := make(chan []ruling)
+	go func() {
+		defer close(out)
+		for batches != nil || priority != nil {
+			select {
+			case r, ok := <-priority:
+				if !ok {
+					priority = nil
+					continue
+				}
+				if f.prepareRuling(&r) {
+					out <- []ruling{r}
+				}
+			case batch, ok := <-batches:
+				if !ok {
+					batches = nil
+					continue
+				}
+				out <- batch
+			}
+		}
+	}()
+	return out
+}
+
+// prepareRuling applies the configured thresholds to a ruling and ranks its
+// window's value, if value histograms are enabled. It returns false for the
+// marker of an evicted series, which isn't passed on.
+func (f *detectFilter) prepareRuling(r *ruling) bool {
+	if r.Window.evicted {
+		f.forgetHistogram(r.Window.Series)
+		return false
+	}
+	f.applyThresholds(r)
+	if f.DetectConfig.ValueHistograms {
+		f.rankValue(r)
+	}
+	return true
+}
+
+// batch coalesces rulings into batches of up to the configured size, sending
+// partial batches once the batch interval has passed.
+func (f *detectFilter) batch(in chan ruling) chan []ruling {
+	out := make(chan []ruling)
+	size := f.DetectConfig.BatchSize
+	go func() {
+		defer close(out)
+		if size <= 1 {
+			for r := range in {
+				if f.prepareRuling(&r) {
+					out <- []ruling{r}
+				}
+			}
+			return
+		}
+
+		interval := time.Duration(f.DetectConfig.BatchInterval) * time.Millisecond
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		batch := make([]ruling, 0, size)
+		for {
+			select {
+			case r, ok := <-in:
+				if !ok {
+					if len(batch) > 0 {
+						out <- batch
+					}
+					return
+				}
+				if !f.prepareRuling(&r) {
+					continue
+				}
+				batch = append(batch, r)
+				if len(batch) >= size {
+					out <- batch
+					batch = make([]ruling, 0, size)
+				}
+			case <-ticker.C:
+				if len(batch) > 0 {
+					out <- batch
+					batch = make([]ruling, 0, size)
+				}
+			}
+		}
+	}()
 	return out
 }
 
@@ -161,5 +650,6 @@ func algoIsKnown(algo string) bool {
 			return true
 		}
 	}
-	return false
+	_, ok := registeredDetector(algo)
+	return ok
 }
@@ -0,0 +1,225 @@
+package hekaanom
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDetector rules every window anomalous, once gate (if set) is closed,
+// and remembers the windows it was trained on.
+type stubDetector struct {
+	gate chan struct{}
+
+	sync.Mutex
+	trained []window
+}
+
+func (d *stubDetector) Init(config interface{}) error { return nil }
+
+func (d *stubDetector) Detect(win window, out chan ruling) {
+	if d.gate != nil {
+		<-d.gate
+	}
+	out <- ruling{Window: win, Anomalous: true, Anomalousness: 1, Normed: 1}
+}
+
+func (d *stubDetector) Train(win window) {
+	d.Lock()
+	defer d.Unlock()
+	d.trained = append(d.trained, win)
+}
+
+func (d *stubDetector) Rename(old, new string) {}
+
+func (d *stubDetector) Forget(series string) {}
+
+// newTestDetectFilter returns a detect filter with a single detect worker,
+// which it replaces with bulk, and with priority as its priority detector
+// if that's set.
+func newTestDetectFilter(t testing.TB, bulk, priority detectAlgo, configure func(*DetectConfig)) *detectFilter {
+	f := &detectFilter{}
+	conf := f.ConfigStruct().(*DetectConfig)
+	conf.Algorithm = "EWMA"
+	conf.DetectorConfig = map[string]interface{}{}
+	conf.maxProcs = 1
+	if priority != nil {
+		conf.PrioritySeries = []string{"^priority"}
+	}
+	if configure != nil {
+		configure(conf)
+	}
+	if err := f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	f.Detectors[0] = bulk
+	if priority != nil {
+		f.priorityDetector = priority
+	}
+	return f
+}
+
+func TestPriorityWindowsBypassBulkBacklog(t *testing.T) {
+	gate := make(chan struct{})
+	f := newTestDetectFilter(t, &stubDetector{gate: gate}, &stubDetector{}, nil)
+
+	in := make(chan window)
+	out := f.Connect(in)
+	defer func() {
+		close(gate)
+		for range out {
+		}
+	}()
+	go func() {
+		// More bulk windows than the bulk detector's queue holds, which used
+		// to leave the priority window stuck behind them.
+		start := time.Unix(0, 0)
+		for i := 0; i < 15000; i++ {
+			in <- window{Series: "bulk", Start: start, End: start.Add(time.Minute)}
+		}
+		in <- window{Series: "priority", Start: start, End: start.Add(time.Minute)}
+		close(in)
+	}()
+
+	select {
+	case batch := <-out:
+		if len(batch) != 1 || batch[0].Window.Series != "priority" {
+			t.Fatalf("got %v, want the priority ruling", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the priority window was held up by the bulk backlog")
+	}
+}
+
+func TestRenameAcrossPriorityIsRejected(t *testing.T) {
+	f := newTestDetectFilter(t, &stubDetector{}, &stubDetector{}, nil)
+	if err := f.Rename("bulk", "priority-web"); err == nil {
+		t.Error("handing a bulk baseline over to a priority series should be an error")
+	}
+	if err := f.Rename("priority-web", "bulk"); err == nil {
+		t.Error("handing a priority baseline over to a bulk series should be an error")
+	}
+	if err := f.Rename("bulk", "bulk-web"); err != nil {
+		t.Error(err)
+	}
+	if len(f.renames) != 1 {
+		t.Errorf("%d handovers are pending, want 1", len(f.renames))
+	}
+}
+
+func TestTrainSkipsExcludedWindows(t *testing.T) {
+	bulk := &stubDetector{}
+	f := newTestDetectFilter(t, bulk, nil, func(conf *DetectConfig) {
+		conf.Exclusions = []ExclusionConfig{{
+			Series: "^web",
+			Start:  "2024-03-10T01:00:00Z",
+			End:    "2024-03-10T02:00:00Z",
+		}}
+	})
+
+	incident := time.Date(2024, 3, 10, 1, 30, 0, 0, time.UTC)
+	before := incident.Add(-time.Hour)
+	f.Train(window{Series: "web", Start: incident, End: incident.Add(time.Minute)})
+	f.Train(window{Series: "web", Start: before, End: before.Add(time.Minute)})
+	f.Train(window{Series: "db", Start: incident, End: incident.Add(time.Minute)})
+
+	if len(bulk.trained) != 2 {
+		t.Fatalf("trained on %d windows, want 2", len(bulk.trained))
+	}
+	for _, win := range bulk.trained {
+		if win.Series == "web" && win.Start.Equal(incident) {
+			t.Error("trained on a window inside an exclusion")
+		}
+	}
+}
+
+func TestEvictedSeriesAreForgotten(t *testing.T) {
+	f := newTestDetectFilter(t, &stubDetector{}, nil, func(conf *DetectConfig) {
+		conf.DetectorConfig = map[string]interface{}{"warmup": int64(1)}
+		conf.ValueHistograms = true
+	})
+	detector, err := f.newDetector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Detectors[0] = detector
+
+	in := make(chan window)
+	out := f.Connect(in)
+	go func() {
+		start := time.Unix(0, 0)
+		for i := 0; i < 3; i++ {
+			winStart := start.Add(time.Duration(i) * time.Minute)
+			in <- window{Series: "web", Start: winStart, End: winStart.Add(time.Minute), Value: float64(i)}
+		}
+		in <- window{Series: "web", evicted: true}
+		close(in)
+	}()
+	for batch := range out {
+		for _, r := range batch {
+			if r.Window.evicted {
+				t.Error("an eviction marker was passed on as a ruling")
+			}
+		}
+	}
+
+	if _, ok := detector.(*ewmaDetector).series["web"]; ok {
+		t.Error("the detector kept the series' baseline")
+	}
+	if _, ok := f.seriesToI["web"]; ok {
+		t.Error("the series is still assigned to a detector")
+	}
+	if _, ok := f.histograms["web"]; ok {
+		t.Error("the series' value histogram was kept")
+	}
+}
+
+// quietDetector rules every window normal.
+type quietDetector struct{}
+
+func (d quietDetector) Init(config interface{}) error { return nil }
+
+func (d quietDetector) Detect(win window, out chan ruling) {
+	out <- ruling{Window: win, Normed: 0.5, Anomalousness: 0.5, Confidence: 1}
+}
+
+func (d quietDetector) Train(win window) {}
+
+func (d quietDetector) Rename(old, new string) {}
+
+func (d quietDetector) Forget(series string) {}
+
+// BenchmarkDetectBatch measures sending rulings from the detect stage into the
+// gather stage one at a time against sending them in batches.
+func BenchmarkDetectBatch(b *testing.B) {
+	for _, size := range []int{1, 16, 256} {
+		name := "per-ruling"
+		if size > 1 {
+			name = fmt.Sprintf("batch-%d", size)
+		}
+		b.Run(name, func(b *testing.B) {
+			detect := newTestDetectFilter(b, quietDetector{}, nil, func(conf *DetectConfig) {
+				conf.BatchSize = size
+			})
+			gather := newTestGatherFilter(b, nil)
+
+			series := make([]string, 1000)
+			for i := range series {
+				series[i] = fmt.Sprintf("series-%d", i)
+			}
+			start := time.Unix(0, 0)
+
+			in := make(chan window, 1000)
+			spans := gather.Connect(detect.Connect(in))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t := start.Add(time.Duration(i/len(series)) * time.Minute)
+				in <- window{Series: series[i%len(series)], Start: t, End: t.Add(time.Minute)}
+			}
+			close(in)
+			for range spans {
+			}
+		})
+	}
+}
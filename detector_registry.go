@@ -0,0 +1,247 @@
+package hekaanom
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Detector is a detection algorithm that can be plugged into the detect stage
+// with RegisterDetector. Each of the stage's detect workers gets its own
+// Detector, which sees every window of the series assigned to that worker,
+// in order.
+type Detector interface {
+	// Init is given the detect stage's "config" section, as a
+	// pipeline.PluginConfig.
+	Init(config interface{}) error
+
+	// Connect starts ruling on the windows sent to in, returning the channel
+	// the rulings are sent to. The rulings channel must be closed once in has
+	// been closed and every ruling sent. A window may be ruled on late (e.g.
+	// once a baseline has filled up) or not at all, but at most once, and
+	// never if its TrainOnly or Evicted is set.
+	Connect(in chan Window) chan Ruling
+}
+
+// Window is the view of a window given to a registered Detector.
+type Window struct {
+	Start  time.Time
+	End    time.Time
+	Series string
+	Value  float64
+	Unit   string
+	Kind   string
+	Tags   map[string]string
+
+	Passthrough []*message.Field
+
+	// The window's value before it was transformed, if it was.
+	Transformed bool
+	RawValue    float64
+
+	// The last raw metrics in the window, if the window stage keeps them.
+	Points []Point
+
+	// Filled windows stand in for windows in which a series reported nothing.
+	Filled bool
+
+	// Excluded windows must be ruled on, but not added to the series'
+	// baseline.
+	Excluded bool
+
+	// TrainOnly windows must be added to the series' baseline, but not ruled
+	// on, e.g. because they're historical or their series is observe-only.
+	TrainOnly bool
+
+	// RenamedFrom, if set, is the old name of the window's series, whose
+	// baseline should be handed over to the new name before the window is
+	// handled, unless the new name already has one.
+	RenamedFrom string
+
+	// Evicted windows carry no value. Their series has been evicted, so its
+	// baseline should be dropped. They must not be ruled or trained on.
+	Evicted bool
+
+	flushed time.Time
+}
+
+// Point is a single raw metric in a Window.
+type Point struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Ruling is a registered Detector's judgement of a window, which it should
+// pass back unchanged.
+type Ruling struct {
+	Window        Window
+	Anomalous     bool
+	Anomalousness float64
+	Normed        float64
+	// Confidence is in [0, 1]. Left unset, it counts as full confidence.
+	Confidence float64
+}
+
+var (
+	registeredDetectors     = map[string]func() Detector{}
+	registeredDetectorsLock sync.RWMutex
+)
+
+// RegisterDetector makes a detection algorithm available to the detect stage
+// under a name, for its "algorithm" setting. It's meant to be called from an
+// init function, and panics if the name is already taken.
+func RegisterDetector(name string, factory func() Detector) {
+	registeredDetectorsLock.Lock()
+	defer registeredDetectorsLock.Unlock()
+	_, ok := registeredDetectors[name]
+	for _, algo := range algos {
+		ok = ok || name == algo
+	}
+	if ok {
+		panic("hekaanom: detector " + name + " is already registered")
+	}
+	registeredDetectors[name] = factory
+}
+
+func registeredDetector(name string) (func() Detector, bool) {
+	registeredDetectorsLock.RLock()
+	defer registeredDetectorsLock.RUnlock()
+	factory, ok := registeredDetectors[name]
+	return factory, ok
+}
+
+// registeredAlgo adapts a registered Detector to the detect stage. Any
+// windows to train on that come before its Detector is connected are held
+// until then.
+type registeredAlgo struct {
+	detector Detector
+	in       chan Window
+	done     chan struct{}
+	training []Window
+	// Series awaiting a baseline handover, mapped to their old names.
+	renames map[string]string
+}
+
+func newRegisteredAlgo(detector Detector) *registeredAlgo {
+	return &registeredAlgo{detector: detector, renames: map[string]string{}}
+}
+
+func (a *registeredAlgo) Init(config interface{}) error {
+	return a.detector.Init(config)
+}
+
+func (a *registeredAlgo) Detect(win window, out chan ruling) {
+	a.in <- a.export(win)
+}
+
+func (a *registeredAlgo) Train(win window) {
+	exported := a.export(win)
+	exported.TrainOnly = true
+	if a.in == nil {
+		a.training = append(a.training, exported)
+		return
+	}
+	a.in <- exported
+}
+
+func (a *registeredAlgo) Rename(old, new string) {
+	a.renames[new] = old
+}
+
+func (a *registeredAlgo) Forget(series string) {
+	delete(a.renames, series)
+	if a.in != nil {
+		a.in <- Window{Series: series, Evicted: true}
+	}
+}
+
+// Close stops the Detector once every window sent to it has been handled.
+func (a *registeredAlgo) Close() {
+	if a.in == nil {
+		return
+	}
+	close(a.in)
+	<-a.done
+}
+
+func (a *registeredAlgo) connect(out chan ruling) {
+	a.in = make(chan Window)
+	a.done = make(chan struct{})
+	rulings := a.detector.Connect(a.in)
+	go func() {
+		defer close(a.done)
+		for r := range rulings {
+			if r.Window.TrainOnly || r.Window.Evicted {
+				continue
+			}
+			win := importWindow(r.Window)
+			confidence := r.Confidence
+			if confidence == 0 {
+				confidence = 1
+			}
+			out <- ruling{
+				Window:        win,
+				Anomalous:     r.Anomalous,
+				Anomalousness: r.Anomalousness,
+				Normed:        r.Normed,
+				Confidence:    confidence,
+				Passthrough:   win.Passthrough,
+			}
+		}
+	}()
+	for _, win := range a.training {
+		a.in <- win
+	}
+	a.training = nil
+}
+
+// export converts a window for a registered Detector, attaching any pending
+// rename of its series.
+func (a *registeredAlgo) export(win window) Window {
+	exported := Window{
+		Start:       win.Start,
+		End:         win.End,
+		Series:      win.Series,
+		Value:       win.Value,
+		Unit:        win.Unit,
+		Kind:        win.Kind,
+		Tags:        win.Tags,
+		Passthrough: win.Passthrough,
+		Transformed: win.Transformed,
+		RawValue:    win.RawValue,
+		Filled:      win.Filled,
+		Excluded:    win.Excluded,
+		flushed:     win.flushed,
+	}
+	for _, p := range win.Points {
+		exported.Points = append(exported.Points, Point{p.Timestamp, p.Value})
+	}
+	if old, ok := a.renames[win.Series]; ok {
+		exported.RenamedFrom = old
+		delete(a.renames, win.Series)
+	}
+	return exported
+}
+
+func importWindow(win Window) window {
+	imported := window{
+		Start:       win.Start,
+		End:         win.End,
+		Series:      win.Series,
+		Value:       win.Value,
+		Unit:        win.Unit,
+		Kind:        win.Kind,
+		Tags:        win.Tags,
+		Passthrough: win.Passthrough,
+		Transformed: win.Transformed,
+		RawValue:    win.RawValue,
+		Filled:      win.Filled,
+		Excluded:    win.Excluded,
+		flushed:     win.flushed,
+	}
+	for _, p := range win.Points {
+		imported.Points = append(imported.Points, point{p.Timestamp, p.Value})
+	}
+	return imported
+}
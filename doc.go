@@ -59,5 +59,26 @@ the gather stage can use a number of different operators when combining the
 constituent ruling values (outlined in the config struct documentation). The
 gather stage injects the generated anomalous spans into the Heka pipeline for
 any further processing or output the user might wish to perform.
+If escalation levels are configured, the gather stage also injects an
+"anom.span.state" message each time an open span escalates to a more severe
+state, so that long-running anomalies can be acted on before they end.
+
+Spans can optionally be grouped into incidents: spans for different series that
+overlap in time and share a route or owner in the series catalog are combined
+into a single "anom.incident" message with a combined score and a timeline of
+its constituent spans.
+
+With `latency_report` enabled, the filter injects an "anom.latency" message for
+each stage on every tick, giving the median, 90th and 99th percentile and
+maximum time recent items spent in it: from the end of a window to its flush,
+from a window's flush to its ruling, and from a span's last ruling to its flush.
+These are only meaningful for realtime analysis.
+
+Every ruling and span message carries a `schema_version` integer field. Adding
+new fields to a message type does not change the version, so consumers should
+ignore fields they don't recognize. The version is incremented only when an
+existing field is removed, renamed, or changes its type or meaning, which lets
+downstream parsers detect formats they don't understand instead of silently
+misreading them.
 */
 package hekaanom
@@ -0,0 +1,83 @@
+package hekaanom
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// evictIdleSeries forgets every series that hasn't reported a metric for
+// longer than the series TTL as of now, first flushing its open windows if
+// configured to.
+func (f *windowFilter) evictIdleSeries(now time.Time, out chan window) {
+	ttl := time.Duration(f.WindowConfig.SeriesTTL) * time.Second
+	f.lastEviction = now
+	for series, seen := range f.seen {
+		if now.Sub(seen) <= ttl {
+			continue
+		}
+		if f.WindowConfig.FlushEvicted {
+			f.flushSeries(series, out)
+		}
+		f.evictSeries(series, out)
+		atomic.AddInt64(&f.evicted, 1)
+	}
+}
+
+// flushSeries emits whatever windows a series has open, partial or not.
+func (f *windowFilter) flushSeries(series string, out chan window) {
+	for _, held := range f.held[series] {
+		f.flushWindow(held, out)
+	}
+	if win, ok := f.windows[series]; ok && win.acc.count > 0 {
+		f.flushWindow(win, out)
+	}
+	if sw, ok := f.sliding[series]; ok && len(sw.buckets) > 0 {
+		out <- sw.window(f.Width(series), f.WindowConfig.WindowStatistic, f.WindowConfig.RawPoints)
+	}
+	if win, ok := f.sessions[series]; ok {
+		f.flushSession(win, out)
+	}
+}
+
+// evictSeries forgets a series, passing on a marker for the stages after this
+// one to forget it as well.
+func (f *windowFilter) evictSeries(series string, out chan window) {
+	delete(f.seen, series)
+	delete(f.windows, series)
+	delete(f.sliding, series)
+	delete(f.sessions, series)
+	delete(f.held, series)
+	delete(f.latest, series)
+	delete(f.lastValues, series)
+	delete(f.pendingFills, series)
+	delete(f.counters, series)
+	f.intervals.Forget(series)
+	f.catalog.Forget(series)
+	out <- window{Series: series, evicted: true}
+}
+
+// forgetSeries evicts a series, flushing its open windows first if evicted
+// series' windows are flushed.
+func (f *windowFilter) forgetSeries(series string, out chan window) {
+	if f.WindowConfig.FlushEvicted {
+		f.flushSeries(series, out)
+	}
+	f.evictSeries(series, out)
+}
+
+// Forget evicts a series, flushing its open windows first if evicted series'
+// windows are flushed, whenever it last reported.
+func (f *windowFilter) Forget(series string) {
+	instances := f.instances()
+	instances[SeriesShard(series, len(instances))].forget <- series
+}
+
+// EvictedSeries returns the number of series evicted so far for going quiet
+// for longer than the series TTL.
+func (f *windowFilter) EvictedSeries() int64 {
+	var evicted int64
+	for _, instance := range f.instances() {
+		evicted += atomic.LoadInt64(&instance.evicted)
+	}
+	return evicted
+}
@@ -0,0 +1,154 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// ewmaDetector rules on each window by how far its value is from an
+// exponentially weighted moving average of its series' previous windows, in
+// units of their exponentially weighted standard deviation. The average
+// follows slow drifts, so only sudden departures from it are anomalous.
+type ewmaDetector struct {
+	alpha  float64
+	band   float64
+	warmup int
+	series map[string]*ewmaState
+}
+
+// ewmaState is a series' smoothed baseline.
+type ewmaState struct {
+	mean     float64
+	variance float64
+	count    int
+}
+
+func (d *ewmaDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	var err error
+	if d.alpha, err = configFloat(conf, "alpha", 0.3); err != nil {
+		return err
+	}
+	if d.alpha <= 0 || d.alpha > 1 {
+		return errors.New("'alpha' must be greater than zero and at most one")
+	}
+	if d.band, err = configFloat(conf, "band", 3); err != nil {
+		return err
+	}
+	if d.band <= 0 {
+		return errors.New("'band' must be greater than zero")
+	}
+
+	d.warmup = 10
+	if warmup, ok := conf["warmup"]; ok {
+		w, ok := warmup.(int64)
+		if !ok || w < 1 {
+			return errors.New("'warmup' must be an integer greater than zero")
+		}
+		d.warmup = int(w)
+	}
+
+	d.series = map[string]*ewmaState{}
+	return nil
+}
+
+func (d *ewmaDetector) Train(win window) {
+	d.state(win.Series).add(win.Value, d.alpha)
+}
+
+func (d *ewmaDetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	state, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	d.series[new] = state
+}
+
+func (d *ewmaDetector) Forget(series string) {
+	delete(d.series, series)
+}
+
+// Detect rules on a window once its series has seen warmup windows, then adds
+// the window to the series' averages unless it's excluded.
+func (d *ewmaDetector) Detect(win window, out chan ruling) {
+	state := d.state(win.Series)
+	if state.count >= d.warmup {
+		normed := state.score(win.Value, d.band)
+		out <- ruling{
+			Window:        win,
+			Anomalous:     math.Abs(normed) > d.band,
+			Anomalousness: math.Abs(normed),
+			Normed:        normed,
+			Confidence:    1.0,
+			Passthrough:   win.Passthrough,
+		}
+	}
+	if !win.Excluded {
+		state.add(win.Value, d.alpha)
+	}
+}
+
+func (d *ewmaDetector) state(series string) *ewmaState {
+	state, ok := d.series[series]
+	if !ok {
+		state = &ewmaState{}
+		d.series[series] = state
+	}
+	return state
+}
+
+// add folds a value into the averages. The first value seeds the mean.
+func (s *ewmaState) add(value, alpha float64) {
+	s.count++
+	if s.count == 1 {
+		s.mean = value
+		return
+	}
+	diff := value - s.mean
+	s.mean += alpha * diff
+	s.variance = (1 - alpha) * (s.variance + alpha*diff*diff)
+}
+
+// score returns how many standard deviations a value is from the mean. If the
+// series hasn't varied at all, the value is given a flatScore.
+func (s *ewmaState) score(value, band float64) float64 {
+	diff := value - s.mean
+	if s.variance > 0 {
+		return diff / math.Sqrt(s.variance)
+	}
+	return flatScore(diff, band)
+}
+
+// flatScore scores a value's difference from a baseline with no spread to
+// measure it against. Any difference is scored as twice the threshold the
+// detector rules anomalous at, or as its plain size if that's larger, so that
+// it's ruled anomalous.
+func flatScore(diff, threshold float64) float64 {
+	if diff == 0 {
+		return 0
+	}
+	return math.Copysign(math.Max(math.Abs(diff), threshold*2), diff)
+}
+
+// configFloat returns a number from a detector's config, or def if it isn't
+// set. Integers are accepted too, since TOML doesn't write "3" as a float.
+func configFloat(conf pipeline.PluginConfig, name string, def float64) (float64, error) {
+	value, ok := conf[name]
+	if !ok {
+		return def, nil
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	}
+	return 0, errors.New("'" + name + "' must be a number")
+}
@@ -0,0 +1,64 @@
+package hekaanom
+
+import (
+	"time"
+)
+
+// flushExpiredWindows flushes the back-to-back windows, including any held
+// open for late metrics, whose end plus the allowed lateness has passed as of
+// now, without waiting for their series' next metric.
+func (f *windowFilter) flushExpiredWindows(now time.Time, out chan window) {
+	lateness := time.Duration(f.WindowConfig.AllowedLateness) * time.Second
+	for series, win := range f.windows {
+		width := f.Width(series)
+		if lateness > 0 && now.After(f.latest[series]) {
+			// Processing time moves the series' watermark on, so metrics for
+			// the windows flushed here are too late from now on.
+			f.latest[series] = now
+			f.flushHeld(series, out)
+		}
+		if win.acc.count > 0 && !win.Start.Add(width+lateness).After(now) {
+			next := win.Start.Add(width)
+			f.flushWindow(win, out)
+			win.Start = next
+		}
+	}
+}
+
+// expireByClock flushes expired windows as the latest metric time seen across
+// all series passes each window width, so that the windows of series that have
+// gone quiet are flushed even when the filter isn't running in realtime. Each
+// window worker only sees the metrics of its own series, so connectWorkers
+// passes the latest time on to the others with clock ticks.
+func (f *windowFilter) expireByClock(t time.Time, out chan window) {
+	if !t.After(f.clock) {
+		return
+	}
+	f.clock = t
+	if f.clock.Before(f.nextExpiry) {
+		return
+	}
+	f.flushExpiredWindows(f.clock, out)
+	f.nextExpiry = f.clock.Add(f.windowWidth)
+}
+
+// clockTick returns a metric that carries no value, but moves a window
+// worker's clock on to t.
+func clockTick(t time.Time) metric {
+	return metric{Timestamp: t, tick: true}
+}
+
+// FlushExpiredWindows flushes windows whose end has passed as of now, without
+// waiting for their series' next metric. It's a no-op unless expired windows
+// are to be flushed, and never blocks.
+func (f *windowFilter) FlushExpiredWindows(now time.Time) {
+	if !f.WindowConfig.FlushExpired {
+		return
+	}
+	for _, instance := range f.instances() {
+		select {
+		case instance.expired <- now:
+		default:
+		}
+	}
+}
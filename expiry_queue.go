@@ -0,0 +1,76 @@
+package hekaanom
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/berkmancenter/hekaanom/anomutil"
+)
+
+// expiryQueue is a min-heap of open spans ordered by when they expire, so
+// that expired spans can be found without scanning every open span.
+type expiryQueue []*span
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool {
+	return q[i].expiresAt.Before(q[j].expiresAt)
+}
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	s := x.(*span)
+	s.queueIndex = len(*q)
+	*q = append(*q, s)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.queueIndex = -1
+	*q = old[:n-1]
+	return s
+}
+
+// Peek returns the span that expires soonest, or nil if the queue is empty.
+func (q expiryQueue) Peek() *span {
+	if len(q) == 0 {
+		return nil
+	}
+	return q[0]
+}
+
+// expiresAt returns the time after which a span is expired, as decided by
+// SpanExpired. Spans that will never get enough data to expire naturally are
+// due immediately. The expiry of open spans is only recalculated when they're
+// extended, so a span width shortened by a catalog reload applies to already
+// open spans the next time they are.
+func (f *gatherFilter) expiresAt(s *span) time.Time {
+	return anomutil.SpanExpiresAt(s.End, f.spanWidth(s.Series), f.lastDate)
+}
+
+// The following must be called with the span's shard of the span cache
+// locked.
+
+func (f *gatherFilter) queueSpan(shard *spanShard, s *span) {
+	s.expiresAt = f.expiresAt(s)
+	heap.Push(&shard.expiries, s)
+}
+
+func (f *gatherFilter) requeueSpan(shard *spanShard, s *span) {
+	s.expiresAt = f.expiresAt(s)
+	heap.Fix(&shard.expiries, s.queueIndex)
+}
+
+func (f *gatherFilter) dequeueSpan(shard *spanShard, s *span) {
+	if s.queueIndex >= 0 {
+		heap.Remove(&shard.expiries, s.queueIndex)
+	}
+}
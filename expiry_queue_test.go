@@ -0,0 +1,96 @@
+package hekaanom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// openTestSpan opens a span for a series ending at end.
+func openTestSpan(f *gatherFilter, series string, end time.Time) {
+	s := &span{key: series, Series: series, Start: end, End: end, Values: []float64{1}}
+	shard := f.spanCache.shard(series)
+	shard.spans[series] = s
+	shard.nows[series] = end
+	f.queueSpan(shard, s)
+}
+
+// scanExpiredSpans flushes expired spans by checking every open span, as
+// FlushExpiredSpans did before it had the expiry queue to go by.
+func (f *gatherFilter) scanExpiredSpans(now time.Time, out chan span) {
+	for _, shard := range f.spanCache.shards {
+		shard.lock()
+		for _, span := range shard.spans {
+			if f.SpanExpired(span, now) {
+				f.FlushSpan(shard, span, f.expiryReason(span, now), out)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+func TestExpiryQueueOrder(t *testing.T) {
+	f := newTestGatherFilter(t, nil)
+	start := time.Unix(0, 0)
+	for i := 0; i < 1000; i++ {
+		openTestSpan(f, fmt.Sprintf("series-%d", i), start.Add(time.Duration(i*7919%1000)*time.Second))
+	}
+
+	out := make(chan span, 1000)
+	// Spans with a span width of an hour ending in the first 100 seconds
+	// have expired 100 seconds past the hour.
+	f.FlushExpiredSpans(start.Add(time.Hour+100*time.Second), out)
+	if len(out) != 100 {
+		t.Fatalf("flushed %d spans, want 100", len(out))
+	}
+	close(out)
+	for s := range out {
+		if !s.End.Before(start.Add(100 * time.Second)) {
+			t.Errorf("flushed %s ending at %v, which hasn't expired", s.Series, s.End)
+		}
+	}
+	for _, shard := range f.spanCache.shards {
+		if len(shard.expiries) != len(shard.spans) {
+			t.Fatalf("a shard has %d queued spans but %d open ones", len(shard.expiries), len(shard.spans))
+		}
+	}
+}
+
+// BenchmarkExpireSpans compares sweeping 500k open spans for expired ones by
+// the expiry queue with scanning every one of them, both on ticks where no
+// span has expired and on ticks where 1000 have.
+func BenchmarkExpireSpans(b *testing.B) {
+	const open = 500000
+	start := time.Unix(0, 0)
+	sweeps := map[string]func(*gatherFilter, time.Time, chan span){
+		"queue": (*gatherFilter).FlushExpiredSpans,
+		"scan":  (*gatherFilter).scanExpiredSpans,
+	}
+	for _, expiring := range []int{0, 1000} {
+		for _, name := range []string{"queue", "scan"} {
+			sweep := sweeps[name]
+			b.Run(fmt.Sprintf("%s-expiring-%d", name, expiring), func(b *testing.B) {
+				f := newTestGatherFilter(b, nil)
+				// None of these will have expired by now.
+				for i := 0; i < open; i++ {
+					openTestSpan(f, fmt.Sprintf("series-%d", i), start.Add(time.Hour))
+				}
+				now := start.Add(time.Hour + time.Second)
+				out := make(chan span, expiring)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					for j := 0; j < expiring; j++ {
+						openTestSpan(f, fmt.Sprintf("expiring-%d", j), start)
+					}
+					b.StartTimer()
+					sweep(f, now, out)
+					for j := 0; j < expiring; j++ {
+						<-out
+					}
+				}
+			})
+		}
+	}
+}
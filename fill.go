@@ -0,0 +1,94 @@
+package hekaanom
+
+import (
+	"time"
+)
+
+const (
+	fillZero     = "zero"
+	fillPrevious = "previous"
+	fillLinear   = "linear"
+)
+
+// fillGap emits synthetic windows for the whole windows of a series that fit
+// between from and to, in which no metrics arrived. Linearly interpolated
+// windows are held back until the series' next real window is flushed, since
+// their values depend on it.
+func (f *windowFilter) fillGap(win *window, from, to time.Time, out chan window) {
+	if f.WindowConfig.FillMissing == "" {
+		return
+	}
+	if _, ok := f.lastValues[win.Series]; !ok {
+		return
+	}
+	width := f.Width(win.Series)
+	for start := from; !start.Add(width).After(to); start = start.Add(width) {
+		if f.WindowConfig.FillMissing == fillLinear {
+			f.pendingFills[win.Series] = append(f.pendingFills[win.Series], start)
+			continue
+		}
+		f.emitFill(win, start, f.fillValue(win.Series), out)
+	}
+}
+
+func (f *windowFilter) fillValue(series string) float64 {
+	if f.WindowConfig.FillMissing == fillPrevious {
+		return f.lastValues[series]
+	}
+	return 0
+}
+
+// emitPendingFills emits a series' held back interpolated windows, given the
+// value of the real window that follows them.
+func (f *windowFilter) emitPendingFills(win *window, next float64, out chan window) {
+	pending := f.pendingFills[win.Series]
+	if len(pending) == 0 {
+		return
+	}
+	delete(f.pendingFills, win.Series)
+	prev := f.lastValues[win.Series]
+	for i, start := range pending {
+		frac := float64(i+1) / float64(len(pending)+1)
+		f.emitFill(win, start, prev+(next-prev)*frac, out)
+	}
+}
+
+func (f *windowFilter) emitFill(win *window, start time.Time, value float64, out chan window) {
+	out <- window{
+		Start:       start,
+		End:         start.Add(f.Width(win.Series)),
+		Series:      win.Series,
+		Value:       value,
+		Passthrough: win.Passthrough,
+		Tags:        win.Tags,
+		Unit:        win.Unit,
+		Kind:        win.Kind,
+		Filled:      true,
+		flushed:     time.Now(),
+	}
+}
+
+// fillIdle flushes the windows of series that have gone quiet for at least a
+// whole window as of now, and fills the windows they've missed since, so that
+// a series that stops reporting altogether still produces windows. Linearly
+// interpolated windows can't be filled until the series reports again.
+func (f *windowFilter) fillIdle(now time.Time, out chan window) {
+	for _, win := range f.windows {
+		width := f.Width(win.Series)
+		if now.Before(win.Start.Add(width)) {
+			continue
+		}
+		next := win.Start
+		if win.acc.count > 0 {
+			f.flushWindow(win, out)
+			next = next.Add(width)
+		}
+		if f.WindowConfig.FillMissing != fillLinear {
+			f.fillGap(win, next, now, out)
+			for !next.Add(width).After(now) {
+				next = next.Add(width)
+			}
+		}
+		win.Start = next
+	}
+}
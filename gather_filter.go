@@ -3,11 +3,15 @@ package hekaanom
 import (
 	"errors"
 	"fmt"
-	"reflect"
+	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/berkmancenter/hekaanom/anomutil"
 	"github.com/montanaflynn/stats"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
@@ -21,25 +25,46 @@ var (
 		"Midhinge": stats.Midhinge,
 		"Trimean":  stats.Trimean,
 	}
+
+	// The values of a ruling that value_field can name. Names are matched
+	// without regard to case. A value is missing if it's NaN.
+	rulingValues = map[string]func(ruling) float64{
+		"normed":        func(r ruling) float64 { return r.Normed },
+		"anomalousness": func(r ruling) float64 { return r.Anomalousness },
+		"confidence":    func(r ruling) float64 { return r.Confidence },
+		"value":         func(r ruling) float64 { return r.Window.Value },
+		"raw":           rawRulingValue,
+		"value_percentile": func(r ruling) float64 {
+			if !r.Ranked {
+				return math.NaN()
+			}
+			return r.ValuePercentile
+		},
+	}
 )
 
 type gatherer interface {
 	pipeline.HasConfigStruct
 	pipeline.Plugin
-	Connect(in chan ruling) chan span
+	pipeline.ReportingPlugin
+	Connect(in chan []ruling) chan span
 	FlushExpiredSpans(now time.Time, out chan span)
 	FlushStuckSpans(out chan span)
 	PrintSpansInMem()
+	PrintScoreQuantiles()
+	PrintLockContention()
+	EffectiveConfig() map[string]interface{}
+	UseCatalog(c *catalog)
 }
 
 type GatherConfig struct {
 	// Is gathering anomalies into spans disabled?
 	Disabled bool `toml:"disabled"`
 
-	// If two anomalies occur within SpanWidth seconds of one another (i.e. their
-	// ends are less than or equal to SpanWidth seconds apart), they're gathered
-	// into the same anomalous span.
-	SpanWidth int64 `toml:"span_width"`
+	// If two anomalies occur within SpanWidth of one another (i.e. their ends
+	// are no more than SpanWidth apart), they're gathered into the same
+	// anomalous span. It's a duration such as "30m" or a number of seconds.
+	SpanWidth interface{} `toml:"span_width"`
 
 	// Statistic is used to describe the anomalous span in one number derived
 	// from the ValueField's of the gathered anomalies. Possible values are
@@ -47,33 +72,187 @@ type GatherConfig struct {
 	Statistic string
 
 	// ValueField identifies the field of each anomaly that should be used to
-	// generate their parent span's statistic.
-	ValueField string `toml:"value_field"`
+	// generate their parent span's statistic. It may be a single field name or
+	// a list of names (e.g. ["normed", "raw"]), in which case the first field
+	// that is present on the ruling and holds a valid number is used. The
+	// fields are "normed", "anomalousness", "confidence", "value", "raw" (the
+	// window's value before it was transformed or normalized) and
+	// "value_percentile" (only present if value histograms are enabled). A
+	// NaN value counts as missing.
+	ValueField interface{} `toml:"value_field"`
 
 	// LastDate is the date and time of the final piece of data you're
 	// processing. We use this to close out the last span.
 	LastDate string `toml:"last_date"`
+
+	// WeightByConfidence scales each ruling's value by the ruling's confidence
+	// (clamped to [0, 1]) before the span statistic is calculated, so
+	// low-confidence detections contribute less to span scores. With the
+	// "Mean" statistic, the span's aggregation is the weighted mean of its
+	// values, sum(value * confidence) / sum(confidence).
+	WeightByConfidence bool `toml:"weight_by_confidence"`
+
+	// Escalation lists the states (e.g. "watch", "warn", "critical") an open
+	// span moves through as it grows, in increasing order of severity. Each
+	// time a span reaches a later state, a span message of type
+	// "anom.span.state" is emitted without waiting for the span to close.
+	Escalation []EscalationLevel `toml:"escalation"`
+
+	// Sparkline adds the raw values of the span's windows ("window_values")
+	// and a Unicode sparkline of them ("sparkline") to span messages, so alerts
+	// can convey the shape of the anomaly at a glance.
+	Sparkline bool `toml:"sparkline"`
+
+	// Chart adds a small PNG line chart of the span's window values to span
+	// messages as the "chart" field. Up to 10 of the series' windows either
+	// side of the span are drawn around them for context, over a band two
+	// standard deviations either side of the mean of the windows before it.
+	Chart bool `toml:"chart"`
+
+	// MaxEmittedValues limits how many values (and window values) an emitted
+	// span carries, to keep payloads of long spans small. Zero means no limit.
+	// The span's statistics are always calculated from every value first.
+	MaxEmittedValues int `toml:"max_emitted_values"`
+
+	// How values are reduced to MaxEmittedValues: "nth" keeps every Nth value,
+	// while "mean" (the default) replaces each run of values with its mean.
+	DownsampleMethod string `toml:"downsample_method"`
+
+	// ScoreQuantiles ranks each span's absolute score against the scores of
+	// roughly the last ScoreQuantileWindow spans, both overall and within the
+	// span's catalog group (its route or owner). The ranks are emitted as
+	// "score_quantile" and "group_score_quantile", so outputs can match on e.g.
+	// "Fields[score_quantile] >= 0.99" instead of a fixed score.
+	ScoreQuantiles      bool `toml:"score_quantiles"`
+	ScoreQuantileWindow int  `toml:"score_quantile_window"`
+
+	// IncludeNormalValues adds the values of non-anomalous rulings that arrive
+	// while a span is open to the span, without extending it. This is the
+	// default. Turning it off keeps normal values from diluting statistics
+	// such as "Mean" and "Median".
+	IncludeNormalValues bool `toml:"include_normal_values"`
+
+	// CloseAfterNormal closes a span as soon as this many consecutive
+	// non-anomalous rulings arrive for its series, rather than waiting for
+	// SpanWidth to pass. Zero disables it.
+	CloseAfterNormal int `toml:"close_after_normal"`
+
+	// ReopenGrace links a new span to the previous span of the same series and
+	// direction if it starts within this many seconds of the previous span
+	// closing. The new span's "parent_span_id" is set to the previous span's
+	// "span_id", so consumers can treat the two as one incident. Zero
+	// disables linking.
+	ReopenGrace int64 `toml:"reopen_grace"`
+
+	// SpanKey lists passthrough fields (e.g. ["status_code"]) whose values
+	// split a series' anomalies into separate, concurrent spans, one per
+	// combination of values, instead of a single merged span.
+	SpanKey []string `toml:"span_key"`
+
+	// Classify labels each span with the shape of its values, as the "class"
+	// field: "spike", "ramp", "level_shift" or "oscillation".
+	Classify bool `toml:"classify"`
+
+	// PassthroughMerge says how each passthrough field is combined across the
+	// windows of a span, keyed by field name: "first" (the default) keeps the
+	// first window's value, "last" the latest window's, "union" every
+	// distinct value and "list" every value.
+	PassthroughMerge map[string]string `toml:"passthrough_merge"`
+
+	// TrimPercent keeps extreme values from dominating a span's score: before
+	// the statistic is calculated, this percentage of the span's values at
+	// each end is handled according to TrimMethod, either "trim" (the
+	// default), which drops them, or "winsorize", which clamps them to the
+	// most extreme remaining value. Zero disables it.
+	TrimPercent float64 `toml:"trim_percent"`
+	TrimMethod  string  `toml:"trim_method"`
+
+	// AmendLookback lets a late anomalous ruling, one older than its series'
+	// latest ruling when its span closed, be added to that span rather than
+	// start a new one, if it falls within the range the span would have been
+	// extended by. The span is then emitted again with the same "span_id" and
+	// an "amended" field. Spans can be amended until a ruling arrives more
+	// than this many seconds after they closed. Zero disables amending.
+	AmendLookback int64 `toml:"amend_lookback"`
+
+	// ScoreTransform compresses span scores, which can span many orders of
+	// magnitude across series, before they're emitted: "none" (the default),
+	// "log10" or "sqrt", keeping their sign. ScoreDecimals then rounds them to
+	// that many decimal places, or not at all if it's negative (the default).
+	// If either is set, each span's score before both is emitted as
+	// "raw_score". Score quantiles, escalation and incidents use raw scores.
+	ScoreTransform string `toml:"score_transform"`
+	ScoreDecimals  int    `toml:"score_decimals"`
+}
+
+const (
+	downsampleNth  = "nth"
+	downsampleMean = "mean"
+)
+
+// The reasons a span can be closed for.
+const (
+	// No anomalous ruling extended the span within the span width.
+	closeExpired = anomutil.CloseExpired
+	// The span can't expire naturally before the last date of the data.
+	closeStuck = anomutil.CloseStuck
+	// An anomalous ruling with the opposite sign started a new span.
+	closeSignFlip = anomutil.CloseSignFlip
+	// Enough consecutive normal rulings arrived to close the span early.
+	closeNormal = anomutil.CloseNormal
+	// The filter shut down while the span was open.
+	closeShutdown = anomutil.CloseShutdown
+)
+
+// EscalationLevel is a single state in a span's escalation. A span enters the
+// state once its provisional score reaches Score or its duration reaches
+// Duration seconds, whichever happens first. A zero threshold is ignored.
+type EscalationLevel struct {
+	State    string  `toml:"state"`
+	Score    float64 `toml:"score"`
+	Duration int64   `toml:"duration"`
 }
 
 type gatherFilter struct {
 	*GatherConfig
 	aggregator func(stats.Float64Data) (float64, error)
-	spanCache  spanCache
-	lastDate   time.Time
-}
-
-type spanCache struct {
-	sync.Mutex
-	spans map[string]*span
-	nows  map[string]time.Time
+	// Whether span weights are scaled to average 1, for a weighted mean.
+	meanWeights bool
+	spanCache   spanCache
+	lastDate    time.Time
+	// The parsed SpanWidth, for series the catalog doesn't override.
+	defaultSpanWidth time.Duration
+	valueFields      []string
+	catalog          *catalog
+	scores           map[string]*recentDigest
+	scoresLock       sync.Mutex
+	// The number of spans flushed so far.
+	flushed int64
 }
 
 func (f *gatherFilter) ConfigStruct() interface{} {
 	return &GatherConfig{
-		Disabled:   false,
-		Statistic:  defaultAggregator,
-		ValueField: defaultValueField,
+		Disabled:            false,
+		Statistic:           defaultAggregator,
+		ValueField:          defaultValueField,
+		DownsampleMethod:    downsampleMean,
+		ScoreQuantileWindow: 10000,
+		IncludeNormalValues: true,
+		ScoreTransform:      scoreTransformNone,
+		ScoreDecimals:       -1,
+	}
+}
+
+// parseLastDate parses a "last_date" setting: "today", "yesterday" or an
+// RFC3339 timestamp.
+func parseLastDate(date string) (time.Time, error) {
+	switch date {
+	case "today":
+		return time.Now(), nil
+	case "yesterday":
+		return time.Now().Add(-1 * time.Duration(24) * time.Hour), nil
 	}
+	return time.Parse(time.RFC3339, date)
 }
 
 func (f *gatherFilter) Init(config interface{}) error {
@@ -83,182 +262,666 @@ func (f *gatherFilter) Init(config interface{}) error {
 		return nil
 	}
 
-	if f.GatherConfig.SpanWidth <= 0 {
+	spanWidth, err := anomutil.ParseDuration("span_width", f.GatherConfig.SpanWidth)
+	if err != nil {
+		return err
+	}
+	if spanWidth <= 0 {
 		return errors.New("'span_width' must be greater than zero.")
 	}
+	f.defaultSpanWidth = spanWidth
 
-	if f.GatherConfig.LastDate == "today" {
-		f.lastDate = time.Now()
-	} else if f.GatherConfig.LastDate == "yesterday" {
-		f.lastDate = time.Now().Add(-1 * time.Duration(24) * time.Hour)
-	} else {
-		lastDate, err := time.Parse(time.RFC3339, f.GatherConfig.LastDate)
-		if err != nil {
-			return err
+	lastDate, err := parseLastDate(f.GatherConfig.LastDate)
+	if err != nil {
+		return err
+	}
+	f.lastDate = lastDate
+
+	for _, level := range f.GatherConfig.Escalation {
+		if level.State == "" {
+			return errors.New("Every escalation level must have a 'state'.")
+		}
+		if level.Score == 0 && level.Duration <= 0 {
+			return errors.New("Every escalation level must have a 'score' or 'duration'.")
 		}
-		f.lastDate = lastDate
 	}
 
-	f.aggregator = f.getAggregator()
-	f.spanCache = spanCache{spans: map[string]*span{}, nows: map[string]time.Time{}}
+	if f.GatherConfig.MaxEmittedValues < 0 {
+		return errors.New("'max_emitted_values' must not be negative.")
+	}
+	switch f.GatherConfig.DownsampleMethod {
+	case "":
+		f.GatherConfig.DownsampleMethod = downsampleMean
+	case downsampleNth, downsampleMean:
+	default:
+		return errors.New("'downsample_method' must be either \"nth\" or \"mean\".")
+	}
+
+	if err := validateMergePolicies(f.GatherConfig.PassthroughMerge); err != nil {
+		return err
+	}
+
+	if f.GatherConfig.TrimPercent < 0 || f.GatherConfig.TrimPercent >= 50 {
+		return errors.New("'trim_percent' must be at least 0 and less than 50.")
+	}
+	switch f.GatherConfig.TrimMethod {
+	case "":
+		f.GatherConfig.TrimMethod = trimDrop
+	case trimDrop, trimWinsorize:
+	default:
+		return errors.New("'trim_method' must be either \"trim\" or \"winsorize\".")
+	}
+
+	if f.GatherConfig.AmendLookback < 0 {
+		return errors.New("'amend_lookback' must not be negative.")
+	}
+
+	switch f.GatherConfig.ScoreTransform {
+	case "":
+		f.GatherConfig.ScoreTransform = scoreTransformNone
+	case scoreTransformNone, scoreTransformLog10, scoreTransformSqrt:
+	default:
+		return errors.New("'score_transform' must be \"none\", \"log10\" or \"sqrt\".")
+	}
+
+	if f.GatherConfig.ReopenGrace < 0 {
+		return errors.New("'reopen_grace' must not be negative.")
+	}
+
+	if f.GatherConfig.CloseAfterNormal < 0 {
+		return errors.New("'close_after_normal' must not be negative.")
+	}
+
+	if f.GatherConfig.ScoreQuantiles && f.GatherConfig.ScoreQuantileWindow <= 0 {
+		return errors.New("'score_quantile_window' must be greater than zero.")
+	}
+	f.scores = map[string]*recentDigest{}
+
+	valueFields, err := parseValueFields(f.GatherConfig.ValueField)
+	if err != nil {
+		return err
+	}
+	f.valueFields = valueFields
+
+	f.aggregator = trimmedAggregator(f.getAggregator(),
+		f.GatherConfig.TrimPercent, f.GatherConfig.TrimMethod)
+	f.meanWeights = f.GatherConfig.WeightByConfidence && f.GatherConfig.Statistic == "Mean"
+	f.spanCache = newSpanCache()
 	return nil
 }
 
-func (f *gatherFilter) Connect(in chan ruling) chan span {
-	out := make(chan span)
+// UseCatalog sets the catalog used to override span widths per series.
+func (f *gatherFilter) UseCatalog(c *catalog) {
+	f.catalog = c
+}
+
+// spanWidth returns the span width of a series.
+func (f *gatherFilter) spanWidth(series string) time.Duration {
+	if entry, ok := f.catalog.Lookup(series); ok && entry.SpanWidth > 0 {
+		return time.Duration(entry.SpanWidth) * time.Second
+	}
+	return f.defaultSpanWidth
+}
 
-	// There are four things that can be happening here:
-	//     We can have an active span and get non-anomalous, in which case we expire it or add it to the span.
-	//     We can have an active span and get anomalous, in which case we add it to the span and extend the span's lifespan.
-	//     We can not have an active span and get a non-anomalous, in which case we do nothing.
-	//     We can not have an active span and get anomalous, in which case we make a new span.
-	// We always update the time and expire spans.
+func (f *gatherFilter) EffectiveConfig() map[string]interface{} {
+	if f.GatherConfig.Disabled {
+		return map[string]interface{}{"disabled": true}
+	}
+	statistic := f.GatherConfig.Statistic
+	if _, ok := aggFunctions[statistic]; !ok {
+		statistic = defaultAggregator
+	}
+	return map[string]interface{}{
+		"disabled":              false,
+		"span_width":            f.defaultSpanWidth.String(),
+		"statistic":             statistic,
+		"value_field":           f.valueFields,
+		"last_date":             f.lastDate.Format(timeFormat),
+		"weight_by_confidence":  f.GatherConfig.WeightByConfidence,
+		"escalation":            f.GatherConfig.Escalation,
+		"sparkline":             f.GatherConfig.Sparkline,
+		"chart":                 f.GatherConfig.Chart,
+		"max_emitted_values":    f.GatherConfig.MaxEmittedValues,
+		"downsample_method":     f.GatherConfig.DownsampleMethod,
+		"score_quantiles":       f.GatherConfig.ScoreQuantiles,
+		"score_quantile_window": f.GatherConfig.ScoreQuantileWindow,
+		"include_normal_values": f.GatherConfig.IncludeNormalValues,
+		"close_after_normal":    f.GatherConfig.CloseAfterNormal,
+		"reopen_grace":          (time.Duration(f.GatherConfig.ReopenGrace) * time.Second).String(),
+		"span_key":              f.GatherConfig.SpanKey,
+		"classify":              f.GatherConfig.Classify,
+		"passthrough_merge":     f.GatherConfig.PassthroughMerge,
+		"trim_percent":          f.GatherConfig.TrimPercent,
+		"trim_method":           f.GatherConfig.TrimMethod,
+		"amend_lookback":        (time.Duration(f.GatherConfig.AmendLookback) * time.Second).String(),
+		"score_transform":       f.GatherConfig.ScoreTransform,
+		"score_decimals":        f.GatherConfig.ScoreDecimals,
+	}
+}
+
+func (f *gatherFilter) Connect(in chan []ruling) chan span {
+	out := make(chan span)
 
 	go func() {
 		defer close(out)
 
-		for ruling := range in {
-			thisSeries := ruling.Window.Series
+		var order []*spanShard
+		byShard := map[*spanShard][]ruling{}
+		for batch := range in {
+			// Lock each shard once per batch, keeping each series' rulings in
+			// order.
+			for _, ruling := range batch {
+				shard := f.spanCache.shard(ruling.Window.Series)
+				if _, ok := byShard[shard]; !ok {
+					order = append(order, shard)
+				}
+				byShard[shard] = append(byShard[shard], ruling)
+			}
+			for _, shard := range order {
+				shard.lock()
+				for _, ruling := range byShard[shard] {
+					f.gather(shard, ruling, out)
+				}
+				shard.Unlock()
+				delete(byShard, shard)
+			}
+			order = order[:0]
+		}
 
-			f.spanCache.Lock()
+		f.drain(out)
+	}()
+	return out
+}
 
-			// Update the time for the current series.
-			now := ruling.Window.End
-			f.spanCache.nows[thisSeries] = now
+// drain flushes every open span.
+func (f *gatherFilter) drain(out chan span) {
+	for _, shard := range f.spanCache.shards {
+		shard.lock()
+		for _, span := range shard.spans {
+			f.FlushSpan(shard, span, closeShutdown, out)
+		}
+		shard.Unlock()
+	}
+}
 
-			value, err := f.getRulingValue(ruling)
-			if err != nil {
-				fmt.Println(err)
-				f.spanCache.Unlock()
-				continue
-			}
+// gather adds a ruling to its series' span. The series' shard of the span
+// cache must be locked.
+//
+// There are four things that can be happening here:
+//
+//	We can have an active span and get non-anomalous, in which case we expire it or add it to the span.
+//	We can have an active span and get anomalous, in which case we add it to the span and extend the span's lifespan.
+//	We can not have an active span and get a non-anomalous, in which case we do nothing.
+//	We can not have an active span and get anomalous, in which case we make a new span.
+//
+// We always update the time and expire spans.
+func (f *gatherFilter) gather(shard *spanShard, ruling ruling, out chan span) {
+	key := f.spanKey(ruling)
+
+	// Update the time for the current series.
+	now := ruling.Window.End
+	shard.nows[key] = now
+
+	value, err := f.getRulingValue(ruling)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-			// Does a span already exist for the current series?
-			s, ok := f.spanCache.spans[thisSeries]
-			if ok {
-				if ruling.Anomalous {
-					// Does this anomaly have the same sign as the current span? If so,
-					// add it to this span and extend the span's lifespan.
-					if s.Values[0] >= 0 && value >= 0 || s.Values[0] < 0 && value < 0 {
-						s.Values = append(s.Values, value)
-						s.End = now
-					} else {
-						// If they have different signs, flush that old one and make a new
-						// span.
-						f.FlushSpan(s, out)
-						s = &span{
-							Series:      thisSeries,
-							Values:      []float64{value},
-							Start:       ruling.Window.Start,
-							End:         ruling.Window.End,
-							Passthrough: ruling.Window.Passthrough,
-						}
-						f.spanCache.spans[thisSeries] = s
-					}
-				} else {
-					// This ruling is not anomalous. If this span is expired, flush it.
-					// If it's not, add this ruling but don't extend its lifespan.
-					if f.SpanExpired(s, now) {
-						f.FlushSpan(s, out)
-					} else {
-						s.Values = append(s.Values, value)
-					}
+	if f.GatherConfig.AmendLookback > 0 && f.amend(shard, key, ruling, value, out) {
+		return
+	}
+
+	// Does a span already exist for the current series?
+	s, ok := shard.spans[key]
+	if ok {
+		if ruling.Anomalous {
+			// Does this anomaly have the same sign as the current span? If so,
+			// add it to this span and extend the span's lifespan.
+			if s.Values[0] >= 0 && value >= 0 || s.Values[0] < 0 && value < 0 {
+				f.addValue(s, value, ruling)
+				s.End = now
+				s.normalRun = 0
+				f.requeueSpan(shard, s)
+				f.escalate(s, out)
+			} else {
+				// If they have different signs, flush that old one and make a new
+				// span.
+				f.FlushSpan(shard, s, closeSignFlip, out)
+				s = f.newSpan(key, ruling, value)
+				f.linkSpan(shard, s)
+				shard.spans[key] = s
+				f.queueSpan(shard, s)
+				f.escalate(s, out)
+			}
+		} else {
+			// This ruling is not anomalous. If this span is expired, flush it.
+			// If it's not, add this ruling (if configured to) but don't extend
+			// its lifespan, unless it's been normal for long enough to close
+			// early.
+			if f.SpanExpired(s, now) {
+				f.FlushSpan(shard, s, f.expiryReason(s, now), out)
+			} else {
+				if f.GatherConfig.IncludeNormalValues {
+					f.addValue(s, value, ruling)
+				} else if f.GatherConfig.Chart {
+					s.chartAfter = appendContext(s.chartAfter, ruling.Window.Value)
 				}
-			} else if ruling.Anomalous {
-				// This ruling is anomalous, so start a new span.
-				s = &span{
-					Series:      thisSeries,
-					Values:      []float64{value},
-					Start:       ruling.Window.Start,
-					End:         ruling.Window.End,
-					Passthrough: ruling.Window.Passthrough,
+				s.normalRun++
+				if k := f.GatherConfig.CloseAfterNormal; k > 0 && s.normalRun >= k {
+					f.FlushSpan(shard, s, closeNormal, out)
 				}
-				f.spanCache.spans[thisSeries] = s
 			}
+		}
+	} else if ruling.Anomalous {
+		// This ruling is anomalous, so start a new span.
+		s = f.newSpan(key, ruling, value)
+		s.chartBefore = shard.recent[key]
+		delete(shard.recent, key)
+		f.linkSpan(shard, s)
+		shard.spans[key] = s
+		f.queueSpan(shard, s)
+		f.escalate(s, out)
+	}
+
+	if _, open := shard.spans[key]; f.GatherConfig.Chart && !open && !ruling.Anomalous {
+		shard.recent[key] = appendContext(shard.recent[key], ruling.Window.Value)
+	}
+}
+
+// appendContext adds a window value to those drawn around a span in its
+// chart, keeping only the latest chartContext of them.
+func appendContext(values []float64, value float64) []float64 {
+	values = append(values, value)
+	if len(values) > chartContext {
+		values = append(values[:0], values[len(values)-chartContext:]...)
+	}
+	return values
+}
+
+func (f *gatherFilter) newSpan(key string, ruling ruling, value float64) *span {
+	s := &span{
+		key:         key,
+		ID:          newSpanID(),
+		Series:      ruling.Window.Series,
+		Start:       ruling.Window.Start,
+		End:         ruling.Window.End,
+		Passthrough: ruling.Window.Passthrough,
+		Tags:        ruling.Window.Tags,
+		Unit:        ruling.Window.Unit,
+		Kind:        ruling.Window.Kind,
+	}
+	f.addValue(s, value, ruling)
+	return s
+}
+
+func (f *gatherFilter) addValue(s *span, value float64, ruling ruling) {
+	// The span's first window already set its passthrough fields.
+	if len(s.Values) > 0 {
+		merged, err := mergePassthrough(s.Passthrough, ruling.Window.Passthrough, f.GatherConfig.PassthroughMerge)
+		if err != nil {
+			fmt.Println(err)
+		}
+		s.Passthrough = merged
+	}
+	s.Values = append(s.Values, value)
+	s.lastRuled = time.Now()
+	if f.GatherConfig.Sparkline || f.GatherConfig.Chart {
+		s.WindowValues = append(s.WindowValues, ruling.Window.Value)
+	}
+	if f.GatherConfig.WeightByConfidence {
+		s.Weights = append(s.Weights, math.Max(0, math.Min(1, ruling.Confidence)))
+	}
+}
+
+// escalate moves an open span to the most severe escalation state it has
+// reached and emits a state change event if that state is new.
+func (f *gatherFilter) escalate(s *span, out chan span) {
+	if len(f.GatherConfig.Escalation) == 0 {
+		return
+	}
+
+	provisional := *s
+	provisional.Values = append([]float64(nil), s.Values...)
+	provisional.Weights = append([]float64(nil), s.Weights...)
+	provisional.Duration = s.End.Sub(s.Start)
+	if err := provisional.CalcScore(f.aggregator, f.meanWeights); err != nil {
+		fmt.Println(err)
+		return
+	}
 
-			f.spanCache.Unlock()
+	level := s.escalation
+	for i, l := range f.GatherConfig.Escalation {
+		scoreReached := l.Score != 0 && math.Abs(provisional.Score) >= math.Abs(l.Score)
+		durationReached := l.Duration > 0 && provisional.Duration >= time.Duration(l.Duration)*time.Second
+		if scoreReached || durationReached {
+			level = i + 1
 		}
-	}()
-	return out
+	}
+	if level <= s.escalation {
+		return
+	}
+
+	s.escalation = level
+	s.State = f.GatherConfig.Escalation[level-1].State
+	provisional.State = s.State
+	provisional.StateChanged = true
+	f.transformScore(&provisional)
+	out <- provisional
 }
 
+// SpanExpired reports whether nothing has extended a span for a span width,
+// or the span will never get enough data to expire naturally.
 func (f *gatherFilter) SpanExpired(span *span, now time.Time) bool {
-	// When will this span be too old?
-	willExpireAt := span.End.Add(time.Duration(f.GatherConfig.SpanWidth) * time.Second)
+	return anomutil.SpanExpired(span.End, f.spanWidth(span.Series), f.lastDate, now)
+}
+
+// spanKey returns the key of the span a ruling belongs to: its series, plus
+// the values of any SpanKey passthrough fields.
+func (f *gatherFilter) spanKey(ruling ruling) string {
+	if len(f.GatherConfig.SpanKey) == 0 {
+		return ruling.Window.Series
+	}
+	parts := make([]string, 0, len(f.GatherConfig.SpanKey)+1)
+	parts = append(parts, ruling.Window.Series)
+	for _, name := range f.GatherConfig.SpanKey {
+		var value string
+		for _, field := range ruling.Passthrough {
+			if field.GetName() == name {
+				value = fmt.Sprint(fieldValue(field))
+				break
+			}
+		}
+		parts = append(parts, name+"="+value)
+	}
+	return strings.Join(parts, "\x00")
+}
 
-	isExpired := now.After(willExpireAt)
+// rememberSpan records a closing span, so that a new span for the same
+// series can be linked to it.
+func (f *gatherFilter) rememberSpan(shard *spanShard, span *span) {
+	if f.GatherConfig.ReopenGrace <= 0 {
+		return
+	}
+	closedAt, ok := shard.nows[span.key]
+	if !ok || closedAt.Before(span.End) {
+		closedAt = span.End
+	}
+	shard.closed[span.key] = closedSpan{
+		ID:       span.ID,
+		ClosedAt: closedAt,
+		Positive: len(span.Values) == 0 || span.Values[0] >= 0,
+	}
+}
 
-	// Are we never going to get enough data to expire this span naturally?
-	outOfData := willExpireAt.Equal(f.lastDate) || willExpireAt.After(f.lastDate)
+// linkSpan sets a new span's parent to the previous span of its series if
+// that went in the same direction and closed within the grace period.
+func (f *gatherFilter) linkSpan(shard *spanShard, s *span) {
+	prev, ok := shard.closed[s.key]
+	if !ok {
+		return
+	}
+	delete(shard.closed, s.key)
+	grace := time.Duration(f.GatherConfig.ReopenGrace) * time.Second
+	positive := s.Values[0] >= 0
+	if prev.Positive == positive && !s.Start.After(prev.ClosedAt.Add(grace)) {
+		s.ParentID = prev.ID
+	}
+}
 
-	return isExpired || outOfData
+// expiryReason returns why SpanExpired considers a span expired.
+func (f *gatherFilter) expiryReason(span *span, now time.Time) string {
+	if now.After(span.End.Add(f.spanWidth(span.Series))) {
+		return closeExpired
+	}
+	return closeStuck
 }
 
-func (f *gatherFilter) FlushSpan(span *span, out chan span) {
-	// Only called from within a goroutine that already locks spanCache for
-	// writing, so we don't need to lock here.
-	f.flushSpan(span, out)
-	delete(f.spanCache.spans, span.Series)
-	delete(f.spanCache.nows, span.Series)
+func (f *gatherFilter) FlushSpan(shard *spanShard, span *span, reason string, out chan span) {
+	// Only called from within a goroutine that already locks the span's shard
+	// for writing, so we don't need to lock here.
+	f.keepAmendable(shard, span, reason)
+	f.flushSpan(span, reason, out)
+	f.rememberSpan(shard, span)
+	f.dequeueSpan(shard, span)
+	delete(shard.spans, span.key)
+	delete(shard.nows, span.key)
 }
 
 func (f *gatherFilter) FlushExpiredSpans(now time.Time, out chan span) {
-	f.spanCache.Lock()
-	for _, span := range f.spanCache.spans {
-		if f.SpanExpired(span, now) {
-			f.FlushSpan(span, out)
+	for _, shard := range f.spanCache.shards {
+		shard.lock()
+		for {
+			span := shard.expiries.Peek()
+			if span == nil || !now.After(span.expiresAt) {
+				break
+			}
+			f.FlushSpan(shard, span, f.expiryReason(span, now), out)
 		}
+		shard.Unlock()
 	}
-	f.spanCache.Unlock()
+}
+
+// ReportMsg implements Heka's ReportingPlugin interface.
+func (f *gatherFilter) ReportMsg(msg *message.Message) error {
+	if f.GatherConfig.Disabled {
+		return nil
+	}
+	var open, acquisitions int64
+	var waited time.Duration
+	for _, shard := range f.spanCache.shards {
+		shard.lock()
+		open += int64(len(shard.spans))
+		acquisitions += shard.acquisitions
+		waited += shard.waited
+		shard.Unlock()
+	}
+	if err := message.NewInt64Field(msg, "OpenSpans", open, "count"); err != nil {
+		return err
+	}
+	if err := message.NewInt64Field(msg, "SpanLockWaits", acquisitions, "count"); err != nil {
+		return err
+	}
+	if err := message.NewInt64Field(msg, "SpanLockWaitTime", int64(waited), "ns"); err != nil {
+		return err
+	}
+	return message.NewInt64Field(msg, "FlushedSpans", atomic.LoadInt64(&f.flushed), "count")
 }
 
 func (f *gatherFilter) FlushStuckSpans(out chan span) {
-	f.spanCache.Lock()
-	for series, span := range f.spanCache.spans {
-		willExpireAt := span.End.Add(time.Duration(f.GatherConfig.SpanWidth) * time.Second)
-
-		if willExpireAt.After(f.lastDate) {
-			f.flushSpan(span, out)
-			delete(f.spanCache.spans, series)
-			delete(f.spanCache.nows, series)
+	for _, shard := range f.spanCache.shards {
+		shard.lock()
+		for series, span := range shard.spans {
+			willExpireAt := span.End.Add(f.spanWidth(span.Series))
+
+			if willExpireAt.After(f.lastDate) {
+				f.keepAmendable(shard, span, closeStuck)
+				f.flushSpan(span, closeStuck, out)
+				f.rememberSpan(shard, span)
+				f.dequeueSpan(shard, span)
+				delete(shard.spans, series)
+				delete(shard.nows, series)
+			}
 		}
+		shard.Unlock()
 	}
-	f.spanCache.Unlock()
 }
 
 func (f *gatherFilter) PrintSpansInMem() {
 	fmt.Println("Spans in mem")
-	f.spanCache.Lock()
-	for series, span := range f.spanCache.spans {
-		willExpireAt := span.End.Add(time.Duration(f.GatherConfig.SpanWidth) * time.Second)
+	for _, span := range f.spanCache.Snapshot() {
+		willExpireAt := span.End.Add(f.spanWidth(span.Series))
 
-		fmt.Println(series)
+		fmt.Println(span.Series)
 		fmt.Println("start", span.Start)
 		fmt.Println("end", span.End)
-		fmt.Println("now", f.spanCache.nows[span.Series])
+		fmt.Println("now", span.Now)
 		fmt.Println("expires", willExpireAt)
 		fmt.Println("")
 	}
-	f.spanCache.Unlock()
 }
 
-func (f *gatherFilter) flushSpan(span *span, out chan span) {
+func (f *gatherFilter) PrintLockContention() {
+	f.spanCache.PrintLockContention()
+}
+
+func (f *gatherFilter) flushSpan(span *span, reason string, out chan span) {
+	atomic.AddInt64(&f.flushed, 1)
+	span.CloseReason = reason
 	span.Duration = span.End.Sub(span.Start) // + (time.Duration(f.GatherConfig.SampleInterval) * time.Second)
-	err := span.CalcScore(f.aggregator)
+	err := span.CalcScore(f.aggregator, f.meanWeights)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	if f.GatherConfig.Chart {
+		if span.Chart, err = renderChart(span.chartBefore, span.WindowValues, span.chartAfter); err != nil {
+			fmt.Println(err)
+		}
+		if !f.GatherConfig.Sparkline {
+			span.WindowValues = nil
+		}
+	}
+	// Amended spans aren't ranked again, so their scores aren't counted twice.
+	if f.GatherConfig.ScoreQuantiles && !span.Amended {
+		f.rankScore(span)
+	}
+	if f.GatherConfig.Classify {
+		span.Class = classify(span.Values)
+	}
+	span.ValueCount = len(span.Values)
+	if max := f.GatherConfig.MaxEmittedValues; max > 0 {
+		span.Values = downsample(span.Values, max, f.GatherConfig.DownsampleMethod)
+		span.WindowValues = downsample(span.WindowValues, max, f.GatherConfig.DownsampleMethod)
+	}
+	f.transformScore(span)
 	out <- *span
 }
 
+// allSeriesGroup is the key of the score digest covering every series. Real
+// groups come from the catalog and can't start with a NUL.
+const allSeriesGroup = "\x00all"
+
+// rankScore sets the quantiles of a span's score among recent spans, then
+// records the score.
+func (f *gatherFilter) rankScore(span *span) {
+	f.scoresLock.Lock()
+	defer f.scoresLock.Unlock()
+	score := math.Abs(span.Score)
+	group := f.catalog.Group(span.Series)
+
+	all := f.scoreDigest(allSeriesGroup)
+	groupDigest := f.scoreDigest(group)
+	if d := all.Digest(); d.Count() > 0 {
+		span.ScoreQuantile = d.CDF(score)
+		span.GroupScoreQuantile = groupDigest.Digest().CDF(score)
+		if math.IsNaN(span.GroupScoreQuantile) {
+			span.GroupScoreQuantile = span.ScoreQuantile
+		}
+		span.Ranked = true
+	}
+	all.Add(score)
+	if group != allSeriesGroup {
+		groupDigest.Add(score)
+	}
+}
+
+func (f *gatherFilter) scoreDigest(group string) *recentDigest {
+	d, ok := f.scores[group]
+	if !ok {
+		d = newRecentDigest(f.GatherConfig.ScoreQuantileWindow)
+		f.scores[group] = d
+	}
+	return d
+}
+
+func (f *gatherFilter) PrintScoreQuantiles() {
+	fmt.Println("Span score quantiles")
+	// Copy the digests so that spans can keep being ranked while we print.
+	f.scoresLock.Lock()
+	digests := make(map[string]*tDigest, len(f.scores))
+	for group, d := range f.scores {
+		digests[group] = d.Digest()
+	}
+	f.scoresLock.Unlock()
+
+	for group, digest := range digests {
+		if group == allSeriesGroup {
+			group = "(all)"
+		}
+		fmt.Println(group, "p50", digest.Quantile(0.5), "p90", digest.Quantile(0.9),
+			"p99", digest.Quantile(0.99))
+	}
+	fmt.Println()
+}
+
+// getRulingValue returns the first of the value fields that's present on a
+// ruling and holds a finite number.
 func (f *gatherFilter) getRulingValue(ruling ruling) (float64, error) {
-	st := reflect.ValueOf(ruling)
-	value := reflect.Indirect(st).FieldByName(f.GatherConfig.ValueField)
-	if !value.IsValid() {
-		return 0.0, errors.New("Ruling did not contain field.")
+	for _, name := range f.valueFields {
+		value := rulingValues[name](ruling)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		return value, nil
+	}
+	return 0.0, errors.New("Ruling did not contain a valid value field.")
+}
+
+// rawRulingValue returns the value of a ruling's window before it was
+// transformed or normalized, which is just its value if it wasn't.
+func rawRulingValue(r ruling) float64 {
+	if r.Window.Transformed {
+		return r.Window.RawValue
+	}
+	return r.Window.Value
+}
+
+// parseValueFields returns the names of the ruling values value_field lists,
+// in lower case, rejecting any that a ruling doesn't have.
+func parseValueFields(config interface{}) ([]string, error) {
+	fields, err := valueFieldNames(config)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range fields {
+		fields[i] = strings.ToLower(name)
+		if _, ok := rulingValues[fields[i]]; !ok {
+			return nil, fmt.Errorf("Unknown value field %q.", name)
+		}
+	}
+	return fields, nil
+}
+
+func valueFieldNames(config interface{}) ([]string, error) {
+	switch v := config.(type) {
+	case nil:
+		return []string{defaultValueField}, nil
+	case string:
+		if v == "" {
+			return []string{defaultValueField}, nil
+		}
+		return []string{v}, nil
+	case []string:
+		if len(v) == 0 {
+			return []string{defaultValueField}, nil
+		}
+		return append([]string(nil), v...), nil
+	case []interface{}:
+		if len(v) == 0 {
+			return []string{defaultValueField}, nil
+		}
+		fields := make([]string, len(v))
+		for i, field := range v {
+			name, ok := field.(string)
+			if !ok {
+				return nil, errors.New("'value_field' must be a string or a list of strings.")
+			}
+			fields[i] = name
+		}
+		return fields, nil
 	}
-	return value.Float(), nil
+	return nil, errors.New("'value_field' must be a string or a list of strings.")
 }
 
 func (f *gatherFilter) getAggregator() func(stats.Float64Data) (float64, error) {
@@ -0,0 +1,277 @@
+package hekaanom
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+func newTestGatherFilter(t testing.TB, configure func(*GatherConfig)) *gatherFilter {
+	f := &gatherFilter{}
+	conf := f.ConfigStruct().(*GatherConfig)
+	conf.SpanWidth = "1h"
+	conf.LastDate = "2100-01-01T00:00:00Z"
+	if configure != nil {
+		configure(conf)
+	}
+	if err := f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestValueFieldFallback(t *testing.T) {
+	fields, err := parseValueFields([]interface{}{"Normed", "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &gatherFilter{valueFields: fields}
+
+	cases := []struct {
+		name   string
+		ruling ruling
+		want   float64
+	}{
+		{"normed", ruling{Normed: 2.5, Window: window{Value: 7}}, 2.5},
+		{"raw value", ruling{Normed: math.NaN(), Window: window{Value: 7}}, 7},
+		{"transformed", ruling{Normed: math.NaN(),
+			Window: window{Value: 0.8, RawValue: 7, Transformed: true}}, 7},
+	}
+	for _, c := range cases {
+		got, err := f.getRulingValue(c.ruling)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := f.getRulingValue(ruling{Normed: math.NaN(),
+		Window: window{Value: math.Inf(1)}}); err == nil {
+		t.Error("a ruling with no valid value field should be an error")
+	}
+}
+
+func TestWeightByConfidenceMean(t *testing.T) {
+	f := newTestGatherFilter(t, func(conf *GatherConfig) {
+		conf.Statistic = "Mean"
+		conf.WeightByConfidence = true
+	})
+	start := time.Unix(0, 0)
+	in := make(chan []ruling)
+	out := f.Connect(in)
+	go func() {
+		var rulings []ruling
+		for i, r := range []struct{ normed, confidence float64 }{{4, 1}, {2, 0.5}} {
+			winStart := start.Add(time.Duration(i) * time.Minute)
+			rulings = append(rulings, ruling{
+				Window:     window{Series: "web", Start: winStart, End: winStart.Add(time.Minute)},
+				Anomalous:  true,
+				Normed:     r.normed,
+				Confidence: r.confidence,
+			})
+		}
+		in <- rulings
+		close(in)
+	}()
+
+	var spans []span
+	for s := range out {
+		spans = append(spans, s)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	// (4*1 + 2*0.5) / (1 + 0.5)
+	if want := 10.0 / 3; math.Abs(spans[0].Aggregation-want) > 1e-9 {
+		t.Errorf("got an aggregation of %v, want the weighted mean %v", spans[0].Aggregation, want)
+	}
+}
+
+func TestChartContext(t *testing.T) {
+	f := newTestGatherFilter(t, func(conf *GatherConfig) {
+		conf.Chart = true
+		conf.IncludeNormalValues = false
+		conf.CloseAfterNormal = 2
+	})
+	start := time.Unix(0, 0)
+	var rulings []ruling
+	for i, value := range []float64{1, 2, 1, 2, 10, 12, 1, 2} {
+		winStart := start.Add(time.Duration(i) * time.Minute)
+		rulings = append(rulings, ruling{
+			Window:    window{Series: "web", Start: winStart, End: winStart.Add(time.Minute), Value: value},
+			Anomalous: value > 5,
+			Normed:    value,
+		})
+	}
+	in := make(chan []ruling)
+	out := f.Connect(in)
+	go func() {
+		in <- rulings
+		close(in)
+	}()
+
+	var spans []span
+	for s := range out {
+		spans = append(spans, s)
+	}
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	s := spans[0]
+	if fmt.Sprint(s.chartBefore) != "[1 2 1 2]" || fmt.Sprint(s.chartAfter) != "[1 2]" {
+		t.Errorf("got %v before the span and %v after it, want [1 2 1 2] and [1 2]", s.chartBefore, s.chartAfter)
+	}
+
+	img, err := png.Decode(bytes.NewReader(s.Chart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drawn := map[color.Color]bool{}
+	bounds := img.Bounds()
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			drawn[color.RGBAModel.Convert(img.At(x, y))] = true
+		}
+	}
+	for name, c := range map[string]color.Color{"baseline band": chartBand, "context": chartAround, "span": chartLine} {
+		if !drawn[c] {
+			t.Errorf("the chart has no %s", name)
+		}
+	}
+}
+
+func TestParseValueFieldsRejectsUnknown(t *testing.T) {
+	if _, err := parseValueFields([]interface{}{"normed", "bogus"}); err == nil {
+		t.Error("an unknown value field should be an error")
+	}
+	fields, err := parseValueFields(nil)
+	if err != nil || len(fields) != 1 || fields[0] != defaultValueField {
+		t.Errorf("got %v, %v; want the default value field", fields, err)
+	}
+}
+
+func TestReportMsgLockContention(t *testing.T) {
+	f := newTestGatherFilter(t, nil)
+	openTestSpan(f, "web", time.Unix(0, 0))
+
+	msg := &message.Message{}
+	if err := f.ReportMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	// Reporting locks every shard once, and is counted too.
+	for name, want := range map[string]int64{"OpenSpans": 1, "SpanLockWaits": spanCacheShards} {
+		value, ok := msg.GetFieldValue(name)
+		if !ok || value.(int64) != want {
+			t.Errorf("got %s %v, want %d", name, value, want)
+		}
+	}
+	if _, ok := msg.GetFieldValue("SpanLockWaitTime"); !ok {
+		t.Error("no SpanLockWaitTime field")
+	}
+}
+
+// FuzzParseLastDate parses arbitrary last_date settings. Any timestamp it
+// accepts must survive being formatted and parsed again.
+func FuzzParseLastDate(f *testing.F) {
+	f.Fuzz(func(t *testing.T, date string) {
+		parsed, err := parseLastDate(date)
+		if err != nil || date == "today" || date == "yesterday" {
+			return
+		}
+		again, err := parseLastDate(parsed.Format(time.RFC3339Nano))
+		if err != nil {
+			t.Fatalf("%q parsed as %v, which doesn't parse again: %s", date, parsed, err)
+		}
+		if !again.Equal(parsed) {
+			t.Errorf("%q parsed as %v, then as %v", date, parsed, again)
+		}
+	})
+}
+
+// TestAnomalousRulingsLandInOneSpan checks, for any rulings arriving in order,
+// that every span starts no later than it ends and that every anomalous ruling
+// lands in exactly one span of its series.
+func TestAnomalousRulingsLandInOneSpan(t *testing.T) {
+	property := func(steps []uint8, scores []int8) bool {
+		f := newTestGatherFilter(t, func(conf *GatherConfig) {
+			conf.IncludeNormalValues = false
+		})
+		var rulings []ruling
+		var anomalous int
+		starts := map[string]time.Time{}
+		for i := 0; i < len(steps) && i < len(scores); i++ {
+			series := fmt.Sprintf("series-%d", i%3)
+			// Gaps of up to an hour and a half let some spans expire.
+			last, ok := starts[series]
+			if !ok {
+				last = time.Unix(0, 0)
+			}
+			start := last.Add(time.Duration(steps[i]%90) * time.Minute)
+			starts[series] = start.Add(time.Minute)
+			r := ruling{
+				Window:    window{Series: series, Start: start, End: start.Add(time.Minute)},
+				Normed:    float64(scores[i]) / 10,
+				Anomalous: scores[i] >= 30 || scores[i] <= -30,
+			}
+			if r.Anomalous {
+				anomalous++
+			}
+			rulings = append(rulings, r)
+		}
+
+		in := make(chan []ruling)
+		out := f.Connect(in)
+		go func() {
+			for i := 0; i < len(rulings); i += 5 {
+				end := i + 5
+				if end > len(rulings) {
+					end = len(rulings)
+				}
+				in <- rulings[i:end]
+			}
+			close(in)
+		}()
+		var spans []span
+		var values int
+		for s := range out {
+			if s.End.Before(s.Start) {
+				t.Logf("%s: span ends at %v, before its start at %v", s.Series, s.End, s.Start)
+				return false
+			}
+			spans = append(spans, s)
+			values += s.ValueCount
+		}
+		if values != anomalous {
+			t.Logf("spans hold %d values, want one for each of %d anomalous rulings", values, anomalous)
+			return false
+		}
+
+		for _, r := range rulings {
+			if !r.Anomalous {
+				continue
+			}
+			var in int
+			for _, s := range spans {
+				if s.Series == r.Window.Series && !r.Window.Start.Before(s.Start) && !r.Window.End.After(s.End) {
+					in++
+				}
+			}
+			if in != 1 {
+				t.Logf("%s: anomalous ruling at %v is in %d spans", r.Window.Series, r.Window.Start, in)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
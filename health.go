@@ -0,0 +1,121 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	healthIngestRate = "ingest_rate"
+	healthRulingRate = "ruling_rate"
+	healthSpanRate   = "span_rate"
+	healthQueueDepth = "queue_depth"
+
+	// The smoothing factor of the moving averages that form the baseline of
+	// each health metric.
+	healthAlpha = 0.1
+)
+
+var healthMetrics = []string{healthIngestRate, healthRulingRate, healthSpanRate, healthQueueDepth}
+
+// healthMonitor watches the pipeline's own throughput and queue depth once per
+// tick, and flags ticks that stray too far from the exponentially weighted
+// moving average of previous ticks. It is deliberately much simpler than the
+// configurable detectors so it can't fail in the same way they might.
+type healthMonitor struct {
+	threshold float64
+	warmup    int
+
+	ingested int64
+	ruled    int64
+	spanned  int64
+
+	ticks     int
+	means     map[string]float64
+	variances map[string]float64
+}
+
+type healthAlert struct {
+	Metric    string
+	Value     float64
+	Expected  float64
+	Deviation float64
+}
+
+func newHealthMonitor(threshold float64, warmup int) *healthMonitor {
+	return &healthMonitor{
+		threshold: threshold,
+		warmup:    warmup,
+		means:     map[string]float64{},
+		variances: map[string]float64{},
+	}
+}
+
+func (h *healthMonitor) Ingested() { atomic.AddInt64(&h.ingested, 1) }
+func (h *healthMonitor) Ruled()    { atomic.AddInt64(&h.ruled, 1) }
+func (h *healthMonitor) Spanned()  { atomic.AddInt64(&h.spanned, 1) }
+
+// Tick takes the counts gathered since the last tick, along with the current
+// queue depth, and returns alerts for every metric that looks anomalous.
+func (h *healthMonitor) Tick(queueDepth int) []healthAlert {
+	values := map[string]float64{
+		healthIngestRate: float64(atomic.SwapInt64(&h.ingested, 0)),
+		healthRulingRate: float64(atomic.SwapInt64(&h.ruled, 0)),
+		healthSpanRate:   float64(atomic.SwapInt64(&h.spanned, 0)),
+		healthQueueDepth: float64(queueDepth),
+	}
+
+	var alerts []healthAlert
+	for _, metric := range healthMetrics {
+		value := values[metric]
+		if h.ticks == 0 {
+			h.means[metric] = value
+			continue
+		}
+
+		mean, variance := h.means[metric], h.variances[metric]
+		sd := math.Max(math.Sqrt(variance), 1)
+		deviation := (value - mean) / sd
+		if h.ticks >= h.warmup {
+			// Ingestion stopping altogether is always worth flagging, however
+			// noisy it has been.
+			stopped := metric == healthIngestRate && value == 0 && mean >= 1
+			if stopped || math.Abs(deviation) > h.threshold {
+				alerts = append(alerts, healthAlert{metric, value, mean, deviation})
+			}
+		}
+
+		diff := value - mean
+		h.means[metric] = mean + healthAlpha*diff
+		h.variances[metric] = (1 - healthAlpha) * (variance + healthAlpha*diff*diff)
+	}
+	h.ticks++
+	return alerts
+}
+
+func (a healthAlert) FillMessage(m *message.Message) error {
+	metric, err := message.NewField("metric", a.Metric, "")
+	if err != nil {
+		return errors.New("Could not create 'metric' field")
+	}
+	value, err := message.NewField("value", a.Value, "count")
+	if err != nil {
+		return errors.New("Could not create 'value' field")
+	}
+	expected, err := message.NewField("expected", a.Expected, "count")
+	if err != nil {
+		return errors.New("Could not create 'expected' field")
+	}
+	deviation, err := message.NewField("deviation", a.Deviation, "")
+	if err != nil {
+		return errors.New("Could not create 'deviation' field")
+	}
+	m.AddField(metric)
+	m.AddField(value)
+	m.AddField(expected)
+	m.AddField(deviation)
+	return nil
+}
@@ -0,0 +1,189 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// The number of histogram buckets per doubling of magnitude, so each bucket
+// is about 19% wider than the last.
+const histogramScale = 4
+
+// expHistogram is a compact histogram of a series' recent window values, with
+// buckets whose bounds grow exponentially in both directions from zero. Older
+// values weigh less, halving every half-life values.
+type expHistogram struct {
+	growth float64
+	// The weight of the next value. Rather than decaying every bucket on every
+	// value, new values are weighted more, and the weights rescaled once they
+	// get large.
+	weight   float64
+	zero     float64
+	pos, neg map[int]float64
+	total    float64
+}
+
+type histogramBucket struct {
+	Lower  float64 `json:"lower"`
+	Upper  float64 `json:"upper"`
+	Weight float64 `json:"weight"`
+}
+
+func newExpHistogram(halfLife int) *expHistogram {
+	return &expHistogram{
+		growth: math.Pow(2, 1/float64(halfLife)),
+		weight: 1,
+		pos:    map[int]float64{},
+		neg:    map[int]float64{},
+	}
+}
+
+// histogramIndex returns the index of the bucket a magnitude falls in. Bucket
+// i covers (2^((i-1)/scale), 2^(i/scale)].
+func histogramIndex(magnitude float64) int {
+	return int(math.Ceil(math.Log2(magnitude) * histogramScale))
+}
+
+func histogramBound(i int) float64 {
+	return math.Pow(2, float64(i)/histogramScale)
+}
+
+func (h *expHistogram) Add(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	switch {
+	case v > 0:
+		h.pos[histogramIndex(v)] += h.weight
+	case v < 0:
+		h.neg[histogramIndex(-v)] += h.weight
+	default:
+		h.zero += h.weight
+	}
+	h.total += h.weight
+	h.weight *= h.growth
+
+	if h.weight > 1e100 {
+		scale := 1 / h.weight
+		for i := range h.pos {
+			h.pos[i] *= scale
+		}
+		for i := range h.neg {
+			h.neg[i] *= scale
+		}
+		h.zero *= scale
+		h.total *= scale
+		h.weight = 1
+	}
+}
+
+// Percentile returns the fraction of the recent values below v, counting half
+// of those in v's own bucket, or NaN if no values have been added.
+func (h *expHistogram) Percentile(v float64) float64 {
+	if h.total == 0 {
+		return math.NaN()
+	}
+	var below, same float64
+	switch {
+	case v > 0:
+		below = h.zero
+		for _, weight := range h.neg {
+			below += weight
+		}
+		i := histogramIndex(v)
+		for j, weight := range h.pos {
+			if j < i {
+				below += weight
+			} else if j == i {
+				same = weight
+			}
+		}
+	case v < 0:
+		i := histogramIndex(-v)
+		for j, weight := range h.neg {
+			if j > i {
+				below += weight
+			} else if j == i {
+				same = weight
+			}
+		}
+	default:
+		for _, weight := range h.neg {
+			below += weight
+		}
+		same = h.zero
+	}
+	return (below + same/2) / h.total
+}
+
+// Buckets returns the histogram's non-empty buckets in ascending order, with
+// weights as fractions of the total.
+func (h *expHistogram) Buckets() []histogramBucket {
+	if h.total == 0 {
+		return nil
+	}
+	buckets := make([]histogramBucket, 0, len(h.pos)+len(h.neg)+1)
+	for i, weight := range h.neg {
+		buckets = append(buckets, histogramBucket{-histogramBound(i), -histogramBound(i - 1), weight / h.total})
+	}
+	if h.zero > 0 {
+		buckets = append(buckets, histogramBucket{0, 0, h.zero / h.total})
+	}
+	for i, weight := range h.pos {
+		buckets = append(buckets, histogramBucket{histogramBound(i - 1), histogramBound(i), weight / h.total})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Lower < buckets[j].Lower })
+	return buckets
+}
+
+// rankValue sets where a ruling's window value sits among its series' recent
+// window values, then adds it to them. Anomalous rulings also carry the
+// histogram itself.
+func (f *detectFilter) rankValue(r *ruling) {
+	f.histogramsLock.Lock()
+	defer f.histogramsLock.Unlock()
+	h, ok := f.histograms[r.Window.Series]
+	if !ok {
+		h = newExpHistogram(f.DetectConfig.HistogramHalfLife)
+		f.histograms[r.Window.Series] = h
+	}
+	if p := h.Percentile(r.Window.Value); !math.IsNaN(p) {
+		r.Ranked = true
+		r.ValuePercentile = p
+		if r.Anomalous {
+			r.Histogram = h.Buckets()
+		}
+	}
+	h.Add(r.Window.Value)
+}
+
+// forgetHistogram drops the value histogram of a series.
+func (f *detectFilter) forgetHistogram(series string) {
+	f.histogramsLock.Lock()
+	defer f.histogramsLock.Unlock()
+	delete(f.histograms, series)
+}
+
+func addHistogramFields(m *message.Message, buckets []histogramBucket) error {
+	lower := message.NewFieldInit("histogram_lower", message.Field_DOUBLE, "")
+	upper := message.NewFieldInit("histogram_upper", message.Field_DOUBLE, "")
+	weights := message.NewFieldInit("histogram_weights", message.Field_DOUBLE, "")
+	for _, b := range buckets {
+		if err := lower.AddValue(b.Lower); err != nil {
+			return errors.New("Could not create 'histogram_lower' field")
+		}
+		if err := upper.AddValue(b.Upper); err != nil {
+			return errors.New("Could not create 'histogram_upper' field")
+		}
+		if err := weights.AddValue(b.Weight); err != nil {
+			return errors.New("Could not create 'histogram_weights' field")
+		}
+	}
+	m.AddField(lower)
+	m.AddField(upper)
+	m.AddField(weights)
+	return nil
+}
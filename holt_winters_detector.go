@@ -0,0 +1,247 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// The ways a Holt-Winters model can combine its seasonal part with its level
+// and trend.
+const (
+	seasonalityAdditive       = "additive"
+	seasonalityMultiplicative = "multiplicative"
+
+	// How much weight each new forecast error gets in the estimate of the
+	// forecast's standard deviation.
+	holtWintersErrorWeight = 0.1
+)
+
+// holtWintersDetector forecasts each window of a series with a Holt-Winters
+// (triple exponential smoothing) model of its level, trend and season, and
+// rules the window anomalous if its value falls outside a band around the
+// forecast, measured in standard deviations of the model's recent forecast
+// errors.
+type holtWintersDetector struct {
+	season         int
+	multiplicative bool
+	alpha          float64
+	beta           float64
+	gamma          float64
+	band           float64
+	series         map[string]*holtWintersModel
+}
+
+// holtWintersModel is a series' model. Until it's seen two seasons, it only
+// collects their values to fit its starting state from.
+type holtWintersModel struct {
+	initial  []float64
+	level    float64
+	trend    float64
+	seasonal []float64
+	phase    int
+	variance float64
+}
+
+func (d *holtWintersDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	season, ok := conf["season"]
+	if !ok {
+		return errors.New("Must provide 'season'")
+	}
+	s, ok := season.(int64)
+	if !ok || s < 2 {
+		return errors.New("'season' must be an integer of at least 2")
+	}
+	d.season = int(s)
+
+	d.multiplicative = false
+	if seasonality, ok := conf["seasonality"]; ok {
+		switch seasonality {
+		case seasonalityAdditive:
+		case seasonalityMultiplicative:
+			d.multiplicative = true
+		default:
+			return errors.New("'seasonality' must be \"additive\" or \"multiplicative\"")
+		}
+	}
+
+	var err error
+	for _, param := range []struct {
+		name  string
+		value *float64
+		def   float64
+	}{
+		{"alpha", &d.alpha, 0.3},
+		{"beta", &d.beta, 0.05},
+		{"gamma", &d.gamma, 0.3},
+	} {
+		if *param.value, err = configFloat(conf, param.name, param.def); err != nil {
+			return err
+		}
+		if *param.value < 0 || *param.value > 1 {
+			return errors.New("'" + param.name + "' must be between zero and one")
+		}
+	}
+	if d.band, err = configFloat(conf, "band", 3); err != nil {
+		return err
+	}
+	if d.band <= 0 {
+		return errors.New("'band' must be greater than zero")
+	}
+
+	d.series = map[string]*holtWintersModel{}
+	return nil
+}
+
+func (d *holtWintersDetector) Train(win window) {
+	d.update(d.model(win.Series), win.Value)
+}
+
+func (d *holtWintersDetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	model, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	d.series[new] = model
+}
+
+func (d *holtWintersDetector) Forget(series string) {
+	delete(d.series, series)
+}
+
+// Detect rules on a window once its series' model has been fitted, then
+// updates the model with the window's value. An excluded window updates the
+// model with its forecast instead, so that the season stays in step without
+// the window affecting it.
+func (d *holtWintersDetector) Detect(win window, out chan ruling) {
+	model := d.model(win.Series)
+	if model.seasonal == nil {
+		if !win.Excluded {
+			d.update(model, win.Value)
+		}
+		return
+	}
+
+	forecast := d.forecast(model)
+	normed := d.score(model, win.Value-forecast)
+	out <- ruling{
+		Window:        win,
+		Anomalous:     math.Abs(normed) > d.band,
+		Anomalousness: math.Abs(normed),
+		Normed:        normed,
+		Confidence:    1.0,
+		Passthrough:   win.Passthrough,
+	}
+	if win.Excluded {
+		d.update(model, forecast)
+	} else {
+		d.update(model, win.Value)
+	}
+}
+
+func (d *holtWintersDetector) model(series string) *holtWintersModel {
+	model, ok := d.series[series]
+	if !ok {
+		model = &holtWintersModel{}
+		d.series[series] = model
+	}
+	return model
+}
+
+// forecast returns the model's forecast of the next value.
+func (d *holtWintersDetector) forecast(m *holtWintersModel) float64 {
+	if d.multiplicative {
+		return (m.level + m.trend) * m.seasonal[m.phase]
+	}
+	return m.level + m.trend + m.seasonal[m.phase]
+}
+
+// score returns how many standard deviations of the model's forecast errors a
+// window's error is. Before the model has made any errors, the error is given
+// a flatScore.
+func (d *holtWintersDetector) score(m *holtWintersModel, err float64) float64 {
+	if m.variance > 0 {
+		return err / math.Sqrt(m.variance)
+	}
+	return flatScore(err, d.band)
+}
+
+// update adds a value to a series' model, fitting the model once it has two
+// seasons of values.
+func (d *holtWintersDetector) update(m *holtWintersModel, value float64) {
+	if m.seasonal == nil {
+		m.initial = append(m.initial, value)
+		if len(m.initial) == 2*d.season {
+			d.fit(m)
+		}
+		return
+	}
+
+	err := value - d.forecast(m)
+	m.variance = (1-holtWintersErrorWeight)*m.variance + holtWintersErrorWeight*err*err
+
+	seasonal := m.seasonal[m.phase]
+	level := m.level
+	if d.multiplicative {
+		if seasonal != 0 {
+			m.level = d.alpha*(value/seasonal) + (1-d.alpha)*(level+m.trend)
+		}
+		if m.level != 0 {
+			m.seasonal[m.phase] = d.gamma*(value/m.level) + (1-d.gamma)*seasonal
+		}
+	} else {
+		m.level = d.alpha*(value-seasonal) + (1-d.alpha)*(level+m.trend)
+		m.seasonal[m.phase] = d.gamma*(value-m.level) + (1-d.gamma)*seasonal
+	}
+	m.trend = d.beta*(m.level-level) + (1-d.beta)*m.trend
+	m.phase = (m.phase + 1) % d.season
+}
+
+// fit sets a model's starting level, trend and season from its first two
+// seasons of values, then runs the model over them to bring it up to date.
+func (d *holtWintersDetector) fit(m *holtWintersModel) {
+	first, second := m.initial[:d.season], m.initial[d.season:]
+	firstMean, secondMean := mean(first), mean(second)
+
+	m.level = firstMean
+	m.trend = (secondMean - firstMean) / float64(d.season)
+	m.seasonal = make([]float64, d.season)
+	for i := range m.seasonal {
+		if d.multiplicative {
+			m.seasonal[i] = (ratio(first[i], firstMean) + ratio(second[i], secondMean)) / 2
+		} else {
+			m.seasonal[i] = (first[i] - firstMean + second[i] - secondMean) / 2
+		}
+	}
+
+	initial := m.initial
+	m.initial = nil
+	for _, value := range initial {
+		d.update(m, value)
+	}
+}
+
+// mean returns the mean of values.
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// ratio returns a value as a multiple of a season's mean, or 1 if the mean is
+// zero.
+func ratio(value, mean float64) float64 {
+	if mean == 0 {
+		return 1
+	}
+	return value / mean
+}
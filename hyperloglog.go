@@ -0,0 +1,66 @@
+package hekaanom
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits that pick a register. 2^12
+// registers take 4KB and estimate with a standard error of about 1.6%.
+const hllPrecision = 12
+
+// hyperLogLog estimates the number of distinct keys added to it, after
+// Flajolet et al., in a fixed amount of memory however many keys there are.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// Add records a key.
+func (h *hyperLogLog) Add(key string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	x := mix64(hash.Sum64())
+
+	i := x >> (64 - hllPrecision)
+	// The rank of the remaining bits: the position of their first set bit.
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// Count returns the estimated number of distinct keys added.
+func (h *hyperLogLog) Count() float64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Small cardinalities are estimated better by linear counting.
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// mix64 scrambles the bits of a hash (splitmix64's finalizer), since FNV
+// hashes of similar keys differ little in their high bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
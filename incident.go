@@ -0,0 +1,167 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// incident groups spans that overlap in time and share a route (or, failing
+// that, an owner) in the catalog, so that one underlying problem affecting
+// many series pages once.
+type incident struct {
+	Group    string
+	Start    time.Time
+	End      time.Time
+	Score    float64
+	MaxScore float64
+	Spans    []span
+}
+
+// incidentGatherer turns a stream of closed spans into a stream of incidents.
+type incidentGatherer struct {
+	sync.Mutex
+	gap       time.Duration
+	catalog   *catalog
+	incidents map[string]*incident
+}
+
+func newIncidentGatherer(gap time.Duration, c *catalog) *incidentGatherer {
+	return &incidentGatherer{
+		gap:       gap,
+		catalog:   c,
+		incidents: map[string]*incident{},
+	}
+}
+
+func (g *incidentGatherer) Connect(in chan span) chan incident {
+	out := make(chan incident)
+	go func() {
+		defer close(out)
+		for s := range in {
+			if s.StateChanged {
+				continue
+			}
+			group := g.catalog.Group(s.Series)
+
+			g.Lock()
+			inc, ok := g.incidents[group]
+			if ok && s.Start.After(inc.End.Add(g.gap)) {
+				out <- *inc
+				ok = false
+			}
+			if !ok {
+				inc = &incident{Group: group, Start: s.Start, End: s.End}
+				g.incidents[group] = inc
+			}
+			inc.add(s)
+			g.Unlock()
+		}
+
+		g.Lock()
+		for group, inc := range g.incidents {
+			out <- *inc
+			delete(g.incidents, group)
+		}
+		g.Unlock()
+	}()
+	return out
+}
+
+// FlushExpiredIncidents closes incidents that no span has joined for longer
+// than the incident gap.
+func (g *incidentGatherer) FlushExpiredIncidents(now time.Time, out chan incident) {
+	g.Lock()
+	defer g.Unlock()
+	for group, inc := range g.incidents {
+		if now.After(inc.End.Add(g.gap)) {
+			out <- *inc
+			delete(g.incidents, group)
+		}
+	}
+}
+
+func (inc *incident) add(s span) {
+	if s.Start.Before(inc.Start) {
+		inc.Start = s.Start
+	}
+	if s.End.After(inc.End) {
+		inc.End = s.End
+	}
+	inc.Score += math.Abs(s.rawScore())
+	inc.MaxScore = math.Max(inc.MaxScore, math.Abs(s.rawScore()))
+	inc.Spans = append(inc.Spans, s)
+}
+
+func (inc incident) FillMessage(m *message.Message) error {
+	group, err := message.NewField("group", inc.Group, "")
+	if err != nil {
+		return errors.New("Could not create 'group' field")
+	}
+	start, err := message.NewField("start", inc.Start.Format(timeFormat), "date-time")
+	if err != nil {
+		return errors.New("Could not create 'start' field")
+	}
+	end, err := message.NewField("end", inc.End.Format(timeFormat), "date-time")
+	if err != nil {
+		return errors.New("Could not create 'end' field")
+	}
+	duration, err := message.NewField("duration", inc.End.Sub(inc.Start).Seconds(), "seconds")
+	if err != nil {
+		return errors.New("Could not create 'duration' field")
+	}
+	score, err := message.NewField("score", inc.Score, "count")
+	if err != nil {
+		return errors.New("Could not create 'score' field")
+	}
+	maxScore, err := message.NewField("max_score", inc.MaxScore, "count")
+	if err != nil {
+		return errors.New("Could not create 'max_score' field")
+	}
+	spanCount, err := message.NewField("span_count", len(inc.Spans), "count")
+	if err != nil {
+		return errors.New("Could not create 'span_count' field")
+	}
+	version, err := message.NewField("schema_version", schemaVersion, "")
+	if err != nil {
+		return errors.New("Could not create 'schema_version' field")
+	}
+
+	// The timeline of constituent spans, as parallel lists.
+	spanSeries := message.NewFieldInit("span_series", message.Field_STRING, "")
+	spanStarts := message.NewFieldInit("span_start", message.Field_STRING, "date-time")
+	spanEnds := message.NewFieldInit("span_end", message.Field_STRING, "date-time")
+	spanScores := message.NewFieldInit("span_score", message.Field_DOUBLE, "count")
+	for _, s := range inc.Spans {
+		if err := spanSeries.AddValue(s.Series); err != nil {
+			return errors.New("Could not create 'span_series' field")
+		}
+		if err := spanStarts.AddValue(s.Start.Format(timeFormat)); err != nil {
+			return errors.New("Could not create 'span_start' field")
+		}
+		if err := spanEnds.AddValue(s.End.Format(timeFormat)); err != nil {
+			return errors.New("Could not create 'span_end' field")
+		}
+		if err := spanScores.AddValue(s.rawScore()); err != nil {
+			return errors.New("Could not create 'span_score' field")
+		}
+	}
+
+	m.SetTimestamp(inc.End.UnixNano())
+	m.AddField(group)
+	m.AddField(start)
+	m.AddField(end)
+	m.AddField(duration)
+	m.AddField(score)
+	m.AddField(maxScore)
+	m.AddField(spanCount)
+	m.AddField(spanSeries)
+	m.AddField(spanStarts)
+	m.AddField(spanEnds)
+	m.AddField(spanScores)
+	m.AddField(version)
+	return nil
+}
@@ -0,0 +1,96 @@
+package hekaanom
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The number of recent inter-arrival times kept per series when learning its
+// emission interval.
+const intervalSamples = 64
+
+// intervalTracker learns each series' native emission interval as the median
+// time between consecutive metrics.
+type intervalTracker struct {
+	sync.Mutex
+	last   map[string]time.Time
+	deltas map[string][]time.Duration
+}
+
+func newIntervalTracker() *intervalTracker {
+	return &intervalTracker{
+		last:   map[string]time.Time{},
+		deltas: map[string][]time.Duration{},
+	}
+}
+
+// Observe records the arrival of a metric for a series.
+func (t *intervalTracker) Observe(series string, timestamp time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	last, ok := t.last[series]
+	t.last[series] = timestamp
+	if !ok || !timestamp.After(last) {
+		return
+	}
+
+	deltas := append(t.deltas[series], timestamp.Sub(last))
+	if len(deltas) > intervalSamples {
+		deltas = deltas[1:]
+	}
+	t.deltas[series] = deltas
+}
+
+// Interval returns the learned emission interval for a series, and false if
+// not enough metrics have been seen to learn it.
+func (t *intervalTracker) Interval(series string) (time.Duration, bool) {
+	t.Lock()
+	deltas := append([]time.Duration(nil), t.deltas[series]...)
+	t.Unlock()
+
+	if len(deltas) == 0 {
+		return 0, false
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+	mid := len(deltas) / 2
+	if len(deltas)%2 == 0 {
+		return (deltas[mid-1] + deltas[mid]) / 2, true
+	}
+	return deltas[mid], true
+}
+
+// Intervals returns the learned emission interval of every series that has
+// one.
+func (t *intervalTracker) Intervals() map[string]time.Duration {
+	t.Lock()
+	series := make([]string, 0, len(t.deltas))
+	for s := range t.deltas {
+		series = append(series, s)
+	}
+	t.Unlock()
+
+	intervals := make(map[string]time.Duration, len(series))
+	for _, s := range series {
+		if interval, ok := t.Interval(s); ok {
+			intervals[s] = interval
+		}
+	}
+	return intervals
+}
+
+// SeriesCount returns the number of series being tracked.
+func (t *intervalTracker) SeriesCount() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.last)
+}
+
+// Forget drops everything learned about a series.
+func (t *intervalTracker) Forget(series string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.last, series)
+	delete(t.deltas, series)
+}
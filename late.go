@@ -0,0 +1,117 @@
+package hekaanom
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// holdWindow sets aside a series' current window, which later metrics have
+// moved past, until the series' watermark passes its end, so that metrics
+// arriving out of order can still be added to it.
+func (f *windowFilter) holdWindow(win *window) {
+	held := *win
+	f.held[win.Series] = append(f.held[win.Series], &held)
+	*win = window{
+		Series:      win.Series,
+		Passthrough: win.Passthrough,
+		Tags:        win.Tags,
+		Unit:        win.Unit,
+		Kind:        win.Kind,
+	}
+}
+
+// lateMetric adds a metric that's older than its series' current window to the
+// held window it falls in. If there's no such window because the series
+// skipped it, one is opened, as long as it wouldn't already be due to be
+// flushed. Otherwise the metric is too late and is dropped. It returns false
+// if the metric isn't late.
+func (f *windowFilter) lateMetric(m metric) bool {
+	win, ok := f.windows[m.Series]
+	if !ok || !m.Timestamp.Before(win.Start) {
+		return false
+	}
+	width := f.Width(m.Series)
+
+	held := f.held[m.Series]
+	i := 0
+	for i < len(held) && !m.Timestamp.Before(held[i].Start.Add(width)) {
+		i++
+	}
+	if i < len(held) && !m.Timestamp.Before(held[i].Start) {
+		f.addLate(held[i], m)
+		return true
+	}
+
+	// Only aligned windows can be opened in a gap without overlapping their
+	// neighbours.
+	start := f.windowStart(m.Timestamp, width)
+	if f.WindowConfig.AlignWindows && start.Add(width).After(f.watermark(m.Series)) {
+		gap := &window{
+			Start:       start,
+			Series:      m.Series,
+			Passthrough: win.Passthrough,
+			Tags:        win.Tags,
+			Unit:        win.Unit,
+			Kind:        win.Kind,
+		}
+		f.addLate(gap, m)
+		held = append(held, nil)
+		copy(held[i+1:], held[i:])
+		held[i] = gap
+		f.held[m.Series] = held
+		return true
+	}
+
+	atomic.AddInt64(&f.droppedLate, 1)
+	return true
+}
+
+// addLate adds a metric to a held window, keeping the window's last value and
+// end those of its latest metric.
+func (f *windowFilter) addLate(win *window, m metric) {
+	last := win.acc.last
+	f.accumulate(&win.acc, m)
+	if m.Timestamp.Before(win.End) {
+		win.acc.last = last
+	} else {
+		win.End = m.Timestamp
+	}
+	win.addPoint(point{m.Timestamp, m.Value}, f.WindowConfig.RawPoints)
+}
+
+// watermark returns the time before which a series' metrics are too late to
+// be windowed: the allowed lateness before the latest metric seen.
+func (f *windowFilter) watermark(series string) time.Time {
+	lateness := time.Duration(f.WindowConfig.AllowedLateness) * time.Second
+	return f.latest[series].Add(-lateness)
+}
+
+// flushHeld flushes, in order, the held windows of a series that end at or
+// before its watermark.
+func (f *windowFilter) flushHeld(series string, out chan window) {
+	held := f.held[series]
+	if len(held) == 0 {
+		return
+	}
+	watermark, width := f.watermark(series), f.Width(series)
+	i := 0
+	for i < len(held) && !held[i].Start.Add(width).After(watermark) {
+		f.flushWindow(held[i], out)
+		i++
+	}
+	if i == len(held) {
+		delete(f.held, series)
+		return
+	}
+	f.held[series] = held[i:]
+}
+
+// DroppedLateMetrics returns the number of metrics dropped so far for
+// arriving later than the allowed lateness.
+func (f *windowFilter) DroppedLateMetrics() int64 {
+	var dropped int64
+	for _, instance := range f.instances() {
+		dropped += atomic.LoadInt64(&instance.droppedLate)
+	}
+	return dropped
+}
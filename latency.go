@@ -0,0 +1,133 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// The time from the end of a window (i.e. its latest possible metric) to
+	// its being flushed by the window stage.
+	stageWindow = "window"
+	// The time from a window being flushed to its ruling being published.
+	stageDetect = "detect"
+	// The time from the last ruling added to a span to the span being
+	// published.
+	stageGather = "gather"
+
+	// Roughly how many recent samples each stage's distribution covers.
+	latencyWindow = 10000
+)
+
+var latencyStages = []string{stageWindow, stageDetect, stageGather}
+
+// latencyTracker keeps a streaming distribution of each stage's processing
+// latency.
+type latencyTracker struct {
+	sync.Mutex
+	digests map[string]*recentDigest
+	max     map[string]time.Duration
+}
+
+type latencyReport struct {
+	Stage string
+	Count float64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func newLatencyTracker() *latencyTracker {
+	t := &latencyTracker{
+		digests: map[string]*recentDigest{},
+		max:     map[string]time.Duration{},
+	}
+	for _, stage := range latencyStages {
+		t.digests[stage] = newRecentDigest(latencyWindow)
+	}
+	return t
+}
+
+// Observe records how long a stage took.
+func (t *latencyTracker) Observe(stage string, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.digests[stage].Add(d.Seconds())
+	if d > t.max[stage] {
+		t.max[stage] = d
+	}
+}
+
+// Reports summarizes each stage that has been observed since the last call.
+// Maxima are reset on each call, so they cover one reporting interval.
+func (t *latencyTracker) Reports() []latencyReport {
+	t.Lock()
+	defer t.Unlock()
+	var reports []latencyReport
+	for _, stage := range latencyStages {
+		d := t.digests[stage].Digest()
+		if d.Count() == 0 {
+			continue
+		}
+		reports = append(reports, latencyReport{
+			Stage: stage,
+			Count: d.Count(),
+			P50:   seconds(d.Quantile(0.5)),
+			P90:   seconds(d.Quantile(0.9)),
+			P99:   seconds(d.Quantile(0.99)),
+			Max:   t.max[stage],
+		})
+		t.max[stage] = 0
+	}
+	return reports
+}
+
+func printLatencies(reports []latencyReport) {
+	for _, r := range reports {
+		fmt.Println(r.Stage, "p50:", r.P50, "p90:", r.P90, "p99:", r.P99, "max:", r.Max)
+	}
+	fmt.Println()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func (r latencyReport) FillMessage(m *message.Message) error {
+	stage, err := message.NewField("stage", r.Stage, "")
+	if err != nil {
+		return errors.New("Could not create 'stage' field")
+	}
+	count, err := message.NewField("count", r.Count, "count")
+	if err != nil {
+		return errors.New("Could not create 'count' field")
+	}
+	p50, err := message.NewField("p50", r.P50.Seconds(), "seconds")
+	if err != nil {
+		return errors.New("Could not create 'p50' field")
+	}
+	p90, err := message.NewField("p90", r.P90.Seconds(), "seconds")
+	if err != nil {
+		return errors.New("Could not create 'p90' field")
+	}
+	p99, err := message.NewField("p99", r.P99.Seconds(), "seconds")
+	if err != nil {
+		return errors.New("Could not create 'p99' field")
+	}
+	max, err := message.NewField("max", r.Max.Seconds(), "seconds")
+	if err != nil {
+		return errors.New("Could not create 'max' field")
+	}
+	m.AddField(stage)
+	m.AddField(count)
+	m.AddField(p50)
+	m.AddField(p90)
+	m.AddField(p99)
+	m.AddField(max)
+	return nil
+}
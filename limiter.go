@@ -0,0 +1,92 @@
+package hekaanom
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// What happens to the metrics of a new series once MaxSeries are tracked.
+const (
+	// The metrics are dropped.
+	overflowDrop = "drop"
+	// The least recently seen series is evicted to make room.
+	overflowEvict = "evict"
+	// The metrics are aggregated into the otherSeries series.
+	overflowOther = "other"
+)
+
+// The series overflowing metrics are aggregated into.
+const otherSeries = "_other"
+
+// seriesLimiter caps the number of distinct series the filter tracks, in
+// least recently seen order.
+type seriesLimiter struct {
+	max    int
+	policy string
+	order  *list.List
+	series map[string]*list.Element
+
+	dropped    int64
+	evicted    int64
+	aggregated int64
+}
+
+func newSeriesLimiter(max int, policy string) *seriesLimiter {
+	return &seriesLimiter{
+		max:    max,
+		policy: policy,
+		order:  list.New(),
+		series: map[string]*list.Element{},
+	}
+}
+
+// Admit returns the series a metric of the given series should be processed
+// as, or false if the metric should be dropped. If another series had to be
+// evicted to make room, it's returned as well.
+func (l *seriesLimiter) Admit(series string) (admitted, evicted string, ok bool) {
+	if elem, known := l.series[series]; known {
+		l.order.MoveToFront(elem)
+		return series, "", true
+	}
+	if l.order.Len() < l.max {
+		l.series[series] = l.order.PushFront(series)
+		return series, "", true
+	}
+
+	switch l.policy {
+	case overflowEvict:
+		oldest := l.order.Back()
+		evicted = oldest.Value.(string)
+		l.order.Remove(oldest)
+		delete(l.series, evicted)
+		l.series[series] = l.order.PushFront(series)
+		atomic.AddInt64(&l.evicted, 1)
+		return series, evicted, true
+	case overflowOther:
+		atomic.AddInt64(&l.aggregated, 1)
+		return otherSeries, "", true
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+		return "", "", false
+	}
+}
+
+// Counts returns the number of metrics dropped, series evicted and metrics
+// aggregated into the other series so far.
+func (l *seriesLimiter) Counts() (dropped, evicted, aggregated int64) {
+	return atomic.LoadInt64(&l.dropped), atomic.LoadInt64(&l.evicted), atomic.LoadInt64(&l.aggregated)
+}
+
+// limitSeries applies the series limit, if there is one, to a series about to
+// be processed, returning the series to process it as, or false if it should
+// be dropped.
+func (f *AnomalyFilter) limitSeries(series string) (string, bool) {
+	if f.limiter == nil {
+		return series, true
+	}
+	admitted, evicted, ok := f.limiter.Admit(series)
+	if evicted != "" {
+		f.windower.Forget(evicted)
+	}
+	return admitted, ok
+}
@@ -0,0 +1,132 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// madDetector rules on each window by how far its value is from the median of
+// its series' previous windows, in units of their scaled median absolute
+// deviation (MAD). Unlike the mean and standard deviation, the median and MAD
+// barely move when the baseline contains a few outliers, so one big spike
+// doesn't hide the anomalies that follow it.
+type madDetector struct {
+	lookback  int
+	threshold float64
+	series    map[string]*madBaseline
+}
+
+// madBaseline holds the last lookback window values of a series, in a ring.
+type madBaseline struct {
+	values []float64
+	next   int
+}
+
+func (d *madDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	d.lookback = 100
+	if lookback, ok := conf["lookback"]; ok {
+		l, ok := lookback.(int64)
+		if !ok || l <= 0 {
+			return errors.New("'lookback' must be an integer greater than zero")
+		}
+		d.lookback = int(l)
+	}
+
+	var err error
+	if d.threshold, err = configFloat(conf, "threshold", 3.5); err != nil {
+		return err
+	}
+	if d.threshold <= 0 {
+		return errors.New("'threshold' must be greater than zero")
+	}
+
+	d.series = map[string]*madBaseline{}
+	return nil
+}
+
+func (d *madDetector) Train(win window) {
+	d.baseline(win.Series).add(win.Value, d.lookback)
+}
+
+func (d *madDetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	baseline, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	d.series[new] = baseline
+}
+
+func (d *madDetector) Forget(series string) {
+	delete(d.series, series)
+}
+
+// Detect rules on a window once its series has a full lookback of previous
+// windows, then adds the window to them unless it's excluded.
+func (d *madDetector) Detect(win window, out chan ruling) {
+	baseline := d.baseline(win.Series)
+	if len(baseline.values) == d.lookback {
+		normed := d.score(baseline.values, win.Value)
+		out <- ruling{
+			Window:        win,
+			Anomalous:     math.Abs(normed) > d.threshold,
+			Anomalousness: math.Abs(normed),
+			Normed:        normed,
+			Confidence:    1.0,
+			Passthrough:   win.Passthrough,
+		}
+	}
+	if !win.Excluded {
+		baseline.add(win.Value, d.lookback)
+	}
+}
+
+// score returns the robust z-score of a value against a baseline: its
+// distance from their median over their MAD, scaled so that it estimates the
+// standard deviation of normally distributed values. If more than half the
+// baseline is the same value, so that the MAD is zero, their mean absolute
+// deviation from the median is used instead. If the baseline doesn't vary at
+// all, the value is given a flatScore.
+func (d *madDetector) score(values []float64, value float64) float64 {
+	center := median(values)
+	deviations := make([]float64, len(values))
+	meanDeviation := 0.0
+	for i, v := range values {
+		deviations[i] = math.Abs(v - center)
+		meanDeviation += deviations[i]
+	}
+	meanDeviation /= float64(len(values))
+
+	if mad := median(deviations); mad > 0 {
+		return (value - center) / (1.4826 * mad)
+	}
+	if meanDeviation > 0 {
+		return (value - center) / (1.2533 * meanDeviation)
+	}
+	return flatScore(value-center, d.threshold)
+}
+
+func (d *madDetector) baseline(series string) *madBaseline {
+	baseline, ok := d.series[series]
+	if !ok {
+		baseline = &madBaseline{}
+		d.series[series] = baseline
+	}
+	return baseline
+}
+
+func (b *madBaseline) add(value float64, lookback int) {
+	if len(b.values) < lookback {
+		b.values = append(b.values, value)
+		return
+	}
+	b.values[b.next] = value
+	b.next = (b.next + 1) % lookback
+}
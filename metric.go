@@ -11,4 +11,21 @@ type metric struct {
 	Series      string
 	Value       float64
 	Passthrough []*message.Field
+
+	// The metric's dimensions (e.g. host and endpoint), by name.
+	Tags map[string]string
+
+	// Optional descriptions of the value, e.g. "requests/s" and "throughput".
+	Unit string
+	Kind string
+
+	// Whether the value is a "gauge", "counter" or "delta".
+	Type string
+
+	// The value of the distinct field, for counting distinct values.
+	Distinct string
+
+	// Ticks carry no value. They only move a window worker's clock on to
+	// their timestamp.
+	tick bool
 }
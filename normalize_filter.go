@@ -0,0 +1,221 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// The ways windows can be normalized.
+const (
+	normalizeZScore = "zscore"
+	normalizeRobust = "robust"
+	normalizeMinMax = "minmax"
+)
+
+type normalizer interface {
+	pipeline.HasConfigStruct
+	pipeline.Plugin
+	Connect(in chan window) chan window
+	Normalize(win *window)
+	EffectiveConfig() map[string]interface{}
+	UseExclusions(excluded func(window) bool)
+}
+
+type NormalizeConfig struct {
+	// Is normalizing windows disabled? It is by default.
+	Disabled bool `toml:"disabled"`
+
+	// How each window's value is normalized against the values of its
+	// series' previous windows: "zscore" (the default) subtracts their mean
+	// and divides by their standard deviation, "robust" subtracts their
+	// median and divides by their scaled median absolute deviation, and
+	// "minmax" rescales the value so that their minimum is 0 and their
+	// maximum 1. Windows are normalized after any transforms. A window's
+	// value before either is kept as its "raw_value" field.
+	Method string `toml:"method"`
+
+	// How many previous windows of a series the normalization looks back
+	// over. Zero looks back over every window seen, for "zscore" and
+	// "minmax". Windows in the detect stage's exclusions are normalized, but
+	// kept out of the lookback.
+	Lookback int `toml:"lookback"`
+}
+
+// normStats holds the recent window values of a series, or for an unbounded
+// lookback, running summaries of them.
+type normStats struct {
+	values []float64
+	next   int
+	acc    accumulator
+}
+
+type normalizeFilter struct {
+	*NormalizeConfig
+	stats map[string]*normStats
+	// Reports whether a window falls in one of the detect stage's
+	// exclusions, if set.
+	excluded func(window) bool
+}
+
+func (f *normalizeFilter) ConfigStruct() interface{} {
+	return &NormalizeConfig{
+		Disabled: true,
+		Method:   normalizeZScore,
+		Lookback: 100,
+	}
+}
+
+func (f *normalizeFilter) Init(config interface{}) error {
+	f.NormalizeConfig = config.(*NormalizeConfig)
+	if f.NormalizeConfig.Disabled {
+		return nil
+	}
+
+	switch f.NormalizeConfig.Method {
+	case "":
+		f.NormalizeConfig.Method = normalizeZScore
+	case normalizeZScore, normalizeRobust, normalizeMinMax:
+	default:
+		return errors.New("'method' must be \"zscore\", \"robust\" or \"minmax\".")
+	}
+	if f.NormalizeConfig.Lookback < 0 {
+		return errors.New("'lookback' must not be negative.")
+	}
+	if f.NormalizeConfig.Lookback == 0 && f.NormalizeConfig.Method == normalizeRobust {
+		return errors.New("'lookback' must be greater than zero for \"robust\" normalization.")
+	}
+	f.stats = map[string]*normStats{}
+	return nil
+}
+
+// UseExclusions sets how windows that fall in an exclusion are told apart, so
+// that their values are kept out of their series' lookback.
+func (f *normalizeFilter) UseExclusions(excluded func(window) bool) {
+	f.excluded = excluded
+}
+
+func (f *normalizeFilter) EffectiveConfig() map[string]interface{} {
+	if f.NormalizeConfig.Disabled {
+		return map[string]interface{}{"disabled": true}
+	}
+	return map[string]interface{}{
+		"disabled": false,
+		"method":   f.NormalizeConfig.Method,
+		"lookback": f.NormalizeConfig.Lookback,
+	}
+}
+
+func (f *normalizeFilter) Connect(in chan window) chan window {
+	if f.NormalizeConfig.Disabled {
+		return in
+	}
+	out := make(chan window)
+	go func() {
+		defer close(out)
+		for win := range in {
+			if win.evicted {
+				delete(f.stats, win.Series)
+			} else {
+				f.Normalize(&win)
+			}
+			out <- win
+		}
+	}()
+	return out
+}
+
+// Normalize replaces a window's value with its normalized value, then adds
+// the value it had to its series' lookback, unless the window is excluded.
+// Until a series has enough previous windows to normalize against, or when
+// they don't vary, its windows are normalized to zero. Historical windows must
+// be normalized before Connect.
+func (f *normalizeFilter) Normalize(win *window) {
+	if f.NormalizeConfig.Disabled {
+		return
+	}
+	s, ok := f.stats[win.Series]
+	if !ok {
+		s = &normStats{}
+		f.stats[win.Series] = s
+	}
+
+	value := win.Value
+	if !win.Transformed {
+		win.RawValue, win.Transformed = win.Value, true
+	}
+	win.Value = f.normalizeValue(s, value)
+	if win.Excluded || (f.excluded != nil && f.excluded(*win)) {
+		return
+	}
+	s.add(value, f.NormalizeConfig.Lookback)
+}
+
+func (f *normalizeFilter) normalizeValue(s *normStats, v float64) float64 {
+	var center, scale float64
+	switch f.NormalizeConfig.Method {
+	case normalizeZScore:
+		acc := s.summary(f.NormalizeConfig.Lookback)
+		center, scale = acc.Value("Mean", 0), acc.Value("StdDev", 0)
+	case normalizeMinMax:
+		acc := s.summary(f.NormalizeConfig.Lookback)
+		center, scale = acc.Value("Min", 0), acc.Value("Max", 0)-acc.Value("Min", 0)
+	case normalizeRobust:
+		center = median(s.values)
+		deviations := make([]float64, len(s.values))
+		for i, value := range s.values {
+			deviations[i] = math.Abs(value - center)
+		}
+		// Scaled so that it estimates the standard deviation of normally
+		// distributed values.
+		scale = 1.4826 * median(deviations)
+	}
+	if scale == 0 || math.IsNaN(scale) {
+		return 0
+	}
+	return (v - center) / scale
+}
+
+// add records a raw window value, keeping only the last lookback of them, or
+// if lookback is zero, summaries of all of them.
+func (s *normStats) add(v float64, lookback int) {
+	if lookback == 0 {
+		s.acc.Add(v)
+		return
+	}
+	if len(s.values) < lookback {
+		s.values = append(s.values, v)
+		return
+	}
+	s.values[s.next] = v
+	s.next = (s.next + 1) % lookback
+}
+
+// summary returns running summaries of the recorded values.
+func (s *normStats) summary(lookback int) *accumulator {
+	if lookback == 0 {
+		return &s.acc
+	}
+	acc := &accumulator{}
+	for _, value := range s.values {
+		acc.Add(value)
+	}
+	return acc
+}
+
+// median returns the median of values, or zero if there are none.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
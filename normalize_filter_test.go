@@ -0,0 +1,36 @@
+package hekaanom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeSkipsExcludedWindows(t *testing.T) {
+	f := &normalizeFilter{}
+	conf := f.ConfigStruct().(*NormalizeConfig)
+	conf.Disabled = false
+	conf.Lookback = 10
+	if err := f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	incident := time.Unix(0, 0).Add(3 * time.Minute)
+	f.UseExclusions(func(win window) bool { return win.Start.Equal(incident) })
+
+	start := time.Unix(0, 0)
+	for i, value := range []float64{1, 2, 3, 1000, 4} {
+		winStart := start.Add(time.Duration(i) * time.Minute)
+		f.Normalize(&window{Series: "web", Start: winStart, End: winStart.Add(time.Minute), Value: value})
+	}
+	f.Normalize(&window{Series: "web", Excluded: true, Value: 2000})
+
+	got := f.stats["web"].values
+	want := []float64{1, 2, 3, 4}
+	if len(got) != len(want) {
+		t.Fatalf("the lookback holds %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("the lookback holds %v, want %v", got, want)
+		}
+	}
+}
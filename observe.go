@@ -0,0 +1,19 @@
+package hekaanom
+
+// UseCatalog sets the catalog used to mark series observe-only.
+func (f *detectFilter) UseCatalog(c *catalog) {
+	f.catalog = c
+}
+
+// isObserveOnly reports whether a series' windows should only be added to its
+// baseline, without being ruled on: because it matches one of the
+// observe-only patterns, or its catalog entry says so.
+func (f *detectFilter) isObserveOnly(series string) bool {
+	for _, re := range f.observeOnly {
+		if re.MatchString(series) {
+			return true
+		}
+	}
+	entry, _ := f.catalog.Lookup(series)
+	return entry.ObserveOnly
+}
@@ -0,0 +1,115 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// The ways a passthrough field can be merged across the rulings in a span.
+const (
+	// Keep the value of the span's first window.
+	mergeFirst = "first"
+	// Keep the value of the span's latest window.
+	mergeLast = "last"
+	// Keep every distinct value, in the order they were first seen.
+	mergeUnion = "union"
+	// Keep every value, one per window that had the field.
+	mergeList = "list"
+)
+
+func validateMergePolicies(policies map[string]string) error {
+	for name, policy := range policies {
+		switch policy {
+		case mergeFirst, mergeLast, mergeUnion, mergeList:
+		default:
+			return fmt.Errorf("Unknown passthrough merge policy %q for %q.", policy, name)
+		}
+	}
+	return nil
+}
+
+// fieldValues returns every value of a field.
+func fieldValues(field *message.Field) []interface{} {
+	var values []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			values = append(values, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, v)
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// mergePassthrough merges the passthrough fields of another window into a
+// span's, according to the configured policy for each field. Fields without a
+// policy keep their first value. The span's fields are never modified in
+// place, since they may be shared with its windows.
+func mergePassthrough(current, incoming []*message.Field, policies map[string]string) ([]*message.Field, error) {
+	if len(policies) == 0 {
+		return current, nil
+	}
+	merged := make([]*message.Field, len(current))
+	copy(merged, current)
+
+	for _, field := range incoming {
+		policy := policies[field.GetName()]
+		if policy == "" || policy == mergeFirst {
+			continue
+		}
+
+		i := -1
+		for j, existing := range merged {
+			if existing.GetName() == field.GetName() {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			merged = append(merged, field)
+			continue
+		}
+		if policy == mergeLast {
+			merged[i] = field
+			continue
+		}
+
+		existing := merged[i]
+		if existing.GetValueType() != field.GetValueType() {
+			continue
+		}
+		combined := message.NewFieldInit(existing.GetName(), existing.GetValueType(), existing.GetRepresentation())
+		seen := map[string]bool{}
+		for _, v := range append(fieldValues(existing), fieldValues(field)...) {
+			if policy == mergeUnion {
+				key := fmt.Sprint(v)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			if err := combined.AddValue(v); err != nil {
+				return current, errors.New("Could not merge passthrough field '" + existing.GetName() + "'")
+			}
+		}
+		merged[i] = combined
+	}
+	return merged, nil
+}
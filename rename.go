@@ -0,0 +1,69 @@
+package hekaanom
+
+import (
+	"errors"
+	"regexp"
+)
+
+// RenameConfig maps series that have been renamed upstream to their new
+// names, e.g. after a host is replaced or a metric path changes.
+type RenameConfig struct {
+	// A regular expression matching the old series codes.
+	Pattern string `toml:"pattern"`
+
+	// The new series code. It may refer to the pattern's capture groups as $1,
+	// ${name} and so on.
+	Series string `toml:"series"`
+
+	// Whether the detector baseline built up under the old name is handed
+	// over to the new name, so that the renamed series doesn't have to warm up
+	// again. It can't be handed over between a priority series and a bulk
+	// one, as they're kept by different detectors; that's logged as an error
+	// and the renamed series warms up again.
+	TransferState bool `toml:"transfer_state"`
+}
+
+type seriesRename struct {
+	re            *regexp.Regexp
+	series        string
+	transferState bool
+}
+
+func newSeriesRenames(confs []RenameConfig) ([]seriesRename, error) {
+	renames := make([]seriesRename, len(confs))
+	for i, conf := range confs {
+		if conf.Pattern == "" {
+			return nil, errors.New("Every rename needs a 'pattern'.")
+		}
+		if conf.Series == "" {
+			return nil, errors.New("Every rename needs a 'series'.")
+		}
+		re, err := regexp.Compile(conf.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		renames[i] = seriesRename{re, conf.Series, conf.TransferState}
+	}
+	return renames, nil
+}
+
+// renameSeries returns the new name of a series under the first rename that
+// matches it, or the series unchanged if none do. The first time a series is
+// renamed with state transfer, the detector is told to hand the series'
+// baseline over. If it can't, the renamed series warms up again.
+func (f *AnomalyFilter) renameSeries(series string) string {
+	for _, rename := range f.renames {
+		if !rename.re.MatchString(series) {
+			continue
+		}
+		renamed := rename.re.ReplaceAllString(series, rename.series)
+		if rename.transferState && renamed != series && !f.transferred[series] {
+			f.transferred[series] = true
+			if err := f.detector.Rename(series, renamed); err != nil {
+				f.runner.LogError(err)
+			}
+		}
+		return renamed
+	}
+	return series
+}
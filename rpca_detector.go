@@ -13,6 +13,10 @@ type rPCADetector struct {
 	minorFreq int
 	autoDiff  bool
 	series    map[string][]*window
+
+	// The number of windows at the start of each series that came from
+	// training and so shouldn't be ruled on.
+	trained map[string]int
 }
 
 func (d *rPCADetector) Init(config interface{}) error {
@@ -22,7 +26,11 @@ func (d *rPCADetector) Init(config interface{}) error {
 	if !ok {
 		return errors.New("Must provide 'major_frequency'")
 	}
-	d.majorFreq = int(majorFreq.(int64))
+	major, ok := majorFreq.(int64)
+	if !ok {
+		return errors.New("'major_frequency' must be an integer")
+	}
+	d.majorFreq = int(major)
 	if d.majorFreq <= 0 {
 		return errors.New("'major_frequency' must be >= 0")
 	}
@@ -31,7 +39,11 @@ func (d *rPCADetector) Init(config interface{}) error {
 	if !ok {
 		return errors.New("Must provide 'minor_frequency'")
 	}
-	d.minorFreq = int(minorFreq.(int64))
+	minor, ok := minorFreq.(int64)
+	if !ok {
+		return errors.New("'minor_frequency' must be an integer")
+	}
+	d.minorFreq = int(minor)
 	if d.minorFreq <= 0 {
 		return errors.New("'minor_frequency' must be >= 0")
 	}
@@ -44,12 +56,53 @@ func (d *rPCADetector) Init(config interface{}) error {
 	if !ok {
 		autoDiff = true
 	}
-	d.autoDiff = autoDiff.(bool)
+	if d.autoDiff, ok = autoDiff.(bool); !ok {
+		return errors.New("'autodiff' must be a boolean")
+	}
 	d.series = map[string][]*window{}
+	d.trained = map[string]int{}
 	return nil
 }
 
+func (d *rPCADetector) Train(win window) {
+	series := append(d.series[win.Series], &win)
+	if len(series) > d.minorFreq {
+		series = series[len(series)-d.minorFreq:]
+	}
+	d.series[win.Series] = series
+	if d.trained[win.Series] < d.minorFreq {
+		d.trained[win.Series]++
+	}
+}
+
+func (d *rPCADetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	series, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	delete(d.trained, old)
+	for _, win := range series {
+		win.Series = new
+	}
+	d.series[new] = series
+	// The handed over windows have already been ruled on under the old name.
+	d.trained[new] = len(series)
+}
+
+func (d *rPCADetector) Forget(series string) {
+	delete(d.series, series)
+	delete(d.trained, series)
+}
+
 func (d *rPCADetector) Detect(win window, out chan ruling) {
+	if win.Excluded {
+		d.detectExcluded(win, out)
+		return
+	}
 
 	d.series[win.Series] = append(d.series[win.Series], &win)
 	series := d.series[win.Series]
@@ -77,12 +130,15 @@ func (d *rPCADetector) Detect(win window, out chan ruling) {
 	anoms := rpca.FindAnomalies(values, rpca.Frequency(d.majorFreq), rpca.AutoDiff(d.autoDiff))
 
 	if sendAll {
-		for i := range anoms.Positions {
+		trained := d.trained[win.Series]
+		delete(d.trained, win.Series)
+		for i := trained; i < len(anoms.Positions); i++ {
 			out <- ruling{
 				Window:        *series[i],
 				Anomalous:     anoms.Positions[i],
 				Anomalousness: anoms.Values[i],
 				Normed:        anoms.NormedValues[i],
+				Confidence:    1.0,
 				Passthrough:   series[i].Passthrough,
 			}
 		}
@@ -91,6 +147,39 @@ func (d *rPCADetector) Detect(win window, out chan ruling) {
 		i := len(anoms.Values) - 1
 		anomalous, anomalousness := anoms.Positions[i], anoms.Values[i]
 		normed := anoms.NormedValues[i]
-		out <- ruling{win, anomalous, anomalousness, normed, win.Passthrough}
+		out <- ruling{
+			Window:        win,
+			Anomalous:     anomalous,
+			Anomalousness: anomalousness,
+			Normed:        normed,
+			Confidence:    1.0,
+			Passthrough:   win.Passthrough,
+		}
+	}
+}
+
+// detectExcluded rules on a window against the series' current baseline
+// without adding the window to it.
+func (d *rPCADetector) detectExcluded(win window, out chan ruling) {
+	series := d.series[win.Series]
+	if len(series) < d.minorFreq {
+		return
+	}
+
+	values := make([]float64, 0, d.minorFreq)
+	for _, thisWin := range series[len(series)-d.minorFreq+1:] {
+		values = append(values, thisWin.Value)
+	}
+	values = append(values, win.Value)
+
+	anoms := rpca.FindAnomalies(values, rpca.Frequency(d.majorFreq), rpca.AutoDiff(d.autoDiff))
+	i := len(anoms.Values) - 1
+	out <- ruling{
+		Window:        win,
+		Anomalous:     anoms.Positions[i],
+		Anomalousness: anoms.Values[i],
+		Normed:        anoms.NormedValues[i],
+		Confidence:    1.0,
+		Passthrough:   win.Passthrough,
 	}
 }
@@ -7,7 +7,15 @@ type ruling struct {
 	Anomalous     bool
 	Anomalousness float64
 	Normed        float64
+	Confidence    float64
 	Passthrough   []*message.Field
+
+	// Where the window's value sits among its series' recent window values,
+	// if value histograms are enabled, and for anomalous rulings, the
+	// histogram of those values.
+	Ranked          bool
+	ValuePercentile float64
+	Histogram       []histogramBucket
 }
 
 func (r ruling) FillMessage(m *message.Message) error {
@@ -25,10 +33,33 @@ func (r ruling) FillMessage(m *message.Message) error {
 	if err != nil {
 		return err
 	}
+	confidence, err := message.NewField("confidence", r.Confidence, "")
+	if err != nil {
+		return err
+	}
+	version, err := message.NewField("schema_version", schemaVersion, "")
+	if err != nil {
+		return err
+	}
 
 	m.AddField(anomalousness)
 	m.AddField(normed)
+	m.AddField(confidence)
 	m.AddField(anomalous)
+	m.AddField(version)
+
+	if r.Ranked {
+		percentile, err := message.NewField("value_percentile", r.ValuePercentile, "")
+		if err != nil {
+			return err
+		}
+		m.AddField(percentile)
+	}
+	if len(r.Histogram) > 0 {
+		if err := addHistogramFields(m, r.Histogram); err != nil {
+			return err
+		}
+	}
 
 	for _, field := range r.Passthrough {
 		m.AddField(field)
@@ -0,0 +1,46 @@
+package hekaanom
+
+import "math"
+
+// The transforms that can be applied to span scores before emission.
+const (
+	scoreTransformNone  = "none"
+	scoreTransformLog10 = "log10"
+	scoreTransformSqrt  = "sqrt"
+)
+
+// transformScore replaces a span's score with its transformed and rounded
+// score for emission, keeping the score it had as RawScore. The sign of the
+// score is kept: "log10" takes the log of one plus the score's absolute value,
+// and "sqrt" the square root of its absolute value.
+func (f *gatherFilter) transformScore(s *span) {
+	transform, decimals := f.GatherConfig.ScoreTransform, f.GatherConfig.ScoreDecimals
+	if transform == scoreTransformNone && decimals < 0 {
+		return
+	}
+	if !s.ScoreTransformed {
+		s.RawScore, s.ScoreTransformed = s.Score, true
+	}
+
+	score := s.RawScore
+	switch transform {
+	case scoreTransformLog10:
+		score = math.Copysign(math.Log10(1+math.Abs(score)), score)
+	case scoreTransformSqrt:
+		score = math.Copysign(math.Sqrt(math.Abs(score)), score)
+	}
+	if decimals >= 0 {
+		scale := math.Pow(10, float64(decimals))
+		score = math.Round(score*scale) / scale
+	}
+	s.Score = score
+}
+
+// rawScore returns the score a span had before it was transformed for
+// emission.
+func (s span) rawScore() float64 {
+	if s.ScoreTransformed {
+		return s.RawScore
+	}
+	return s.Score
+}
@@ -0,0 +1,595 @@
+package hekaanom
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// The pipeline types are serialized to JSON with explicit, stable field names.
+// Times are normalized to UTC RFC3339 with nanoseconds, durations are given in
+// seconds, and Passthrough fields are written out with their type and
+// representation so they can be rebuilt exactly. Numbers that aren't finite,
+// which JSON can't express, are written as the strings "NaN", "+Inf" and
+// "-Inf". Gob encoding uses the same representation, so both formats agree.
+
+func init() {
+	gob.Register(metric{})
+	gob.Register(window{})
+	gob.Register(ruling{})
+	gob.Register(span{})
+}
+
+type jsonField struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	Representation string            `json:"representation,omitempty"`
+	Values         []json.RawMessage `json:"values"`
+}
+
+type jsonMetric struct {
+	Timestamp   string      `json:"timestamp"`
+	Series      string      `json:"series"`
+	Value       jsonFloat   `json:"value"`
+	Passthrough []jsonField `json:"passthrough,omitempty"`
+	Unit        string      `json:"unit,omitempty"`
+	Kind        string      `json:"kind,omitempty"`
+	Type        string      `json:"type,omitempty"`
+	Distinct    string      `json:"distinct,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type jsonWindow struct {
+	Start       string      `json:"start"`
+	End         string      `json:"end"`
+	Series      string      `json:"series"`
+	Value       jsonFloat   `json:"value"`
+	Passthrough []jsonField `json:"passthrough,omitempty"`
+	Unit        string      `json:"unit,omitempty"`
+	Kind        string      `json:"kind,omitempty"`
+	Excluded    bool        `json:"excluded,omitempty"`
+	Filled      bool        `json:"filled,omitempty"`
+	RawValue    *jsonFloat  `json:"raw_value,omitempty"`
+	Points      []jsonPoint `json:"points,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type jsonRuling struct {
+	Window        window      `json:"window"`
+	Anomalous     bool        `json:"anomalous"`
+	Anomalousness jsonFloat   `json:"anomalousness"`
+	Normed        jsonFloat   `json:"normed"`
+	Confidence    jsonFloat   `json:"confidence"`
+	Passthrough   []jsonField `json:"passthrough,omitempty"`
+
+	Ranked          bool              `json:"ranked,omitempty"`
+	ValuePercentile jsonFloat         `json:"value_percentile,omitempty"`
+	Histogram       []histogramBucket `json:"histogram,omitempty"`
+}
+
+type jsonSpan struct {
+	ID           string      `json:"id,omitempty"`
+	ParentID     string      `json:"parent_id,omitempty"`
+	Start        string      `json:"start"`
+	End          string      `json:"end"`
+	Duration     float64     `json:"duration"`
+	Series       string      `json:"series"`
+	Aggregation  jsonFloat   `json:"aggregation"`
+	Values       []jsonFloat `json:"values"`
+	ValueCount   int         `json:"value_count,omitempty"`
+	Weights      []jsonFloat `json:"weights,omitempty"`
+	WindowValues []jsonFloat `json:"window_values,omitempty"`
+	Chart        []byte      `json:"chart,omitempty"`
+	Score        jsonFloat   `json:"score"`
+	RawScore     *jsonFloat  `json:"raw_score,omitempty"`
+	Passthrough  []jsonField `json:"passthrough,omitempty"`
+	Unit         string      `json:"unit,omitempty"`
+	Kind         string      `json:"kind,omitempty"`
+	State        string      `json:"state,omitempty"`
+	StateChanged bool        `json:"state_changed,omitempty"`
+	CloseReason  string      `json:"close_reason,omitempty"`
+	Amended      bool        `json:"amended,omitempty"`
+	Class        string      `json:"class,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+
+	ScoreQuantile      *jsonFloat `json:"score_quantile,omitempty"`
+	GroupScoreQuantile *jsonFloat `json:"group_score_quantile,omitempty"`
+}
+
+type jsonPoint struct {
+	Timestamp string    `json:"timestamp"`
+	Value     jsonFloat `json:"value"`
+}
+
+func (m metric) MarshalJSON() ([]byte, error) {
+	passthrough, err := encodeFields(m.Passthrough)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonMetric{
+		Timestamp:   encodeTime(m.Timestamp),
+		Series:      m.Series,
+		Value:       jsonFloat(m.Value),
+		Passthrough: passthrough,
+		Unit:        m.Unit,
+		Kind:        m.Kind,
+		Type:        m.Type,
+		Distinct:    m.Distinct,
+		Tags:        m.Tags,
+	})
+}
+
+func (m *metric) UnmarshalJSON(data []byte) error {
+	var j jsonMetric
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	timestamp, err := decodeTime(j.Timestamp)
+	if err != nil {
+		return err
+	}
+	passthrough, err := decodeFields(j.Passthrough)
+	if err != nil {
+		return err
+	}
+	*m = metric{
+		Timestamp:   timestamp,
+		Series:      j.Series,
+		Value:       float64(j.Value),
+		Passthrough: passthrough,
+		Unit:        j.Unit,
+		Kind:        j.Kind,
+		Type:        j.Type,
+		Distinct:    j.Distinct,
+		Tags:        j.Tags,
+	}
+	return nil
+}
+
+func (w window) MarshalJSON() ([]byte, error) {
+	passthrough, err := encodeFields(w.Passthrough)
+	if err != nil {
+		return nil, err
+	}
+	var rawValue *jsonFloat
+	if w.Transformed {
+		rawValue = newJSONFloat(w.RawValue)
+	}
+	return json.Marshal(jsonWindow{
+		Start:       encodeTime(w.Start),
+		End:         encodeTime(w.End),
+		Series:      w.Series,
+		Value:       jsonFloat(w.Value),
+		Passthrough: passthrough,
+		Unit:        w.Unit,
+		Kind:        w.Kind,
+		Excluded:    w.Excluded,
+		Filled:      w.Filled,
+		RawValue:    rawValue,
+		Points:      encodePoints(w.Points),
+		Tags:        w.Tags,
+	})
+}
+
+func (w *window) UnmarshalJSON(data []byte) error {
+	var j jsonWindow
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	start, err := decodeTime(j.Start)
+	if err != nil {
+		return err
+	}
+	end, err := decodeTime(j.End)
+	if err != nil {
+		return err
+	}
+	passthrough, err := decodeFields(j.Passthrough)
+	if err != nil {
+		return err
+	}
+	points, err := decodePoints(j.Points)
+	if err != nil {
+		return err
+	}
+	*w = window{
+		Start:       start,
+		End:         end,
+		Series:      j.Series,
+		Value:       float64(j.Value),
+		Passthrough: passthrough,
+		Unit:        j.Unit,
+		Kind:        j.Kind,
+		Excluded:    j.Excluded,
+		Filled:      j.Filled,
+		Points:      points,
+		Tags:        j.Tags,
+	}
+	if j.RawValue != nil {
+		w.Transformed, w.RawValue = true, float64(*j.RawValue)
+	}
+	return nil
+}
+
+func (r ruling) MarshalJSON() ([]byte, error) {
+	passthrough, err := encodeFields(r.Passthrough)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonRuling{
+		Window:        r.Window,
+		Anomalous:     r.Anomalous,
+		Anomalousness: jsonFloat(r.Anomalousness),
+		Normed:        jsonFloat(r.Normed),
+		Confidence:    jsonFloat(r.Confidence),
+		Passthrough:   passthrough,
+
+		Ranked:          r.Ranked,
+		ValuePercentile: jsonFloat(r.ValuePercentile),
+		Histogram:       r.Histogram,
+	})
+}
+
+func (r *ruling) UnmarshalJSON(data []byte) error {
+	var j jsonRuling
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	passthrough, err := decodeFields(j.Passthrough)
+	if err != nil {
+		return err
+	}
+	*r = ruling{
+		Window:        j.Window,
+		Anomalous:     j.Anomalous,
+		Anomalousness: float64(j.Anomalousness),
+		Normed:        float64(j.Normed),
+		Confidence:    float64(j.Confidence),
+		Passthrough:   passthrough,
+
+		Ranked:          j.Ranked,
+		ValuePercentile: float64(j.ValuePercentile),
+		Histogram:       j.Histogram,
+	}
+	return nil
+}
+
+func (s span) MarshalJSON() ([]byte, error) {
+	passthrough, err := encodeFields(s.Passthrough)
+	if err != nil {
+		return nil, err
+	}
+	j := jsonSpan{
+		ID:           s.ID,
+		ParentID:     s.ParentID,
+		Start:        encodeTime(s.Start),
+		End:          encodeTime(s.End),
+		Duration:     s.Duration.Seconds(),
+		Series:       s.Series,
+		Aggregation:  jsonFloat(s.Aggregation),
+		Values:       encodeFloats(s.Values),
+		ValueCount:   s.ValueCount,
+		Weights:      encodeFloats(s.Weights),
+		WindowValues: encodeFloats(s.WindowValues),
+		Chart:        s.Chart,
+		Score:        jsonFloat(s.Score),
+		Passthrough:  passthrough,
+		Unit:         s.Unit,
+		Kind:         s.Kind,
+		State:        s.State,
+		StateChanged: s.StateChanged,
+		CloseReason:  s.CloseReason,
+		Amended:      s.Amended,
+		Class:        s.Class,
+		Tags:         s.Tags,
+	}
+	if s.ScoreTransformed {
+		j.RawScore = newJSONFloat(s.RawScore)
+	}
+	if s.Ranked {
+		j.ScoreQuantile = newJSONFloat(s.ScoreQuantile)
+		j.GroupScoreQuantile = newJSONFloat(s.GroupScoreQuantile)
+	}
+	return json.Marshal(j)
+}
+
+func (s *span) UnmarshalJSON(data []byte) error {
+	var j jsonSpan
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	start, err := decodeTime(j.Start)
+	if err != nil {
+		return err
+	}
+	end, err := decodeTime(j.End)
+	if err != nil {
+		return err
+	}
+	passthrough, err := decodeFields(j.Passthrough)
+	if err != nil {
+		return err
+	}
+	*s = span{
+		ID:           j.ID,
+		ParentID:     j.ParentID,
+		Start:        start,
+		End:          end,
+		Duration:     time.Duration(j.Duration * float64(time.Second)),
+		Series:       j.Series,
+		Aggregation:  float64(j.Aggregation),
+		Values:       decodeFloats(j.Values),
+		ValueCount:   j.ValueCount,
+		Weights:      decodeFloats(j.Weights),
+		WindowValues: decodeFloats(j.WindowValues),
+		Chart:        j.Chart,
+		Score:        float64(j.Score),
+		Passthrough:  passthrough,
+		Unit:         j.Unit,
+		Kind:         j.Kind,
+		State:        j.State,
+		StateChanged: j.StateChanged,
+		CloseReason:  j.CloseReason,
+		Amended:      j.Amended,
+		Class:        j.Class,
+		Tags:         j.Tags,
+	}
+	if j.RawScore != nil {
+		s.RawScore, s.ScoreTransformed = float64(*j.RawScore), true
+	}
+	if j.ScoreQuantile != nil && j.GroupScoreQuantile != nil {
+		s.ScoreQuantile = float64(*j.ScoreQuantile)
+		s.GroupScoreQuantile = float64(*j.GroupScoreQuantile)
+		s.Ranked = true
+	}
+	return nil
+}
+
+func (m metric) GobEncode() ([]byte, error)   { return m.MarshalJSON() }
+func (m *metric) GobDecode(data []byte) error { return m.UnmarshalJSON(data) }
+func (w window) GobEncode() ([]byte, error)   { return w.MarshalJSON() }
+func (w *window) GobDecode(data []byte) error { return w.UnmarshalJSON(data) }
+func (r ruling) GobEncode() ([]byte, error)   { return r.MarshalJSON() }
+func (r *ruling) GobDecode(data []byte) error { return r.UnmarshalJSON(data) }
+func (s span) GobEncode() ([]byte, error)     { return s.MarshalJSON() }
+func (s *span) GobDecode(data []byte) error   { return s.UnmarshalJSON(data) }
+
+func encodeTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeFormat)
+}
+
+func decodeTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(timeFormat, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// jsonFloat is a float64 that survives a round trip through JSON even if it
+// isn't finite.
+type jsonFloat float64
+
+func newJSONFloat(v float64) *jsonFloat {
+	f := jsonFloat(v)
+	return &f
+}
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(v)
+}
+
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		switch s {
+		case "NaN":
+			*f = jsonFloat(math.NaN())
+		case "+Inf":
+			*f = jsonFloat(math.Inf(1))
+		case "-Inf":
+			*f = jsonFloat(math.Inf(-1))
+		default:
+			return errors.New("Invalid number " + strconv.Quote(s))
+		}
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+func encodeFloats(values []float64) []jsonFloat {
+	if values == nil {
+		return nil
+	}
+	encoded := make([]jsonFloat, len(values))
+	for i, v := range values {
+		encoded[i] = jsonFloat(v)
+	}
+	return encoded
+}
+
+func decodeFloats(encoded []jsonFloat) []float64 {
+	if encoded == nil {
+		return nil
+	}
+	values := make([]float64, len(encoded))
+	for i, v := range encoded {
+		values[i] = float64(v)
+	}
+	return values
+}
+
+func encodePoints(points []point) []jsonPoint {
+	if len(points) == 0 {
+		return nil
+	}
+	encoded := make([]jsonPoint, len(points))
+	for i, p := range points {
+		encoded[i] = jsonPoint{Timestamp: encodeTime(p.Timestamp), Value: jsonFloat(p.Value)}
+	}
+	return encoded
+}
+
+func decodePoints(encoded []jsonPoint) ([]point, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	points := make([]point, len(encoded))
+	for i, j := range encoded {
+		timestamp, err := decodeTime(j.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		points[i] = point{Timestamp: timestamp, Value: float64(j.Value)}
+	}
+	return points, nil
+}
+
+var fieldTypeNames = map[message.Field_ValueType]string{
+	message.Field_STRING:  "string",
+	message.Field_BYTES:   "bytes",
+	message.Field_INTEGER: "integer",
+	message.Field_DOUBLE:  "double",
+	message.Field_BOOL:    "bool",
+}
+
+func encodeFields(fields []*message.Field) ([]jsonField, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	encoded := make([]jsonField, len(fields))
+	for i, field := range fields {
+		typeName, ok := fieldTypeNames[field.GetValueType()]
+		if !ok {
+			return nil, errors.New("Unknown field type for '" + field.GetName() + "'")
+		}
+		var values []interface{}
+		switch field.GetValueType() {
+		case message.Field_STRING:
+			for _, v := range field.GetValueString() {
+				values = append(values, v)
+			}
+		case message.Field_BYTES:
+			for _, v := range field.GetValueBytes() {
+				values = append(values, v)
+			}
+		case message.Field_INTEGER:
+			for _, v := range field.GetValueInteger() {
+				values = append(values, v)
+			}
+		case message.Field_DOUBLE:
+			for _, v := range field.GetValueDouble() {
+				values = append(values, jsonFloat(v))
+			}
+		case message.Field_BOOL:
+			for _, v := range field.GetValueBool() {
+				values = append(values, v)
+			}
+		}
+
+		encoded[i] = jsonField{
+			Name:           field.GetName(),
+			Type:           typeName,
+			Representation: field.GetRepresentation(),
+			Values:         make([]json.RawMessage, len(values)),
+		}
+		for j, v := range values {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i].Values[j] = raw
+		}
+	}
+	return encoded, nil
+}
+
+func decodeFields(encoded []jsonField) ([]*message.Field, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	fields := make([]*message.Field, len(encoded))
+	for i, j := range encoded {
+		var valueType message.Field_ValueType
+		found := false
+		for t, name := range fieldTypeNames {
+			if name == j.Type {
+				valueType, found = t, true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("Unknown field type '" + j.Type + "'")
+		}
+
+		field := message.NewFieldInit(j.Name, valueType, j.Representation)
+		for _, raw := range j.Values {
+			value, err := decodeFieldValue(valueType, raw)
+			if err != nil {
+				return nil, err
+			}
+			if err := field.AddValue(value); err != nil {
+				return nil, err
+			}
+		}
+		fields[i] = field
+	}
+	return fields, nil
+}
+
+// decodeFieldValue decodes a single field value into the Go type its field
+// requires.
+func decodeFieldValue(valueType message.Field_ValueType, raw json.RawMessage) (interface{}, error) {
+	var err error
+	switch valueType {
+	case message.Field_STRING:
+		var v string
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case message.Field_BYTES:
+		var v []byte
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case message.Field_INTEGER:
+		var v int64
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	case message.Field_DOUBLE:
+		var v jsonFloat
+		err = json.Unmarshal(raw, &v)
+		return float64(v), err
+	case message.Field_BOOL:
+		var v bool
+		err = json.Unmarshal(raw, &v)
+		return v, err
+	}
+	return nil, errors.New("Unknown field type")
+}
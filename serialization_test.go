@@ -0,0 +1,257 @@
+package hekaanom
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// testStart is the start of the test windows and spans, in a zone other than
+// UTC.
+var testStart = time.Date(2024, 3, 10, 1, 30, 0, 123456789, time.FixedZone("UTC-5", -5*60*60))
+
+func testFields(t *testing.T) []*message.Field {
+	var fields []*message.Field
+	for _, f := range []struct {
+		name  string
+		value interface{}
+		rep   string
+	}{
+		{"host", "web-1", ""},
+		{"bytes", int64(512), "B"},
+		{"load", 0.75, ""},
+		{"canary", true, ""},
+	} {
+		field, err := message.NewField(f.name, f.value, f.rep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func testWindow(t *testing.T, start time.Time) window {
+	return window{
+		Start:       start,
+		End:         start.Add(time.Minute),
+		Series:      "web-1/requests",
+		Value:       42.5,
+		Passthrough: testFields(t),
+		Unit:        "requests/s",
+		Kind:        "throughput",
+		Tags:        map[string]string{"host": "web-1"},
+		Excluded:    true,
+		Transformed: true,
+		RawValue:    1700,
+		Points:      []point{{Timestamp: start.Add(time.Second), Value: 3}},
+	}
+}
+
+func testSpan(t *testing.T, start time.Time) span {
+	return span{
+		ID:                 "a1",
+		ParentID:           "a0",
+		Start:              start,
+		End:                start.Add(5 * time.Minute),
+		Duration:           5 * time.Minute,
+		Series:             "web-1/requests",
+		Aggregation:        6.5,
+		Values:             []float64{3, 3.5},
+		ValueCount:         2,
+		Weights:            []float64{1, 0.5},
+		WindowValues:       []float64{40, 41},
+		Chart:              []byte("▁▇"),
+		Score:              6.5,
+		Passthrough:        testFields(t),
+		Tags:               map[string]string{"host": "web-1"},
+		Unit:               "requests/s",
+		Kind:               "throughput",
+		ScoreTransformed:   true,
+		RawScore:           3162,
+		ScoreQuantile:      0.9,
+		GroupScoreQuantile: 0.8,
+		Ranked:             true,
+		State:              "critical",
+		StateChanged:       true,
+		CloseReason:        closeExpired,
+		Amended:            true,
+		Class:              "spike",
+	}
+}
+
+// roundTripCases returns each pipeline type with its times outside UTC, a
+// pointer to decode it into, and what it should decode to.
+func roundTripCases(t *testing.T) []struct {
+	name     string
+	in, out  interface{}
+	expected interface{}
+} {
+	start := testStart
+	win, utcWin := testWindow(t, start), testWindow(t, start.UTC())
+	return []struct {
+		name     string
+		in, out  interface{}
+		expected interface{}
+	}{
+		{"metric", metric{
+			Timestamp:   start,
+			Series:      "web-1/requests",
+			Value:       12,
+			Passthrough: testFields(t),
+			Tags:        map[string]string{"host": "web-1"},
+			Unit:        "requests",
+			Kind:        "count",
+			Type:        "counter",
+			Distinct:    "user-7",
+		}, new(metric), metric{
+			Timestamp:   start.UTC(),
+			Series:      "web-1/requests",
+			Value:       12,
+			Passthrough: testFields(t),
+			Tags:        map[string]string{"host": "web-1"},
+			Unit:        "requests",
+			Kind:        "count",
+			Type:        "counter",
+			Distinct:    "user-7",
+		}},
+		{"window", win, new(window), utcWin},
+		{"ruling", ruling{
+			Window:          win,
+			Anomalous:       true,
+			Anomalousness:   4.2,
+			Normed:          -4.2,
+			Confidence:      1,
+			Passthrough:     testFields(t),
+			Ranked:          true,
+			ValuePercentile: 0.99,
+			Histogram:       []histogramBucket{{Lower: 1, Upper: 2, Weight: 0.5}},
+		}, new(ruling), ruling{
+			Window:          utcWin,
+			Anomalous:       true,
+			Anomalousness:   4.2,
+			Normed:          -4.2,
+			Confidence:      1,
+			Passthrough:     testFields(t),
+			Ranked:          true,
+			ValuePercentile: 0.99,
+			Histogram:       []histogramBucket{{Lower: 1, Upper: 2, Weight: 0.5}},
+		}},
+		{"span", testSpan(t, start), new(span), testSpan(t, start.UTC())},
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, c := range roundTripCases(t) {
+		data, err := json.Marshal(c.in)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if err := json.Unmarshal(data, c.out); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got := reflect.ValueOf(c.out).Elem().Interface(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %#v, want %#v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	for _, c := range roundTripCases(t) {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(c.in); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if err := gob.NewDecoder(&buf).Decode(c.out); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got := reflect.ValueOf(c.out).Elem().Interface(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %#v, want %#v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestTimesAreNormalizedToUTC(t *testing.T) {
+	win := testWindow(t, testStart)
+	data, err := json.Marshal(win)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"start":"2024-03-10T06:30:00.123456789Z"`) {
+		t.Errorf("start wasn't written in UTC: %s", data)
+	}
+
+	var decoded window
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Start.Equal(win.Start) || decoded.Start.Location() != time.UTC {
+		t.Errorf("got start %v, want %v in UTC", decoded.Start, win.Start)
+	}
+
+	// A time written with an offset by something else is read as UTC too.
+	if err := json.Unmarshal([]byte(`{"start":"2024-03-10T01:30:00-05:00"}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Start.Location() != time.UTC || decoded.Start.Hour() != 6 {
+		t.Errorf("got start %v, want 06:30 UTC", decoded.Start)
+	}
+}
+
+func TestNonFiniteValuesRoundTrip(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	load, err := message.NewField("load", nan, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testSpan(t, testStart.UTC())
+	s.Values = []float64{nan, inf, -inf, 1}
+	s.Score = nan
+	s.RawScore = -inf
+	s.Passthrough = []*message.Field{load}
+
+	for _, encoding := range []string{"json", "gob"} {
+		var decoded span
+		if encoding == "json" {
+			data, err := json.Marshal(s)
+			if err != nil {
+				t.Fatalf("json: %s", err)
+			}
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("json: %s", err)
+			}
+		} else {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+				t.Fatalf("gob: %s", err)
+			}
+			if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+				t.Fatalf("gob: %s", err)
+			}
+		}
+
+		v := decoded.Values
+		if len(v) != 4 || !math.IsNaN(v[0]) || !math.IsInf(v[1], 1) || !math.IsInf(v[2], -1) || v[3] != 1 {
+			t.Errorf("%s: got values %v", encoding, v)
+		}
+		if !math.IsNaN(decoded.Score) || !math.IsInf(decoded.RawScore, -1) {
+			t.Errorf("%s: got score %v and raw score %v", encoding, decoded.Score, decoded.RawScore)
+		}
+		if len(decoded.Passthrough) != 1 || !math.IsNaN(decoded.Passthrough[0].GetValueDouble()[0]) {
+			t.Errorf("%s: got passthrough %v", encoding, decoded.Passthrough)
+		}
+	}
+
+	var f jsonFloat
+	if err := json.Unmarshal([]byte(`"Infinity"`), &f); err == nil {
+		t.Error("an unknown non-finite number should be an error")
+	}
+}
@@ -0,0 +1,66 @@
+package hekaanom
+
+import (
+	"time"
+)
+
+// sessionMetric adds a metric to its series' session window, first closing
+// the session if the series has been quiet for longer than the session gap.
+func (f *windowFilter) sessionMetric(m metric, out chan window) {
+	gap := time.Duration(f.WindowConfig.SessionGap) * time.Second
+
+	win, ok := f.sessions[m.Series]
+	if ok && m.Timestamp.Sub(win.End) > gap {
+		f.flushSession(win, out)
+		ok = false
+	}
+	if !ok {
+		win = &window{
+			Start:  m.Timestamp,
+			Series: m.Series,
+		}
+		f.sessions[m.Series] = win
+	}
+
+	win.Passthrough, win.Tags, win.Unit, win.Kind = m.Passthrough, m.Tags, m.Unit, m.Kind
+	f.accumulate(&win.acc, m)
+	win.addPoint(point{m.Timestamp, m.Value}, f.WindowConfig.RawPoints)
+	win.End = m.Timestamp
+}
+
+// flushIdleSessions closes every session whose series has been quiet for
+// longer than the session gap as of now.
+func (f *windowFilter) flushIdleSessions(now time.Time, out chan window) {
+	gap := time.Duration(f.WindowConfig.SessionGap) * time.Second
+	for _, win := range f.sessions {
+		if now.Sub(win.End) > gap {
+			f.flushSession(win, out)
+		}
+	}
+}
+
+func (f *windowFilter) flushSession(win *window, out chan window) {
+	delete(f.sessions, win.Series)
+	// A session lasts until the gap after its last metric has passed.
+	win.End = win.End.Add(time.Duration(f.WindowConfig.SessionGap) * time.Second)
+	win.Value = win.acc.Value(f.WindowConfig.WindowStatistic, win.End.Sub(win.Start))
+	win.flushed = time.Now()
+	out <- *win
+}
+
+// FlushIdleWindows closes session windows that have gone quiet for longer
+// than the session gap, fills the windows of series that have stopped
+// reporting, and evicts series idle for longer than the series TTL, without
+// waiting for their series' next metric. It's a no-op unless one of those is
+// enabled, and never blocks.
+func (f *windowFilter) FlushIdleWindows(now time.Time) {
+	if f.WindowConfig.SessionGap <= 0 && f.WindowConfig.FillMissing == "" && f.WindowConfig.SeriesTTL <= 0 {
+		return
+	}
+	for _, instance := range f.instances() {
+		select {
+		case instance.idle <- now:
+		default:
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package hekaanom
+
+import "github.com/berkmancenter/hekaanom/anomutil"
+
+// SeriesShard returns the shard, in [0, totalShards), that owns a series. It
+// uses a 32-bit FNV-1a hash of the series code, so every instance (and any
+// external router) assigns a series to the same shard. It's the same as
+// anomutil.SeriesShard, which routers can use without importing the filter.
+func SeriesShard(series string, totalShards int) int {
+	return anomutil.SeriesShard(series, totalShards)
+}
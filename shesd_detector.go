@@ -0,0 +1,265 @@
+package hekaanom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// shesdDetector is a Seasonal Hybrid ESD detector, after Twitter's
+// AnomalyDetection. For each window it takes its series' recent values,
+// removes their seasonal part (the median value at each point of the season)
+// and their median, and runs a generalized extreme Studentized deviate (ESD)
+// test on the residuals, using the median and MAD in place of the mean and
+// standard deviation. The window is anomalous if the test picks its residual
+// out as an outlier. This catches outliers that are only unusual for their
+// point in the season, as well as global ones.
+type shesdDetector struct {
+	season   int
+	lookback int
+	maxAnoms float64
+	alpha    float64
+	series   map[string]*shesdSeries
+}
+
+// shesdSeries holds the last lookback values of a series and the points of the
+// season they fell on, in a ring.
+type shesdSeries struct {
+	values []float64
+	phases []int
+	next   int
+	phase  int
+}
+
+func (d *shesdDetector) Init(config interface{}) error {
+	conf := config.(pipeline.PluginConfig)
+
+	season, ok := conf["season"]
+	if !ok {
+		return errors.New("Must provide 'season'")
+	}
+	s, ok := season.(int64)
+	if !ok || s < 1 {
+		return errors.New("'season' must be an integer greater than zero")
+	}
+	d.season = int(s)
+
+	d.lookback = 4 * d.season
+	if lookback, ok := conf["lookback"]; ok {
+		l, ok := lookback.(int64)
+		if !ok || int(l) < 2*d.season {
+			return errors.New("'lookback' must be an integer of at least two seasons")
+		}
+		d.lookback = int(l)
+	}
+
+	var err error
+	if d.maxAnoms, err = configFloat(conf, "max_anoms", 0.02); err != nil {
+		return err
+	}
+	if d.maxAnoms <= 0 || d.maxAnoms >= 0.5 {
+		return errors.New("'max_anoms' must be greater than zero and less than 0.5")
+	}
+	if d.alpha, err = configFloat(conf, "alpha", 0.05); err != nil {
+		return err
+	}
+	if d.alpha <= 0 || d.alpha >= 1 {
+		return errors.New("'alpha' must be between zero and one")
+	}
+
+	d.series = map[string]*shesdSeries{}
+	return nil
+}
+
+func (d *shesdDetector) Train(win window) {
+	s := d.seriesFor(win.Series)
+	s.add(win.Value, s.phase, d.lookback)
+	s.phase = (s.phase + 1) % d.season
+}
+
+func (d *shesdDetector) Rename(old, new string) {
+	if _, ok := d.series[new]; ok {
+		return
+	}
+	s, ok := d.series[old]
+	if !ok {
+		return
+	}
+	delete(d.series, old)
+	d.series[new] = s
+}
+
+func (d *shesdDetector) Forget(series string) {
+	delete(d.series, series)
+}
+
+// Detect rules on a window once its series has two seasons of values, testing
+// the window along with them. The window is then added to them unless it's
+// excluded.
+func (d *shesdDetector) Detect(win window, out chan ruling) {
+	s := d.seriesFor(win.Series)
+	phase := s.phase
+	s.phase = (s.phase + 1) % d.season
+
+	if len(s.values) >= 2*d.season {
+		values := append(append([]float64(nil), s.values...), win.Value)
+		phases := append(append([]int(nil), s.phases...), phase)
+		residuals := d.residuals(values, phases)
+		anomalous, normed := d.test(residuals)
+		out <- ruling{
+			Window:        win,
+			Anomalous:     anomalous,
+			Anomalousness: math.Abs(normed),
+			Normed:        normed,
+			Confidence:    1.0,
+			Passthrough:   win.Passthrough,
+		}
+	}
+	if !win.Excluded {
+		s.add(win.Value, phase, d.lookback)
+	}
+}
+
+func (d *shesdDetector) seriesFor(series string) *shesdSeries {
+	s, ok := d.series[series]
+	if !ok {
+		s = &shesdSeries{}
+		d.series[series] = s
+	}
+	return s
+}
+
+func (s *shesdSeries) add(value float64, phase, lookback int) {
+	if len(s.values) < lookback {
+		s.values = append(s.values, value)
+		s.phases = append(s.phases, phase)
+		return
+	}
+	s.values[s.next] = value
+	s.phases[s.next] = phase
+	s.next = (s.next + 1) % lookback
+}
+
+// residuals returns what's left of values once the median value at each point
+// of the season, and the median of everything left after that, are taken
+// away.
+func (d *shesdDetector) residuals(values []float64, phases []int) []float64 {
+	byPhase := make([][]float64, d.season)
+	for i, v := range values {
+		byPhase[phases[i]] = append(byPhase[phases[i]], v)
+	}
+	seasonal := make([]float64, d.season)
+	for phase, vs := range byPhase {
+		seasonal[phase] = median(vs)
+	}
+
+	residuals := make([]float64, len(values))
+	for i, v := range values {
+		residuals[i] = v - seasonal[phases[i]]
+	}
+	center := median(residuals)
+	for i := range residuals {
+		residuals[i] -= center
+	}
+	return residuals
+}
+
+// test runs the hybrid generalized ESD test on residuals, reporting whether
+// the last of them is an outlier, and that residual's robust z-score.
+func (d *shesdDetector) test(residuals []float64) (bool, float64) {
+	n := len(residuals)
+	last := n - 1
+	maxOutliers := int(math.Floor(d.maxAnoms * float64(n)))
+	if maxOutliers < 1 {
+		maxOutliers = 1
+	}
+
+	// The residuals still in the test, by index, and the indexes of those
+	// taken out as the most extreme, in the order they were taken out.
+	remaining := make([]int, n)
+	for i := range remaining {
+		remaining[i] = i
+	}
+	var removed []int
+	outliers := 0
+	normed := 0.0
+
+	for i := 1; i <= maxOutliers; i++ {
+		values := make([]float64, len(remaining))
+		for j, index := range remaining {
+			values[j] = residuals[index]
+		}
+		center, scale := medianMAD(values)
+		if i == 1 {
+			normed = robustZ(residuals[last], center, scale)
+		}
+		if scale == 0 {
+			break
+		}
+
+		extreme, deviation := 0, -1.0
+		for j, index := range remaining {
+			if dev := math.Abs(residuals[index] - center); dev > deviation {
+				extreme, deviation = j, dev
+			}
+		}
+		removed = append(removed, remaining[extreme])
+		remaining = append(remaining[:extreme], remaining[extreme+1:]...)
+
+		if deviation/scale > esdCritical(n, i, d.alpha) {
+			outliers = i
+		}
+	}
+
+	for _, index := range removed[:outliers] {
+		if index == last {
+			return true, normed
+		}
+	}
+	return false, normed
+}
+
+// esdCritical returns the critical value of the i'th step of a generalized ESD
+// test on n values at significance alpha.
+func esdCritical(n, i int, alpha float64) float64 {
+	p := 1 - alpha/(2*float64(n-i+1))
+	df := float64(n - i - 1)
+	t := studentTQuantile(p, df)
+	return float64(n-i) * t / math.Sqrt((df+t*t)*float64(n-i+1))
+}
+
+// studentTQuantile approximates the p quantile of Student's t-distribution with
+// df degrees of freedom by expanding around the normal quantile (Abramowitz
+// and Stegun 26.7.5). It's accurate to a few decimal places from about five
+// degrees of freedom, which the test has unless its lookback is tiny.
+func studentTQuantile(p, df float64) float64 {
+	z := math.Sqrt2 * math.Erfinv(2*p-1)
+	z2 := z * z
+	g1 := (z2 + 1) * z / 4
+	g2 := ((5*z2+16)*z2 + 3) * z / 96
+	g3 := (((3*z2+19)*z2+17)*z2 - 15) * z / 384
+	g4 := ((((79*z2+776)*z2+1482)*z2-1920)*z2 - 945) * z / 92160
+	return z + g1/df + g2/(df*df) + g3/(df*df*df) + g4/(df*df*df*df)
+}
+
+// medianMAD returns the median of values and their median absolute deviation,
+// scaled so that it estimates the standard deviation of normally distributed
+// values.
+func medianMAD(values []float64) (float64, float64) {
+	center := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - center)
+	}
+	return center, 1.4826 * median(deviations)
+}
+
+// robustZ returns how many scaled MADs a value is from the median, or its
+// plain distance from the median if the MAD is zero.
+func robustZ(value, center, scale float64) float64 {
+	if scale == 0 {
+		return value - center
+	}
+	return (value - center) / scale
+}
@@ -0,0 +1,92 @@
+package hekaanom
+
+import (
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// slidingWindow holds the metrics of a series over the last window width,
+// split into buckets one slide wide, so that an overlapping window can be
+// emitted every slide.
+type slidingWindow struct {
+	Series      string
+	Passthrough []*message.Field
+	Tags        map[string]string
+	Unit        string
+	Kind        string
+	buckets     []bucket
+}
+
+type bucket struct {
+	start  time.Time
+	points []point
+}
+
+// slide returns the slide of a series' windows, or zero if its windows don't
+// overlap.
+func (f *windowFilter) slide(series string) time.Duration {
+	slide, width := time.Duration(f.WindowConfig.WindowSlide)*time.Second, f.Width(series)
+	if slide <= 0 || slide >= width || width%slide != 0 {
+		return 0
+	}
+	return slide
+}
+
+// slideMetric adds a metric to its series' sliding window, emitting the
+// window first if the metric starts a new slide and the window covers a full
+// width.
+func (f *windowFilter) slideMetric(m metric, slideWidth time.Duration, out chan window) {
+	width := f.Width(m.Series)
+
+	sw, ok := f.sliding[m.Series]
+	if !ok {
+		sw = &slidingWindow{Series: m.Series}
+		f.sliding[m.Series] = sw
+	}
+	sw.Passthrough, sw.Tags, sw.Unit, sw.Kind = m.Passthrough, m.Tags, m.Unit, m.Kind
+
+	n := len(sw.buckets)
+	if n == 0 || m.Timestamp.Sub(sw.buckets[n-1].start) >= slideWidth {
+		if n > 0 && len(sw.buckets) == int(width/slideWidth) {
+			out <- sw.window(width, f.WindowConfig.WindowStatistic, f.WindowConfig.RawPoints)
+		}
+
+		sw.buckets = append(sw.buckets, bucket{start: f.windowStart(m.Timestamp, slideWidth)})
+		// Drop buckets that have slid out of the window.
+		i := 0
+		for i < len(sw.buckets) && m.Timestamp.Sub(sw.buckets[i].start) >= width {
+			i++
+		}
+		sw.buckets = sw.buckets[i:]
+	}
+
+	last := &sw.buckets[len(sw.buckets)-1]
+	last.points = append(last.points, point{m.Timestamp, m.Value})
+}
+
+// window returns the window covered by the buckets.
+func (sw *slidingWindow) window(width time.Duration, statistic string, rawPoints int) window {
+	win := window{
+		Start:       sw.buckets[0].start,
+		End:         sw.buckets[0].start.Add(width),
+		Series:      sw.Series,
+		Passthrough: sw.Passthrough,
+		Tags:        sw.Tags,
+		Unit:        sw.Unit,
+		Kind:        sw.Kind,
+		flushed:     time.Now(),
+	}
+	var acc accumulator
+	if _, ok := statisticQuantile(statistic); ok {
+		acc.keepQuantiles()
+	}
+	for _, b := range sw.buckets {
+		for _, p := range b.points {
+			acc.Add(p.Value)
+			win.addPoint(p, rawPoints)
+		}
+	}
+	win.Value = acc.Value(statistic, width)
+	return win
+}
@@ -1,7 +1,10 @@
 package hekaanom
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"math"
 	"time"
 
 	"github.com/montanaflynn/stats"
@@ -9,22 +12,92 @@ import (
 )
 
 type span struct {
+	// ID uniquely identifies the span. ParentID is the ID of the previous span
+	// of the same series, if this one was linked to it (see ReopenGrace).
+	ID       string
+	ParentID string
+
+	// The span's key in the gather stage's span cache.
+	key string
+
 	Start       time.Time
 	End         time.Time
 	Duration    time.Duration
 	Series      string
 	Aggregation float64
 	Values      []float64
+	// The number of values the span had before they were downsampled for
+	// emission.
+	ValueCount int
+	Weights    []float64
+	// The values of the windows ruled on, kept only when sparklines are
+	// enabled.
+	WindowValues []float64
+	// A PNG chart of the window values, if charts are enabled.
+	Chart []byte
+	// The values of the windows just before and after the span, drawn around
+	// its own in its chart.
+	chartBefore []float64
+	chartAfter  []float64
+
 	Score       float64
 	Passthrough []*message.Field
+	Tags        map[string]string
+	Unit        string
+	Kind        string
+
+	// The span's score before it was transformed for emission, if it was.
+	ScoreTransformed bool
+	RawScore         float64
+
+	// The fraction of recent spans, overall and in the same catalog group,
+	// whose absolute score is no greater than this one's. Only set if Ranked.
+	ScoreQuantile      float64
+	GroupScoreQuantile float64
+	Ranked             bool
+
+	// State is the span's current escalation state, if escalation is
+	// configured. StateChanged marks an event emitted on entering that state
+	// while the span is still open.
+	State        string
+	StateChanged bool
+	escalation   int
+
+	// Why the span was closed: "expired", "stuck" (it could never expire
+	// before the last date), "sign_flip", "normal" (after enough consecutive
+	// normal rulings) or "shutdown". Empty for state change events.
+	CloseReason string
+
+	// Amended marks a span emitted again after it closed, because a late
+	// anomalous ruling was added to it (see AmendLookback).
+	Amended bool
+
+	// The shape of the span's values, if classification is enabled.
+	Class string
+
+	// When the span last received a ruling, for measuring stage latency.
+	lastRuled time.Time
+
+	// When the span expires and its position in the gather stage's expiry
+	// queue.
+	expiresAt  time.Time
+	queueIndex int
+
+	// The number of consecutive non-anomalous rulings since the span was last
+	// extended.
+	normalRun int
 }
 
-func (span *span) CalcScore(agg func(stats.Float64Data) (float64, error)) error {
+// CalcScore sets the span's aggregation and score. If meanWeights is set, a
+// weighted span's weights are scaled to average 1 first, so that the mean of
+// its weighted values is the weighted mean of its values.
+func (span *span) CalcScore(agg func(stats.Float64Data) (float64, error), meanWeights bool) error {
 	span.trimValues()
-	if len(span.Values) == 1 {
-		span.Aggregation = span.Values[0]
+	values := span.weightedValues(meanWeights)
+	if len(values) == 1 {
+		span.Aggregation = values[0]
 	} else {
-		aggregation, err := agg(span.Values)
+		aggregation, err := agg(values)
 		if err != nil {
 			return err
 		}
@@ -38,6 +111,8 @@ func (span *span) trimValues() {
 	// We want to keep zeroes if they occur between two non-zero values. Walk
 	// backward through the list.
 	trimmedVals := []float64{}
+	trimmedWeights := []float64{}
+	weighted := len(span.Weights) == len(span.Values)
 	keepZeroes := false
 	for i := len(span.Values) - 1; i >= 0; i-- {
 		val := span.Values[i]
@@ -46,13 +121,46 @@ func (span *span) trimValues() {
 		}
 		if keepZeroes || val != 0.0 {
 			trimmedVals = append(trimmedVals, val)
+			if weighted {
+				trimmedWeights = append(trimmedWeights, span.Weights[i])
+			}
 		}
 	}
 	// Reverse them so we can set them to the span values in correct order.
 	for l, r := 0, len(trimmedVals)-1; l < r; l, r = l+1, r-1 {
 		trimmedVals[l], trimmedVals[r] = trimmedVals[r], trimmedVals[l]
 	}
+	for l, r := 0, len(trimmedWeights)-1; l < r; l, r = l+1, r-1 {
+		trimmedWeights[l], trimmedWeights[r] = trimmedWeights[r], trimmedWeights[l]
+	}
 	span.Values = trimmedVals
+	if weighted {
+		span.Weights = trimmedWeights
+	}
+}
+
+// weightedValues returns the span's values scaled by their weights, or the
+// values themselves if the span isn't weighted. If normalize is set, the
+// weights are scaled to sum to the number of values.
+func (span *span) weightedValues(normalize bool) []float64 {
+	if len(span.Weights) != len(span.Values) {
+		return span.Values
+	}
+	scale := 1.0
+	if normalize {
+		var total float64
+		for _, weight := range span.Weights {
+			total += weight
+		}
+		if total > 0 {
+			scale = float64(len(span.Weights)) / total
+		}
+	}
+	values := make([]float64, len(span.Values))
+	for i, val := range span.Values {
+		values[i] = val * span.Weights[i] * scale
+	}
+	return values
 }
 
 func (s span) FillMessage(m *message.Message) error {
@@ -71,6 +179,22 @@ func (s span) FillMessage(m *message.Message) error {
 		return errors.New("Could not create 'series' field")
 	}
 
+	if s.ID != "" {
+		id, err := message.NewField("span_id", s.ID, "")
+		if err != nil {
+			return errors.New("Could not create 'span_id' field")
+		}
+		m.AddField(id)
+	}
+
+	if s.ParentID != "" {
+		parent, err := message.NewField("parent_span_id", s.ParentID, "")
+		if err != nil {
+			return errors.New("Could not create 'parent_span_id' field")
+		}
+		m.AddField(parent)
+	}
+
 	agg, err := message.NewField("aggregation", s.Aggregation, "count")
 	if err != nil {
 		return errors.New("Could not create 'aggregation' field")
@@ -94,6 +218,11 @@ func (s span) FillMessage(m *message.Message) error {
 		return errors.New("Could not create 'score' field")
 	}
 
+	version, err := message.NewField("schema_version", schemaVersion, "")
+	if err != nil {
+		return errors.New("Could not create 'schema_version' field")
+	}
+
 	m.SetTimestamp(s.End.UnixNano())
 	m.AddField(series)
 	m.AddField(start)
@@ -102,9 +231,163 @@ func (s span) FillMessage(m *message.Message) error {
 	m.AddField(agg)
 	m.AddField(score)
 	m.AddField(valuesField)
+	m.AddField(version)
+
+	if s.ValueCount > len(s.Values) {
+		count, err := message.NewField("value_count", s.ValueCount, "count")
+		if err != nil {
+			return errors.New("Could not create 'value_count' field")
+		}
+		m.AddField(count)
+	}
+
+	if len(s.WindowValues) > 0 {
+		windowValues := message.NewFieldInit("window_values", message.Field_DOUBLE, "count")
+		for _, val := range s.WindowValues {
+			if err := windowValues.AddValue(val); err != nil {
+				return errors.New("Could not create 'window_values' field")
+			}
+		}
+		sparkline, err := message.NewField("sparkline", s.Sparkline(), "")
+		if err != nil {
+			return errors.New("Could not create 'sparkline' field")
+		}
+		m.AddField(windowValues)
+		m.AddField(sparkline)
+	}
+
+	if s.ScoreTransformed {
+		rawScore, err := message.NewField("raw_score", s.RawScore, "count")
+		if err != nil {
+			return errors.New("Could not create 'raw_score' field")
+		}
+		m.AddField(rawScore)
+	}
+
+	if s.Ranked {
+		quantile, err := message.NewField("score_quantile", s.ScoreQuantile, "")
+		if err != nil {
+			return errors.New("Could not create 'score_quantile' field")
+		}
+		groupQuantile, err := message.NewField("group_score_quantile", s.GroupScoreQuantile, "")
+		if err != nil {
+			return errors.New("Could not create 'group_score_quantile' field")
+		}
+		m.AddField(quantile)
+		m.AddField(groupQuantile)
+	}
+
+	if err := addUnitFields(m, s.Unit, s.Kind); err != nil {
+		return err
+	}
+
+	if len(s.Chart) > 0 {
+		chart, err := message.NewField("chart", s.Chart, "image/png")
+		if err != nil {
+			return errors.New("Could not create 'chart' field")
+		}
+		m.AddField(chart)
+	}
+
+	if s.State != "" {
+		state, err := message.NewField("state", s.State, "")
+		if err != nil {
+			return errors.New("Could not create 'state' field")
+		}
+		m.AddField(state)
+	}
+
+	if s.Class != "" {
+		class, err := message.NewField("class", s.Class, "")
+		if err != nil {
+			return errors.New("Could not create 'class' field")
+		}
+		m.AddField(class)
+	}
+
+	if s.CloseReason != "" {
+		reason, err := message.NewField("close_reason", s.CloseReason, "")
+		if err != nil {
+			return errors.New("Could not create 'close_reason' field")
+		}
+		m.AddField(reason)
+	}
+
+	if s.Amended {
+		amended, err := message.NewField("amended", true, "")
+		if err != nil {
+			return errors.New("Could not create 'amended' field")
+		}
+		m.AddField(amended)
+	}
+
+	if err := addTagFields(m, s.Tags); err != nil {
+		return err
+	}
 
 	for _, field := range s.Passthrough {
 		m.AddField(field)
 	}
 	return nil
 }
+
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline renders the span's window values as a string of Unicode block
+// characters scaled between their minimum and maximum.
+func (s span) Sparkline() string {
+	if len(s.WindowValues) == 0 {
+		return ""
+	}
+	min, max := s.WindowValues[0], s.WindowValues[0]
+	for _, val := range s.WindowValues {
+		min = math.Min(min, val)
+		max = math.Max(max, val)
+	}
+	line := make([]rune, len(s.WindowValues))
+	for i, val := range s.WindowValues {
+		tick := 0
+		if max > min {
+			tick = int((val - min) / (max - min) * float64(len(sparkTicks)-1))
+		}
+		if tick < 0 || tick >= len(sparkTicks) {
+			tick = len(sparkTicks) - 1
+		}
+		line[i] = sparkTicks[tick]
+	}
+	return string(line)
+}
+
+// downsample reduces values to at most max points, either by keeping every
+// Nth value or by averaging consecutive runs of values.
+func downsample(values []float64, max int, method string) []float64 {
+	if max <= 0 || len(values) <= max {
+		return values
+	}
+	reduced := make([]float64, 0, max)
+	if method == downsampleNth {
+		step := (len(values) + max - 1) / max
+		for i := 0; i < len(values); i += step {
+			reduced = append(reduced, values[i])
+		}
+		return reduced
+	}
+	for i := 0; i < max; i++ {
+		lo, hi := i*len(values)/max, (i+1)*len(values)/max
+		sum := 0.0
+		for _, val := range values[lo:hi] {
+			sum += val
+		}
+		reduced = append(reduced, sum/float64(hi-lo))
+	}
+	return reduced
+}
+
+// newSpanID returns a random identifier for a span.
+func newSpanID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
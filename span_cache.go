@@ -0,0 +1,132 @@
+package hekaanom
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The number of independently locked shards the open spans are split across.
+const spanCacheShards = 256
+
+// spanCache holds the open span of each series, sharded by series so that
+// flushing and inspecting spans only ever holds up a fraction of the series
+// being gathered.
+type spanCache struct {
+	shards []*spanShard
+}
+
+type spanShard struct {
+	sync.Mutex
+
+	// The open spans, the latest ruling time, the most recently closed span
+	// (if reopen_grace is set) and a copy of it that can still be amended (if
+	// amend_lookback is set) of each series, plus any span_key values.
+	spans     map[string]*span
+	nows      map[string]time.Time
+	closed    map[string]closedSpan
+	amendable map[string]*amendableSpan
+	// The values of each series' latest windows outside a span, if charts
+	// are enabled, to draw before its next span.
+	recent map[string][]float64
+
+	expiries expiryQueue
+
+	// How many times the shard has been locked, and how long was spent
+	// waiting to lock it.
+	acquisitions int64
+	waited       time.Duration
+}
+
+func newSpanCache() spanCache {
+	c := spanCache{shards: make([]*spanShard, spanCacheShards)}
+	for i := range c.shards {
+		c.shards[i] = &spanShard{
+			spans:     map[string]*span{},
+			nows:      map[string]time.Time{},
+			closed:    map[string]closedSpan{},
+			amendable: map[string]*amendableSpan{},
+			recent:    map[string][]float64{},
+		}
+	}
+	return c
+}
+
+// closedSpan is what's remembered about a closed span to link later spans
+// to it.
+type closedSpan struct {
+	ID       string
+	ClosedAt time.Time
+	Positive bool
+}
+
+// openSpan is a point-in-time copy of the bounds of an open span.
+type openSpan struct {
+	Series string
+	Start  time.Time
+	End    time.Time
+	Now    time.Time
+}
+
+// Snapshot copies the bounds of every open span, locking one shard at a time
+// and only for as long as it takes to copy it, so that inspecting the cache
+// never holds up gathering for long.
+func (c spanCache) Snapshot() []openSpan {
+	var spans []openSpan
+	for _, s := range c.shards {
+		s.lock()
+		for key, span := range s.spans {
+			spans = append(spans, openSpan{
+				Series: span.Series,
+				Start:  span.Start,
+				End:    span.End,
+				Now:    s.nows[key],
+			})
+		}
+		s.Unlock()
+	}
+	return spans
+}
+
+// shard returns the shard that holds a series' span.
+func (c spanCache) shard(series string) *spanShard {
+	return c.shards[SeriesShard(series, len(c.shards))]
+}
+
+// lock locks the shard, recording how long that took.
+func (s *spanShard) lock() {
+	start := time.Now()
+	s.Lock()
+	s.acquisitions++
+	s.waited += time.Since(start)
+}
+
+// PrintLockContention prints how long, on average, locking the span cache
+// has taken, overall and for the most contended shard.
+func (c spanCache) PrintLockContention() {
+	fmt.Println("Span cache lock contention")
+	var acquisitions int64
+	var waited time.Duration
+	worst, worstWait := -1, time.Duration(0)
+	for i, s := range c.shards {
+		s.Lock()
+		acquisitions += s.acquisitions
+		waited += s.waited
+		if s.acquisitions > 0 {
+			if wait := s.waited / time.Duration(s.acquisitions); wait > worstWait {
+				worst, worstWait = i, wait
+			}
+		}
+		s.Unlock()
+	}
+	if acquisitions == 0 {
+		fmt.Println("no acquisitions")
+		fmt.Println()
+		return
+	}
+	fmt.Println("acquisitions", acquisitions, "mean wait", waited/time.Duration(acquisitions))
+	if worst >= 0 {
+		fmt.Println("most contended shard", worst, "mean wait", worstWait)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,62 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// getMessageTags returns the values of the configured tag fields of a
+// message, by field name.
+func (f *AnomalyFilter) getMessageTags(msg *message.Message) map[string]string {
+	if len(f.AnomalyConfig.TagFields) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(f.AnomalyConfig.TagFields))
+	for _, name := range f.AnomalyConfig.TagFields {
+		field := msg.FindFirstField(name)
+		if field == nil {
+			continue
+		}
+		tags[name] = fmt.Sprint(fieldValue(field))
+	}
+	return tags
+}
+
+// SeriesKey returns the series a metric belongs in once its configured series
+// tags are taken into account: its own series, if it has one, followed by the
+// values of the series tags, joined by '|'. Metrics must be keyed before
+// they're windowed.
+func (f *windowFilter) SeriesKey(m metric) string {
+	if len(f.WindowConfig.SeriesTags) == 0 {
+		return m.Series
+	}
+	parts := make([]string, 0, len(f.WindowConfig.SeriesTags)+1)
+	if m.Series != defaultMessageSeries {
+		parts = append(parts, m.Series)
+	}
+	for _, name := range f.WindowConfig.SeriesTags {
+		parts = append(parts, m.Tags[name])
+	}
+	return strings.Join(parts, "|")
+}
+
+// addTagFields adds a string field to a message for each tag, in name order.
+func addTagFields(m *message.Message, tags map[string]string) error {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, err := message.NewField(name, tags[name], "")
+		if err != nil {
+			return errors.New("Could not create '" + name + "' field")
+		}
+		m.AddField(field)
+	}
+	return nil
+}
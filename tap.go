@@ -0,0 +1,151 @@
+package hekaanom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// The stages that can be tapped.
+const (
+	tapWindows = "windows"
+	tapRulings = "rulings"
+	tapSpans   = "spans"
+
+	// The message type that starts a tap.
+	tapMessageType = "anom.tap"
+)
+
+// activeTap is a tap file still waiting for items.
+type activeTap struct {
+	file      *os.File
+	remaining int64
+}
+
+// tapper copies the next items flowing out of a stage to a file in its
+// directory, as JSON lines, when asked to by an "anom.tap" message.
+type tapper struct {
+	sync.Mutex
+	dir    string
+	active map[string]*activeTap
+}
+
+func newTapper(dir string) *tapper {
+	return &tapper{dir: dir, active: map[string]*activeTap{}}
+}
+
+// Start opens a tap on a stage for the given number of items, replacing any
+// tap already open on it, and returns the file the items will be written to.
+func (t *tapper) Start(stage string, count int64) (string, error) {
+	switch stage {
+	case tapWindows, tapRulings, tapSpans:
+	default:
+		return "", fmt.Errorf("Can't tap unknown stage %q.", stage)
+	}
+	if count <= 0 {
+		return "", errors.New("A tap's 'count' must be greater than zero.")
+	}
+
+	name := fmt.Sprintf("%s-%d.jsonl", stage, time.Now().UnixNano())
+	path := filepath.Join(t.dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if old, ok := t.active[stage]; ok {
+		old.file.Close()
+	}
+	t.active[stage] = &activeTap{file: file, remaining: count}
+	return path, nil
+}
+
+// StartFromMessage opens the tap an "anom.tap" message asks for with its
+// "stage" and "count" fields.
+func (t *tapper) StartFromMessage(msg *message.Message) (string, error) {
+	stage, _ := msg.GetFieldValue("stage")
+	count, _ := msg.GetFieldValue("count")
+	stageName, ok := stage.(string)
+	if !ok {
+		return "", errors.New("A tap message needs a string 'stage' field.")
+	}
+	var n int64
+	switch c := count.(type) {
+	case int64:
+		n = c
+	case float64:
+		n = int64(c)
+	case string:
+		parsed, err := strconv.ParseInt(c, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Invalid tap 'count' %q.", c)
+		}
+		n = parsed
+	default:
+		return "", errors.New("A tap message needs a numeric 'count' field.")
+	}
+	return t.Start(stageName, n)
+}
+
+// Observe writes an item flowing out of a stage to the stage's tap, if it has
+// one, closing the tap once it has had all the items it asked for.
+func (t *tapper) Observe(stage string, item json.Marshaler) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	tap, ok := t.active[stage]
+	if !ok {
+		return
+	}
+	encoded, err := item.MarshalJSON()
+	if err == nil {
+		_, err = tap.file.Write(append(encoded, '\n'))
+	}
+	tap.remaining--
+	if err != nil || tap.remaining <= 0 {
+		tap.file.Close()
+		delete(t.active, stage)
+	}
+}
+
+// Connect passes windows through, copying them to the windows stage's tap.
+func (t *tapper) Connect(in chan window) chan window {
+	if t == nil {
+		return in
+	}
+	out := make(chan window)
+	go func() {
+		defer close(out)
+		for win := range in {
+			if !win.evicted {
+				t.Observe(tapWindows, win)
+			}
+			out <- win
+		}
+	}()
+	return out
+}
+
+// Close closes any taps still open.
+func (t *tapper) Close() {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for stage, tap := range t.active {
+		tap.file.Close()
+		delete(t.active, stage)
+	}
+}
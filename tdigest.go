@@ -0,0 +1,199 @@
+package hekaanom
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	defaultCompression = 100
+	digestBufferSize   = 500
+)
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tDigest is a streaming approximation of a distribution, accurate at its
+// tails, after Dunning's merging t-digest. It answers quantile and rank
+// queries without keeping every sample.
+type tDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	count       float64
+	min, max    float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add records a sample. NaNs are ignored.
+func (d *tDigest) Add(x float64) {
+	d.addWeighted(x, 1)
+}
+
+func (d *tDigest) addWeighted(x, weight float64) {
+	if math.IsNaN(x) || weight <= 0 {
+		return
+	}
+	d.buffer = append(d.buffer, centroid{x, weight})
+	d.count += weight
+	d.min = math.Min(d.min, x)
+	d.max = math.Max(d.max, x)
+	if len(d.buffer) >= digestBufferSize {
+		d.compress()
+	}
+}
+
+// Count returns the total weight of the samples recorded.
+func (d *tDigest) Count() float64 {
+	return d.count
+}
+
+// Merge adds every sample summarized by another digest to this one.
+func (d *tDigest) Merge(other *tDigest) {
+	other.compress()
+	for _, c := range other.centroids {
+		d.addWeighted(c.mean, c.weight)
+	}
+	if other.count > 0 {
+		d.min = math.Min(d.min, other.min)
+		d.max = math.Max(d.max, other.max)
+	}
+}
+
+func (d *tDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	d.buffer = nil
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	total := 0.0
+	for _, c := range all {
+		total += c.weight
+	}
+
+	merged := make([]centroid, 0, len(all))
+	cur := all[0]
+	soFar := 0.0
+	for _, c := range all[1:] {
+		proposed := cur.weight + c.weight
+		q0 := soFar / total
+		q2 := (soFar + proposed) / total
+		limit := 4 * total * math.Min(q0*(1-q0), q2*(1-q2)) / d.compression
+		if proposed <= limit {
+			cur.mean += (c.mean - cur.mean) * c.weight / proposed
+			cur.weight = proposed
+		} else {
+			merged = append(merged, cur)
+			soFar += cur.weight
+			cur = c
+		}
+	}
+	d.centroids = append(merged, cur)
+}
+
+// Quantile returns an estimate of the value below which a fraction q of the
+// samples fall, or NaN if there are no samples.
+func (d *tDigest) Quantile(q float64) float64 {
+	d.compress()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if q >= 1 {
+		return d.max
+	}
+
+	target := q * d.count
+	cum := 0.0
+	prevCenter, prevMean := 0.0, d.min
+	for _, c := range d.centroids {
+		center := cum + c.weight/2
+		if target < center {
+			if center == prevCenter {
+				return c.mean
+			}
+			return prevMean + (c.mean-prevMean)*(target-prevCenter)/(center-prevCenter)
+		}
+		prevCenter, prevMean = center, c.mean
+		cum += c.weight
+	}
+	if d.count == prevCenter {
+		return d.max
+	}
+	return prevMean + (d.max-prevMean)*(target-prevCenter)/(d.count-prevCenter)
+}
+
+// CDF returns an estimate of the fraction of samples less than or equal to x,
+// or NaN if there are no samples.
+func (d *tDigest) CDF(x float64) float64 {
+	d.compress()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	if x < d.min {
+		return 0
+	}
+	if x >= d.max {
+		return 1
+	}
+
+	cum := 0.0
+	prevCenter, prevMean := 0.0, d.min
+	for _, c := range d.centroids {
+		center := cum + c.weight/2
+		if x < c.mean {
+			if c.mean == prevMean {
+				return prevCenter / d.count
+			}
+			return (prevCenter + (center-prevCenter)*(x-prevMean)/(c.mean-prevMean)) / d.count
+		}
+		prevCenter, prevMean = center, c.mean
+		cum += c.weight
+	}
+	return (prevCenter + (d.count-prevCenter)*(x-prevMean)/(d.max-prevMean)) / d.count
+}
+
+// recentDigest summarizes roughly the most recent samples by keeping two
+// digests and starting afresh with the older one once the newer one is full.
+type recentDigest struct {
+	size     float64
+	current  *tDigest
+	previous *tDigest
+}
+
+func newRecentDigest(size int) *recentDigest {
+	return &recentDigest{
+		size:     float64(size),
+		current:  newTDigest(defaultCompression),
+		previous: newTDigest(defaultCompression),
+	}
+}
+
+func (r *recentDigest) Add(x float64) {
+	if r.current.Count() >= r.size {
+		r.previous = r.current
+		r.current = newTDigest(defaultCompression)
+	}
+	r.current.Add(x)
+}
+
+// Digest returns a digest of the recent samples.
+func (r *recentDigest) Digest() *tDigest {
+	d := newTDigest(defaultCompression)
+	d.Merge(r.previous)
+	d.Merge(r.current)
+	return d
+}
@@ -0,0 +1,73 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ThresholdConfig sets the thresholds of the series matching a pattern.
+type ThresholdConfig struct {
+	// A regular expression matching the series the thresholds apply to. An
+	// empty pattern applies to every series.
+	Series string `toml:"series"`
+
+	// How far a window's normed anomalousness must rise above (Upper) or fall
+	// below (Lower) zero for the window to be anomalous. A zero threshold
+	// falls back to the detect stage's own.
+	Upper float64 `toml:"upper"`
+	Lower float64 `toml:"lower"`
+}
+
+type seriesThreshold struct {
+	series *regexp.Regexp
+	upper  float64
+	lower  float64
+}
+
+func newSeriesThreshold(conf ThresholdConfig) (seriesThreshold, error) {
+	threshold := seriesThreshold{upper: conf.Upper, lower: conf.Lower}
+	if threshold.upper < 0 || threshold.lower < 0 {
+		return threshold, errors.New("Thresholds must not be negative.")
+	}
+	if conf.Series != "" {
+		re, err := regexp.Compile(conf.Series)
+		if err != nil {
+			return threshold, fmt.Errorf("Invalid 'thresholds' pattern %q: %s", conf.Series, err)
+		}
+		threshold.series = re
+	}
+	return threshold, nil
+}
+
+// thresholds returns the upper and lower thresholds of a series: those of the
+// first threshold pattern matching it, falling back to the stage's own.
+func (f *detectFilter) thresholds(series string) (upper, lower float64) {
+	upper, lower = f.DetectConfig.UpperThreshold, f.DetectConfig.LowerThreshold
+	for _, threshold := range f.thresholdsBySeries {
+		if threshold.series != nil && !threshold.series.MatchString(series) {
+			continue
+		}
+		if threshold.upper > 0 {
+			upper = threshold.upper
+		}
+		if threshold.lower > 0 {
+			lower = threshold.lower
+		}
+		break
+	}
+	return upper, lower
+}
+
+// applyThresholds rules a window anomalous or not by comparing its normed
+// anomalousness with the threshold for its direction, if there is one.
+// Otherwise the detector's own ruling stands.
+func (f *detectFilter) applyThresholds(r *ruling) {
+	upper, lower := f.thresholds(r.Window.Series)
+	switch {
+	case r.Normed > 0 && upper > 0:
+		r.Anomalous = r.Normed >= upper
+	case r.Normed < 0 && lower > 0:
+		r.Anomalous = -r.Normed >= lower
+	}
+}
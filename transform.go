@@ -0,0 +1,280 @@
+package hekaanom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/berkmancenter/hekaanom/anomutil"
+)
+
+// The transforms that can be applied to window values before detection.
+const (
+	transformLog          = "log"
+	transformBoxCox       = "boxcox"
+	transformDiff         = "diff"
+	transformSeasonalDiff = "seasonal_diff"
+	transformSTL          = "stl"
+)
+
+// TransformConfig sets the transforms applied to the windows of the series
+// matching a pattern before detection, e.g. to take out a trend that would
+// otherwise swamp the detector.
+type TransformConfig struct {
+	// A regular expression matching the series the transforms apply to. An
+	// empty pattern applies to every series.
+	Series string `toml:"series"`
+
+	// The transforms to apply, in order: "log" takes the natural log of one
+	// plus the value, "boxcox" the Box-Cox transform with Lambda of one plus
+	// the value, "diff" the difference from the previous window's value,
+	// "seasonal_diff" the difference from the value one season before, and
+	// "stl" decomposes the values into trend, seasonal and residual parts,
+	// keeping only the residual. Windows without enough earlier values to
+	// difference or decompose against, and those whose log is undefined, are
+	// dropped.
+	Steps  []string `toml:"steps"`
+	Lambda float64  `toml:"lambda"`
+
+	// The length of a season, either as a number of windows (Season) or as a
+	// duration (Period, e.g. "24h" or "7d"), which is rounded down to a whole
+	// number of the series' windows.
+	Season int         `toml:"season"`
+	Period interface{} `toml:"period"`
+
+	// How many of the latest seasons "stl" estimates each point of the
+	// seasonal pattern from. The default is 4.
+	Cycles int `toml:"cycles"`
+}
+
+type seriesTransform struct {
+	re     *regexp.Regexp
+	steps  []string
+	lambda float64
+	season int
+	period time.Duration
+	cycles int
+}
+
+// stepState holds what a differencing or decomposing step has kept of a
+// series' earlier values.
+type stepState struct {
+	// The series' season length, in windows.
+	season int
+	// The last season's values, in a ring.
+	values []float64
+	next   int
+	// For "stl", the latest detrended values at each point of the season,
+	// each in a ring of up to cycles values.
+	phases [][]float64
+	phase  int
+}
+
+// transformer applies the first matching set of transforms to each window.
+type transformer struct {
+	transforms []seriesTransform
+	// Each series' step states, by step.
+	states map[string][]*stepState
+	// The width of a series' windows, to turn periods into seasons.
+	width func(series string) time.Duration
+}
+
+func newTransformer(confs []TransformConfig, width func(series string) time.Duration) (*transformer, error) {
+	t := &transformer{states: map[string][]*stepState{}, width: width}
+	for _, conf := range confs {
+		period, err := anomutil.ParseDuration("period", conf.Period)
+		if err != nil {
+			return nil, err
+		}
+		transform := seriesTransform{
+			steps:  conf.Steps,
+			lambda: conf.Lambda,
+			season: conf.Season,
+			period: period,
+			cycles: conf.Cycles,
+		}
+		if len(conf.Steps) == 0 {
+			return nil, errors.New("Every transform needs 'steps'.")
+		}
+		if conf.Season < 0 || period < 0 || conf.Cycles < 0 {
+			return nil, errors.New("'season', 'period' and 'cycles' must not be negative.")
+		}
+		if transform.cycles == 0 {
+			transform.cycles = 4
+		}
+		for _, step := range conf.Steps {
+			switch step {
+			case transformLog, transformBoxCox, transformDiff:
+			case transformSeasonalDiff, transformSTL:
+				if conf.Season == 0 && period == 0 {
+					return nil, fmt.Errorf("%q needs a 'season' or 'period'.", step)
+				}
+			default:
+				return nil, fmt.Errorf("Unknown transform step %q.", step)
+			}
+		}
+		if conf.Series != "" {
+			re, err := regexp.Compile(conf.Series)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid 'transforms' pattern %q: %s", conf.Series, err)
+			}
+			transform.re = re
+		}
+		t.transforms = append(t.transforms, transform)
+	}
+	return t, nil
+}
+
+func (t *transformer) Connect(in chan window) chan window {
+	if len(t.transforms) == 0 {
+		return in
+	}
+	out := make(chan window)
+	go func() {
+		defer close(out)
+		for win := range in {
+			if win.evicted {
+				delete(t.states, win.Series)
+				out <- win
+				continue
+			}
+			if t.Transform(&win) {
+				out <- win
+			}
+		}
+	}()
+	return out
+}
+
+// Transform applies the first set of transforms matching a window's series to
+// its value, keeping its untransformed value as RawValue. It returns false if
+// the window should be dropped. Historical windows must be transformed before
+// Connect.
+func (t *transformer) Transform(win *window) bool {
+	for _, transform := range t.transforms {
+		if transform.re != nil && !transform.re.MatchString(win.Series) {
+			continue
+		}
+		if !win.Transformed {
+			win.RawValue, win.Transformed = win.Value, true
+		}
+
+		states := t.states[win.Series]
+		if states == nil {
+			states = make([]*stepState, len(transform.steps))
+			t.states[win.Series] = states
+		}
+		value := win.Value
+		for i, step := range transform.steps {
+			var ok bool
+			switch step {
+			case transformLog:
+				value, ok = math.Log1p(value), value > -1
+			case transformBoxCox:
+				value, ok = boxCox(1+value, transform.lambda), value > -1
+			case transformDiff:
+				value, ok = stateFor(&states[i], 1).diff(value)
+			case transformSeasonalDiff:
+				value, ok = stateFor(&states[i], transform.seasonOf(win.Series, t.width)).diff(value)
+			case transformSTL:
+				s := stateFor(&states[i], transform.seasonOf(win.Series, t.width))
+				value, ok = s.residual(value, transform.cycles)
+			}
+			if !ok {
+				return false
+			}
+		}
+		win.Value = value
+		return true
+	}
+	return true
+}
+
+// seasonOf returns the number of a series' windows in a season, at least one.
+func (transform seriesTransform) seasonOf(series string, width func(string) time.Duration) int {
+	if transform.season > 0 {
+		return transform.season
+	}
+	season := int(transform.period / width(series))
+	if season < 1 {
+		return 1
+	}
+	return season
+}
+
+// stateFor returns a series' state for a step, creating it if need be.
+func stateFor(state **stepState, season int) *stepState {
+	if *state == nil {
+		*state = &stepState{season: season}
+	}
+	return *state
+}
+
+// push records a value, returning the value it displaced from one season
+// before, if there was one.
+func (s *stepState) push(value float64) (float64, bool) {
+	if len(s.values) < s.season {
+		s.values = append(s.values, value)
+		return 0, false
+	}
+	old := s.values[s.next]
+	s.values[s.next] = value
+	s.next = (s.next + 1) % s.season
+	return old, true
+}
+
+// diff returns the difference between a value and the value one season
+// before it. It returns false until there's been a whole season.
+func (s *stepState) diff(value float64) (float64, bool) {
+	old, ok := s.push(value)
+	return value - old, ok
+}
+
+// residual decomposes a value, after the fashion of STL, into a trend (the
+// mean of the season before it), a seasonal part (the median of the
+// detrended values at the same point of up to the last cycles seasons) and
+// the residual left over, which it returns. The trend and seasonal part only
+// look back, so an anomaly can't mask itself. It returns false for the first
+// two seasons, until every point of the season has a detrended value.
+func (s *stepState) residual(value float64, cycles int) (float64, bool) {
+	if len(s.values) < s.season {
+		s.push(value)
+		return 0, false
+	}
+	trend := 0.0
+	for _, v := range s.values {
+		trend += v
+	}
+	trend /= float64(s.season)
+	s.push(value)
+
+	if s.phases == nil {
+		s.phases = make([][]float64, s.season)
+	}
+	phase := s.phase
+	s.phase = (s.phase + 1) % s.season
+	history := s.phases[phase]
+	ready := len(history) > 0
+	seasonal := median(history)
+
+	detrended := value - trend
+	if len(history) < cycles {
+		s.phases[phase] = append(history, detrended)
+	} else {
+		s.phases[phase] = append(history[1:], detrended)
+	}
+	if !ready {
+		return 0, false
+	}
+	return detrended - seasonal, true
+}
+
+// boxCox returns the Box-Cox transform of a positive value.
+func boxCox(value, lambda float64) float64 {
+	if lambda == 0 {
+		return math.Log(value)
+	}
+	return (math.Pow(value, lambda) - 1) / lambda
+}
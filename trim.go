@@ -0,0 +1,59 @@
+package hekaanom
+
+import (
+	"sort"
+
+	"github.com/montanaflynn/stats"
+)
+
+// The ways span values beyond TrimPercent are handled before the span
+// statistic is calculated.
+const (
+	trimDrop      = "trim"
+	trimWinsorize = "winsorize"
+)
+
+// trimmedAggregator wraps a span statistic so that the given percentage of
+// values at each end are dropped or, when winsorizing, clamped to the most
+// extreme remaining value before the statistic sees them. Spans too short to
+// lose a single value at each end are passed through untouched.
+func trimmedAggregator(agg func(stats.Float64Data) (float64, error), percent float64, method string) func(stats.Float64Data) (float64, error) {
+	if percent <= 0 {
+		return agg
+	}
+	return func(values stats.Float64Data) (float64, error) {
+		return agg(trimValues(values, percent, method))
+	}
+}
+
+// trimValues returns values with the given percentage at each end dropped or
+// winsorized, leaving the original slice untouched.
+func trimValues(values stats.Float64Data, percent float64, method string) stats.Float64Data {
+	n := len(values)
+	k := int(float64(n) * percent / 100)
+	if k == 0 || 2*k >= n {
+		return values
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	if method != trimWinsorize {
+		return stats.Float64Data(sorted[k : n-k])
+	}
+
+	low, high := sorted[k], sorted[n-k-1]
+	clamped := make(stats.Float64Data, n)
+	for i, value := range values {
+		switch {
+		case value < low:
+			clamped[i] = low
+		case value > high:
+			clamped[i] = high
+		default:
+			clamped[i] = value
+		}
+	}
+	return clamped
+}
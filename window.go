@@ -2,6 +2,7 @@ package hekaanom
 
 import (
 	"errors"
+	"math"
 	"time"
 
 	"github.com/mozilla-services/heka/message"
@@ -13,6 +14,74 @@ type window struct {
 	Series      string
 	Value       float64
 	Passthrough []*message.Field
+	Unit        string
+	Kind        string
+
+	// The tags of the window's metrics.
+	Tags map[string]string
+
+	// Excluded windows are ruled on but must not be added to a detector's
+	// baseline, e.g. because they fall within a confirmed incident.
+	Excluded bool
+
+	// Filled windows are synthetic, standing in for windows in which a series
+	// reported no metrics.
+	Filled bool
+
+	// Transformed windows' values have been transformed before detection,
+	// e.g. differenced or normalized against their series' previous windows.
+	// RawValue is what their value was before.
+	Transformed bool
+	RawValue    float64
+
+	// The last raw metrics aggregated into the window, oldest first, if the
+	// window stage is configured to keep them with RawPoints. Detectors can
+	// use them to tell the shape of the data within the window.
+	Points []point
+
+	// When the window was flushed, for measuring stage latency.
+	flushed time.Time
+
+	// The old name of the window's series, if it's the first window since the
+	// series was renamed and its detector state should be handed over.
+	renamedFrom string
+
+	// Evicted windows carry no value. They tell the stages after the window
+	// stage that their series has been evicted, so that they forget
+	// everything they keep about it too.
+	evicted bool
+
+	// Whether the window's series is observe-only, so the window should be
+	// added to the series' baseline without being ruled on.
+	observeOnly bool
+
+	// The metrics added to the window so far, from which its value is
+	// calculated when it's flushed.
+	acc accumulator
+}
+
+// point is a single raw metric value.
+type point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// addPoint records a raw metric in time order, keeping only the last max of
+// them.
+func (w *window) addPoint(p point, max int) {
+	if max <= 0 {
+		return
+	}
+	i := len(w.Points)
+	for i > 0 && w.Points[i-1].Timestamp.After(p.Timestamp) {
+		i--
+	}
+	w.Points = append(w.Points, point{})
+	copy(w.Points[i+1:], w.Points[i:])
+	w.Points[i] = p
+	if len(w.Points) > max {
+		w.Points = append(w.Points[:0], w.Points[len(w.Points)-max:]...)
+	}
 }
 
 func windowFromMessage(m *message.Message) (window, error) {
@@ -33,16 +102,56 @@ func windowFromMessage(m *message.Message) (window, error) {
 		return window{}, errors.New("Message does not contain 'value' field")
 	}
 
-	startTime, err := time.Parse(timeFormat, start.(string))
+	startStr, ok := start.(string)
+	if !ok {
+		return window{}, errors.New("'window_start' field is not a string")
+	}
+	endStr, ok := end.(string)
+	if !ok {
+		return window{}, errors.New("'window_end' field is not a string")
+	}
+	seriesStr, ok := series.(string)
+	if !ok {
+		return window{}, errors.New("'series' field is not a string")
+	}
+	var floatVal float64
+	switch v := value.(type) {
+	case float64:
+		floatVal = v
+	case int64:
+		floatVal = float64(v)
+	default:
+		return window{}, errors.New("'value' field is not numeric")
+	}
+	if math.IsNaN(floatVal) || math.IsInf(floatVal, 0) {
+		return window{}, errors.New("'value' field is not a finite number")
+	}
+
+	startTime, err := time.Parse(timeFormat, startStr)
 	if err != nil {
 		return window{}, err
 	}
-	endTime, err := time.Parse(timeFormat, end.(string))
+	endTime, err := time.Parse(timeFormat, endStr)
 	if err != nil {
 		return window{}, err
 	}
+	if endTime.Before(startTime) {
+		return window{}, errors.New("'window_end' is before 'window_start'")
+	}
 
-	return window{startTime, endTime, series.(string), value.(float64), nil}, nil
+	win := window{
+		Start:  startTime,
+		End:    endTime,
+		Series: seriesStr,
+		Value:  floatVal,
+	}
+	if unit, ok := m.GetFieldValue("unit"); ok {
+		win.Unit, _ = unit.(string)
+	}
+	if kind, ok := m.GetFieldValue("kind"); ok {
+		win.Kind, _ = kind.(string)
+	}
+	return win, nil
 }
 
 func (w window) FillMessage(m *message.Message) error {
@@ -58,7 +167,11 @@ func (w window) FillMessage(m *message.Message) error {
 	if err != nil {
 		return errors.New("Could not create 'series' field")
 	}
-	value, err := message.NewField("value", w.Value, "count")
+	unit := w.Unit
+	if unit == "" {
+		unit = "count"
+	}
+	value, err := message.NewField("value", w.Value, unit)
 	if err != nil {
 		return errors.New("Could not create 'value' field")
 	}
@@ -74,5 +187,59 @@ func (w window) FillMessage(m *message.Message) error {
 	m.AddField(durField)
 	m.AddField(value)
 
+	if err := addTagFields(m, w.Tags); err != nil {
+		return err
+	}
+
+	if w.Filled {
+		filled, err := message.NewField("filled", true, "")
+		if err != nil {
+			return errors.New("Could not create 'filled' field")
+		}
+		m.AddField(filled)
+	}
+
+	if w.Transformed {
+		raw, err := message.NewField("raw_value", w.RawValue, unit)
+		if err != nil {
+			return errors.New("Could not create 'raw_value' field")
+		}
+		m.AddField(raw)
+	}
+
+	if len(w.Points) > 0 {
+		times := message.NewFieldInit("point_times", message.Field_STRING, "date-time")
+		values := message.NewFieldInit("point_values", message.Field_DOUBLE, w.Unit)
+		for _, p := range w.Points {
+			if err := times.AddValue(p.Timestamp.Format(timeFormat)); err != nil {
+				return errors.New("Could not create 'point_times' field")
+			}
+			if err := values.AddValue(p.Value); err != nil {
+				return errors.New("Could not create 'point_values' field")
+			}
+		}
+		m.AddField(times)
+		m.AddField(values)
+	}
+
+	return addUnitFields(m, w.Unit, w.Kind)
+}
+
+// addUnitFields adds "unit" and "kind" fields to a message, if they're set.
+func addUnitFields(m *message.Message, unit, kind string) error {
+	if unit != "" {
+		field, err := message.NewField("unit", unit, "")
+		if err != nil {
+			return errors.New("Could not create 'unit' field")
+		}
+		m.AddField(field)
+	}
+	if kind != "" {
+		field, err := message.NewField("kind", kind, "")
+		if err != nil {
+			return errors.New("Could not create 'kind' field")
+		}
+		m.AddField(field)
+	}
 	return nil
 }
@@ -2,72 +2,646 @@ package hekaanom
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/berkmancenter/hekaanom/anomutil"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
 type windower interface {
 	pipeline.HasConfigStruct
 	pipeline.Plugin
+	pipeline.ReportingPlugin
 	Connect(in <-chan metric) chan window
+	ConnectWindows(in <-chan window) chan window
+	EffectiveConfig() map[string]interface{}
+	Width(series string) time.Duration
+	FlushIdleWindows(now time.Time)
+	FlushExpiredWindows(now time.Time)
+	SeriesKey(m metric) string
+	Forget(series string)
+	PrintIntervals()
+	UseCatalog(c *catalog)
 }
 
 type WindowConfig struct {
-	// The number of seconds that constitute a single window.
-	WindowWidth int64 `toml:"window_width"`
+	// The width of a single window, as a duration such as "15m" or a number
+	// of seconds.
+	WindowWidth interface{} `toml:"window_width"`
+
+	// What incoming messages contain: "metrics" (the default), which are
+	// windowed as described above, or "windows", which have already been
+	// aggregated upstream. Windows must have "window_start", "window_end",
+	// "series" and "value" fields, like those emitted by this filter, and their
+	// width must divide WindowWidth. They're passed straight on if they're as
+	// wide as WindowWidth, or combined into WindowWidth-wide windows if not,
+	// under WindowStatistic: the windows' values are summed for "Sum" and
+	// "Count", averaged for "Mean" and "Rate", and their minimum, maximum or
+	// last value is taken for "Min", "Max" or "Last". Other statistics can't
+	// be combined. Combined windows start as windows of metrics would, and
+	// each is emitted once a window past its end arrives, once it expires if
+	// FlushExpired is set, or when the input ends.
+	Input string `toml:"input"`
+
+	// The number of seconds between the starts of consecutive windows. If set
+	// to less than WindowWidth (which it must divide), windows overlap: a
+	// window covering the last WindowWidth seconds is emitted every
+	// WindowSlide seconds, once a full width of metrics has been seen. This
+	// lets detection react faster without shrinking the window. Zero, the
+	// default, gives back-to-back windows. Only applies to metrics input.
+	WindowSlide int64 `toml:"window_slide"`
+
+	// If set, each series' metrics are gathered into sessions instead of
+	// fixed-width windows: a window closes once its series has gone
+	// SessionGap seconds without a metric, and ends SessionGap seconds after
+	// its last metric. This suits bursty, irregular series. WindowWidth is
+	// then ignored. Only applies to metrics input, and can't be combined with
+	// WindowSlide.
+	SessionGap int64 `toml:"session_gap"`
+
+	// Snap window boundaries (and slide boundaries) to multiples of the
+	// window width since the Unix epoch, rather than starting each series'
+	// first window at its first metric, so that windows line up across
+	// series. Doesn't apply to session windows.
+	AlignWindows bool `toml:"align_windows"`
+
+	// How the values of a window's metrics are combined into the window's
+	// value: "Sum" (the default), "Mean", "Min", "Max", "Count", "Last",
+	// "StdDev", "Rate", the number of metrics per second, "Distinct", the
+	// estimated number of distinct values of the filter's distinct_field
+	// (e.g. unique client IDs), or a percentile
+	// such as "P95" or "P99.9". Counters are usually best summed, while
+	// gauges suit the Mean, Max or Last value, and latencies a percentile.
+	// Percentiles are estimated from a t-digest of each window's values, so
+	// windows don't keep every value.
+	// Pre-aggregated windows are always summed.
+	WindowStatistic string `toml:"window_statistic"`
+
+	// The number of its most recent raw metrics each window carries along with
+	// its aggregated value, for detectors that need the shape of the data
+	// within a window (e.g. to tell a spike from a ramp). Zero, the default,
+	// keeps none. Doesn't apply to pre-aggregated windows.
+	RawPoints int `toml:"raw_points"`
+
+	// When a series skips one or more whole windows, emit synthetic windows
+	// for them, so that the detector sees drops as well as spikes: "zero"
+	// fills them with zero, "previous" with the value of the last window and
+	// "linear" interpolates between the windows either side of the gap.
+	// Filled windows have Filled set. In realtime mode, series that stop
+	// reporting altogether are filled as time passes, except with "linear",
+	// which has to wait for the series to report again. Empty, the default,
+	// fills nothing. Only applies to back-to-back windows of metrics.
+	FillMissing string `toml:"fill_missing"`
+
+	// The number of seconds a metric may arrive behind the latest metric of
+	// its series and still be added to the window it belongs in. Each window
+	// is held open until a metric arrives at least this long after its end.
+	// Metrics that arrive later are dropped and counted. Zero, the default,
+	// assumes metrics arrive in order, and emits each window as soon as a
+	// metric for the next one arrives. Only applies to back-to-back windows of
+	// metrics, and can't be combined with FillMissing.
+	AllowedLateness int64 `toml:"allowed_lateness"`
+
+	// The number of seconds a series may go without a metric before its
+	// windows and everything else kept about it are evicted, so that series
+	// which stop reporting don't hold memory forever. Idle series are checked
+	// for as metrics arrive and, in realtime mode, on every tick. Zero, the
+	// default, never evicts. Only applies to metrics input.
+	SeriesTTL int64 `toml:"series_ttl"`
+
+	// Whether an evicted series' open window is flushed, even though it's
+	// partial, rather than discarded.
+	FlushEvicted bool `toml:"flush_evicted"`
+
+	// Flush each window once its end, plus the allowed lateness, has passed,
+	// rather than waiting for its series' next metric, so that the last window
+	// of a quiet series isn't left dangling. Time passes with the latest
+	// metric seen across all series and, in realtime mode, with the clock.
+	// LastDate, if set, is the time of the final piece of data being
+	// processed, and windows that end by then are flushed when the input ends.
+	// Only applies to back-to-back windows of metrics.
+	FlushExpired bool   `toml:"flush_expired"`
+	LastDate     string `toml:"last_date"`
+
+	// If set, each window closes once it holds this many metrics, instead of
+	// after WindowWidth seconds, and lasts from its first metric to its last.
+	// For event-driven series, where the rate of events is itself the signal,
+	// count windows with the "Rate" statistic give the detector a much more
+	// stable distribution than the number of events in fixed-width windows.
+	// Only applies to metrics input, and can't be combined with SessionGap,
+	// WindowSlide, FillMissing, AllowedLateness or FlushExpired.
+	WindowCount int `toml:"window_count"`
+
+	// The number of goroutines metrics are windowed in. Series are spread
+	// across them by hash, so each series' metrics are still windowed in
+	// order. At high series cardinality, more workers keep windowing from
+	// becoming the pipeline's bottleneck. Pre-aggregated windows are always
+	// combined in a single goroutine.
+	Workers int `toml:"workers"`
+
+	// Tags whose values are added to each metric's series, so that e.g. a
+	// metric's series is split by host and endpoint. Each must be one of the
+	// filter's tag_fields. Only applies to metrics input.
+	SeriesTags []string `toml:"series_tags"`
 }
 
+const (
+	inputMetrics = "metrics"
+	inputWindows = "windows"
+)
+
 type windowFilter struct {
 	windows map[string]*window
+	sliding map[string]*slidingWindow
+	// Open session windows, and requests to close idle ones.
+	sessions map[string]*window
+	idle     chan time.Time
+	// The value of each series' last window, and the starts of any
+	// interpolated windows waiting on its next one.
+	lastValues   map[string]float64
+	pendingFills map[string][]time.Time
+	// Windows held open for late metrics, oldest first, each series' latest
+	// metric time, and the number of metrics dropped for being too late.
+	held        map[string][]*window
+	latest      map[string]time.Time
+	droppedLate int64
+	// When each series last reported a metric, when idle series were last
+	// evicted and how many have been.
+	seen         map[string]time.Time
+	lastEviction time.Time
+	evicted      int64
+	// Requests to flush expired windows, the latest metric time seen across
+	// all series, when expired windows are next due to be flushed by it, and
+	// the parsed LastDate.
+	expired chan time.Time
+	// The last value of each counter series.
+	counters map[string]counterSample
+	// Series to evict regardless of how recently they reported.
+	forget     chan string
+	clock      time.Time
+	nextExpiry time.Time
+	lastDate   time.Time
+	// The parsed WindowWidth, and whether WindowStatistic is a percentile.
+	windowWidth time.Duration
+	quantiles   bool
+	// The workers series are spread across, if there's more than one.
+	workers []*windowFilter
 	*WindowConfig
+	intervals *intervalTracker
+	catalog   *catalog
 }
 
 func (f *windowFilter) ConfigStruct() interface{} {
-	return &WindowConfig{}
+	return &WindowConfig{
+		Input:           inputMetrics,
+		WindowStatistic: defaultWindowStatistic,
+		Workers:         1,
+	}
 }
 
 func (f *windowFilter) Init(config interface{}) error {
 	f.WindowConfig = config.(*WindowConfig)
-	if f.WindowConfig.WindowWidth <= 0 {
+	width, err := anomutil.ParseDuration("window_width", f.WindowConfig.WindowWidth)
+	if err != nil {
+		return err
+	}
+	if width <= 0 {
 		return errors.New("'window_width' setting must be greater than zero.")
 	}
-	f.windows = map[string]*window{}
+	f.windowWidth = width
+	switch f.WindowConfig.Input {
+	case "":
+		f.WindowConfig.Input = inputMetrics
+	case inputMetrics, inputWindows:
+	default:
+		return errors.New("'input' must be either \"metrics\" or \"windows\".")
+	}
+	if f.WindowConfig.WindowStatistic == "" {
+		f.WindowConfig.WindowStatistic = defaultWindowStatistic
+	}
+	if !windowStatisticIsKnown(f.WindowConfig.WindowStatistic) {
+		return errors.New("Unknown 'window_statistic'.")
+	}
+	_, f.quantiles = statisticQuantile(f.WindowConfig.WindowStatistic)
+	if f.WindowConfig.RawPoints < 0 {
+		return errors.New("'raw_points' must not be negative.")
+	}
+	if f.WindowConfig.WindowSlide < 0 {
+		return errors.New("'window_slide' must not be negative.")
+	}
+	if f.WindowConfig.WindowSlide > 0 && f.windowWidth%(time.Duration(f.WindowConfig.WindowSlide)*time.Second) != 0 {
+		return errors.New("'window_slide' must divide 'window_width'.")
+	}
+	switch f.WindowConfig.FillMissing {
+	case "", fillZero, fillPrevious, fillLinear:
+	default:
+		return errors.New("'fill_missing' must be \"zero\", \"previous\" or \"linear\".")
+	}
+	if f.WindowConfig.WindowStatistic == "Distinct" && f.WindowConfig.WindowSlide > 0 {
+		return errors.New("The \"Distinct\" 'window_statistic' can't be used with 'window_slide'.")
+	}
+	if f.WindowConfig.FillMissing != "" && (f.WindowConfig.SessionGap > 0 || f.WindowConfig.WindowSlide > 0) {
+		return errors.New("'fill_missing' can't be used with 'session_gap' or 'window_slide'.")
+	}
+	if f.WindowConfig.SessionGap < 0 {
+		return errors.New("'session_gap' must not be negative.")
+	}
+	if f.WindowConfig.SessionGap > 0 && f.WindowConfig.WindowSlide > 0 {
+		return errors.New("'session_gap' and 'window_slide' can't be used together.")
+	}
+	if f.WindowConfig.AllowedLateness < 0 {
+		return errors.New("'allowed_lateness' must not be negative.")
+	}
+	if f.WindowConfig.AllowedLateness > 0 && (f.WindowConfig.SessionGap > 0 || f.WindowConfig.WindowSlide > 0 || f.WindowConfig.FillMissing != "") {
+		return errors.New("'allowed_lateness' can't be used with 'session_gap', 'window_slide' or 'fill_missing'.")
+	}
+	if f.WindowConfig.SeriesTTL < 0 {
+		return errors.New("'series_ttl' must not be negative.")
+	}
+	if f.WindowConfig.WindowCount < 0 {
+		return errors.New("'window_count' must not be negative.")
+	}
+	if f.WindowConfig.WindowCount > 0 && (f.WindowConfig.SessionGap > 0 || f.WindowConfig.WindowSlide > 0 ||
+		f.WindowConfig.FillMissing != "" || f.WindowConfig.AllowedLateness > 0 || f.WindowConfig.FlushExpired) {
+		return errors.New("'window_count' can't be used with 'session_gap', 'window_slide', 'fill_missing', 'allowed_lateness' or 'flush_expired'.")
+	}
+	if _, ok := combinedStatistic(f.WindowConfig.WindowStatistic); !ok && f.WindowConfig.Input == inputWindows {
+		return errors.New("The \"" + f.WindowConfig.WindowStatistic + "\" 'window_statistic' can't combine pre-aggregated windows.")
+	}
+	if f.WindowConfig.Workers <= 0 {
+		return errors.New("'workers' must be greater than zero.")
+	}
+	seriesTags := map[string]bool{}
+	for _, name := range f.WindowConfig.SeriesTags {
+		if name == "" {
+			return errors.New("'series_tags' must not contain empty names.")
+		}
+		if seriesTags[name] {
+			return fmt.Errorf("Series tag %q is listed more than once.", name)
+		}
+		seriesTags[name] = true
+	}
+	if f.WindowConfig.LastDate != "" {
+		lastDate, err := parseLastDate(f.WindowConfig.LastDate)
+		if err != nil {
+			return err
+		}
+		f.lastDate = lastDate
+	}
+	f.initState()
+	f.intervals = newIntervalTracker()
+	f.workers = nil
+	if f.WindowConfig.Workers > 1 && f.WindowConfig.Input == inputMetrics {
+		for i := 0; i < f.WindowConfig.Workers; i++ {
+			f.workers = append(f.workers, f.newWorker())
+		}
+	}
 	return nil
 }
 
+// initState sets up the per-series state of a windowFilter.
+func (f *windowFilter) initState() {
+	f.windows = map[string]*window{}
+	f.sliding = map[string]*slidingWindow{}
+	f.sessions = map[string]*window{}
+	f.idle = make(chan time.Time, 1)
+	f.lastValues = map[string]float64{}
+	f.pendingFills = map[string][]time.Time{}
+	f.held = map[string][]*window{}
+	f.latest = map[string]time.Time{}
+	f.seen = map[string]time.Time{}
+	f.expired = make(chan time.Time, 1)
+	f.forget = make(chan string, 100)
+	f.counters = map[string]counterSample{}
+}
+
+// UseCatalog sets the catalog used to override window widths per series.
+func (f *windowFilter) UseCatalog(c *catalog) {
+	f.catalog = c
+	for _, worker := range f.workers {
+		worker.catalog = c
+	}
+}
+
+// Width returns the width of a series' windows.
+func (f *windowFilter) Width(series string) time.Duration {
+	if entry, ok := f.catalog.Lookup(series); ok && entry.WindowWidth > 0 {
+		return time.Duration(entry.WindowWidth) * time.Second
+	}
+	return f.windowWidth
+}
+
+// ReportMsg implements Heka's ReportingPlugin interface.
+func (f *windowFilter) ReportMsg(msg *message.Message) error {
+	if err := message.NewInt64Field(msg, "TrackedSeries", int64(f.intervals.SeriesCount()), "count"); err != nil {
+		return err
+	}
+	if err := message.NewInt64Field(msg, "LateMetricsDropped", f.DroppedLateMetrics(), "count"); err != nil {
+		return err
+	}
+	return message.NewInt64Field(msg, "SeriesEvicted", f.EvictedSeries(), "count")
+}
+
+func (f *windowFilter) PrintIntervals() {
+	fmt.Println("Series intervals")
+	for series, interval := range f.intervals.Intervals() {
+		fmt.Println(series, " - ", interval)
+	}
+	fmt.Println()
+}
+
+func (f *windowFilter) EffectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"window_width":     f.windowWidth.String(),
+		"input":            f.WindowConfig.Input,
+		"window_slide":     (time.Duration(f.WindowConfig.WindowSlide) * time.Second).String(),
+		"session_gap":      (time.Duration(f.WindowConfig.SessionGap) * time.Second).String(),
+		"align_windows":    f.WindowConfig.AlignWindows,
+		"window_statistic": f.WindowConfig.WindowStatistic,
+		"raw_points":       f.WindowConfig.RawPoints,
+		"fill_missing":     f.WindowConfig.FillMissing,
+		"allowed_lateness": (time.Duration(f.WindowConfig.AllowedLateness) * time.Second).String(),
+		"series_ttl":       (time.Duration(f.WindowConfig.SeriesTTL) * time.Second).String(),
+		"flush_evicted":    f.WindowConfig.FlushEvicted,
+		"flush_expired":    f.WindowConfig.FlushExpired,
+		"last_date":        f.WindowConfig.LastDate,
+		"window_count":     f.WindowConfig.WindowCount,
+		"workers":          f.WindowConfig.Workers,
+		"series_tags":      f.WindowConfig.SeriesTags,
+	}
+}
+
 func (f *windowFilter) Connect(in <-chan metric) chan window {
 	out := make(chan window)
+	if len(f.workers) > 0 {
+		f.connectWorkers(in, out)
+		return out
+	}
 	go func() {
 		defer close(out)
-		for metric := range in {
-			win, ok := f.windows[metric.Series]
+		f.run(in, out)
+	}()
+	return out
+}
+
+// run windows metrics until its input ends.
+func (f *windowFilter) run(in <-chan metric, out chan window) {
+	for {
+		select {
+		case metric, ok := <-in:
 			if !ok {
-				win = &window{
-					Start:       metric.Timestamp,
-					Series:      metric.Series,
-					Passthrough: metric.Passthrough,
+				if f.WindowConfig.FlushExpired && !f.lastDate.IsZero() {
+					f.flushExpiredWindows(f.lastDate, out)
 				}
-				f.windows[metric.Series] = win
+				return
+			}
+			if metric.tick {
+				f.expireByClock(metric.Timestamp, out)
+				continue
+			}
+			f.addMetric(metric, out)
+		case now := <-f.expired:
+			f.flushExpiredWindows(now, out)
+		case series := <-f.forget:
+			f.forgetSeries(series, out)
+		case now := <-f.idle:
+			if f.WindowConfig.SessionGap > 0 {
+				f.flushIdleSessions(now, out)
+			} else if f.WindowConfig.FillMissing != "" {
+				f.fillIdle(now, out)
+			}
+			if f.WindowConfig.SeriesTTL > 0 {
+				f.evictIdleSeries(now, out)
 			}
+		}
+	}
+}
+
+func (f *windowFilter) addMetric(metric metric, out chan window) {
+	f.intervals.Observe(metric.Series, metric.Timestamp)
 
-			windowAge := metric.Timestamp.Sub(win.Start)
-			if int64(windowAge/time.Second) >= f.WindowConfig.WindowWidth {
+	if ttl := f.WindowConfig.SeriesTTL; ttl > 0 {
+		if metric.Timestamp.After(f.seen[metric.Series]) {
+			f.seen[metric.Series] = metric.Timestamp
+		}
+		if metric.Timestamp.Sub(f.lastEviction) >= time.Duration(ttl)*time.Second {
+			f.evictIdleSeries(metric.Timestamp, out)
+		}
+	}
+
+	if metric.Type == metricCounter {
+		var ok bool
+		if metric, ok = f.counterRate(metric); !ok {
+			return
+		}
+	}
+
+	if f.WindowConfig.SessionGap > 0 {
+		f.sessionMetric(metric, out)
+		return
+	}
+
+	if f.WindowConfig.WindowCount > 0 {
+		f.countMetric(metric, out)
+		return
+	}
+
+	if f.WindowConfig.FlushExpired {
+		f.expireByClock(metric.Timestamp, out)
+	}
+
+	if slide := f.slide(metric.Series); slide > 0 {
+		f.slideMetric(metric, slide, out)
+		return
+	}
+
+	lateness := f.WindowConfig.AllowedLateness > 0
+	if lateness {
+		if f.lateMetric(metric) {
+			return
+		}
+		if metric.Timestamp.After(f.latest[metric.Series]) {
+			f.latest[metric.Series] = metric.Timestamp
+		}
+	}
+
+	win, ok := f.windows[metric.Series]
+	if !ok {
+		win = &window{
+			Start:       f.windowStart(metric.Timestamp, f.Width(metric.Series)),
+			Series:      metric.Series,
+			Passthrough: metric.Passthrough,
+			Tags:        metric.Tags,
+			Unit:        metric.Unit,
+			Kind:        metric.Kind,
+		}
+		f.windows[metric.Series] = win
+	}
+
+	windowAge := metric.Timestamp.Sub(win.Start)
+	if width := f.Width(metric.Series); windowAge >= width {
+		next := win.Start
+		if win.acc.count > 0 {
+			if lateness {
+				f.holdWindow(win)
+			} else {
 				f.flushWindow(win, out)
-				win.Start = metric.Timestamp
 			}
+			next = next.Add(width)
+		}
+		start := f.windowStart(metric.Timestamp, width)
+		f.fillGap(win, next, start, out)
+		win.Start = start
+	}
 
-			win.Value += metric.Value
-			win.End = metric.Timestamp
+	if lateness {
+		f.addLate(win, metric)
+		f.flushHeld(metric.Series, out)
+		return
+	}
+	f.accumulate(&win.acc, metric)
+	win.addPoint(point{metric.Timestamp, metric.Value}, f.WindowConfig.RawPoints)
+	win.End = metric.Timestamp
+}
+
+// ConnectWindows combines pre-aggregated windows into windows of the
+// configured width.
+func (f *windowFilter) ConnectWindows(in <-chan window) chan window {
+	out := make(chan window)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case incoming, ok := <-in:
+				if !ok {
+					// There's nothing more to wait for, so even partial
+					// windows are flushed.
+					for _, win := range f.windows {
+						if win.acc.count > 0 {
+							f.flushWindow(win, out)
+						}
+					}
+					return
+				}
+				f.combineWindow(incoming, out)
+			case now := <-f.expired:
+				f.flushExpiredWindows(now, out)
+			case series := <-f.forget:
+				f.forgetSeries(series, out)
+			}
 		}
 	}()
 	return out
 }
 
+// combineWindow adds a pre-aggregated window to the window of the configured
+// width it falls in, flushing the series' previous window if it's been
+// passed. Windows as wide as the configured width are passed straight on.
+func (f *windowFilter) combineWindow(incoming window, out chan window) {
+	f.intervals.Observe(incoming.Series, incoming.Start)
+
+	width := f.Width(incoming.Series)
+	incomingWidth := incoming.End.Sub(incoming.Start)
+	if incomingWidth <= 0 || width%incomingWidth != 0 {
+		fmt.Println("Dropping window for", incoming.Series, "- its width of",
+			incomingWidth, "does not divide", width)
+		return
+	}
+	if incomingWidth == width {
+		incoming.flushed = time.Now()
+		out <- incoming
+		return
+	}
+
+	win, ok := f.windows[incoming.Series]
+	if ok && win.acc.count > 0 && !incoming.Start.Before(win.Start.Add(width)) {
+		f.flushWindow(win, out)
+	}
+	if !ok || win.acc.count == 0 {
+		win = &window{
+			Start:       f.windowStart(incoming.Start, width),
+			Series:      incoming.Series,
+			Passthrough: incoming.Passthrough,
+			Tags:        incoming.Tags,
+			Unit:        incoming.Unit,
+			Kind:        incoming.Kind,
+		}
+		f.windows[incoming.Series] = win
+	}
+	win.acc.Add(incoming.Value)
+
+	if f.WindowConfig.FlushExpired {
+		f.expireByClock(incoming.End, out)
+	}
+}
+
+// combinedStatistic returns the statistic of pre-aggregated windows' values
+// that gives a combined window's value under a window statistic, and false
+// if windows can't be combined under it.
+func combinedStatistic(statistic string) (string, bool) {
+	switch statistic {
+	case "Sum", "Count":
+		return "Sum", true
+	case "Mean", "Rate":
+		return "Mean", true
+	case "Min", "Max", "Last":
+		return statistic, true
+	}
+	return "", false
+}
+
+// windowStart returns the start of the window, or slide, of the given width
+// that a metric at the given time falls in.
+func (f *windowFilter) windowStart(t time.Time, width time.Duration) time.Time {
+	if !f.WindowConfig.AlignWindows {
+		return t
+	}
+	return anomutil.BinStart(t, width)
+}
+
+// accumulate adds a metric to a window's accumulator, making sure the
+// accumulator can calculate the window statistic.
+func (f *windowFilter) accumulate(acc *accumulator, m metric) {
+	if f.quantiles {
+		acc.keepQuantiles()
+	}
+	acc.Add(m.Value)
+	if m.Distinct != "" {
+		acc.AddDistinct(m.Distinct)
+	}
+}
+
 func (f *windowFilter) flushWindow(win *window, out chan window) error {
-	// Add one window width to the end of the width because the end is exclusive
-	win.End = win.End.Add(time.Duration(f.WindowConfig.WindowWidth) * time.Second)
+	width := f.Width(win.Series)
+	switch {
+	case f.WindowConfig.WindowCount > 0:
+		// Count windows end at their last metric.
+		width = win.End.Sub(win.Start)
+	case f.WindowConfig.AlignWindows, f.WindowConfig.Input == inputWindows:
+		win.End = win.Start.Add(width)
+	default:
+		// Add one window width to the end of the width because the end is exclusive
+		win.End = win.End.Add(width)
+	}
+	statistic := f.WindowConfig.WindowStatistic
+	if f.WindowConfig.Input == inputWindows {
+		statistic, _ = combinedStatistic(statistic)
+	}
+	win.Value = win.acc.Value(statistic, width)
+	if f.WindowConfig.FillMissing != "" {
+		f.emitPendingFills(win, win.Value, out)
+		f.lastValues[win.Series] = win.Value
+	}
+	win.flushed = time.Now()
 	out <- *win
-	*win = window{Series: win.Series, Passthrough: win.Passthrough}
+	*win = window{
+		Series:      win.Series,
+		Passthrough: win.Passthrough,
+		Tags:        win.Tags,
+		Unit:        win.Unit,
+		Kind:        win.Kind,
+	}
 	return nil
 }
@@ -0,0 +1,249 @@
+package hekaanom
+
+import (
+	"fmt"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func newTestWindowFilter(t testing.TB, configure func(*WindowConfig)) *windowFilter {
+	f := &windowFilter{}
+	conf := f.ConfigStruct().(*WindowConfig)
+	conf.WindowWidth = "1m"
+	if configure != nil {
+		configure(conf)
+	}
+	if err := f.Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// TestTumblingWindowsCoverEveryMetric checks, for any metrics arriving in
+// order, that each series' tumbling windows never overlap and that every
+// metric is counted in exactly one of them.
+func TestTumblingWindowsCoverEveryMetric(t *testing.T) {
+	property := func(steps []uint16, picks []uint8, workers uint8) bool {
+		f := newTestWindowFilter(t, func(conf *WindowConfig) {
+			conf.AlignWindows = true
+			conf.FlushExpired = true
+			conf.LastDate = "2100-01-01T00:00:00Z"
+			conf.WindowStatistic = "Count"
+			conf.Workers = 1 + int(workers%3)
+		})
+		var metrics []metric
+		now := time.Unix(0, 0)
+		for i, step := range steps {
+			now = now.Add(time.Duration(step%300) * time.Second)
+			series := "series-0"
+			if i < len(picks) {
+				series = fmt.Sprintf("series-%d", picks[i]%4)
+			}
+			metrics = append(metrics, metric{Timestamp: now, Series: series, Value: 1})
+		}
+
+		in := make(chan metric)
+		out := f.Connect(in)
+		go func() {
+			for _, m := range metrics {
+				in <- m
+			}
+			close(in)
+		}()
+		bySeries := map[string][]window{}
+		for win := range out {
+			bySeries[win.Series] = append(bySeries[win.Series], win)
+		}
+
+		for series, windows := range bySeries {
+			for i, win := range windows {
+				if win.End.Sub(win.Start) != time.Minute {
+					t.Logf("%s: window from %v to %v isn't a minute wide", series, win.Start, win.End)
+					return false
+				}
+				if i > 0 && win.Start.Before(windows[i-1].End) {
+					t.Logf("%s: window from %v overlaps the one ending at %v", series, win.Start, windows[i-1].End)
+					return false
+				}
+				var count float64
+				for _, m := range metrics {
+					if m.Series == series && !m.Timestamp.Before(win.Start) && m.Timestamp.Before(win.End) {
+						count++
+					}
+				}
+				if win.Value != count {
+					t.Logf("%s: window from %v counted %v metrics, want %v", series, win.Start, win.Value, count)
+					return false
+				}
+			}
+		}
+		for _, m := range metrics {
+			var in int
+			for _, win := range bySeries[m.Series] {
+				if !m.Timestamp.Before(win.Start) && m.Timestamp.Before(win.End) {
+					in++
+				}
+			}
+			if in != 1 {
+				t.Logf("%s: metric at %v is in %d windows", m.Series, m.Timestamp, in)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlushExpiredFillsGap(t *testing.T) {
+	f := newTestWindowFilter(t, func(conf *WindowConfig) {
+		conf.AlignWindows = true
+		conf.FlushExpired = true
+		conf.FillMissing = fillZero
+	})
+	in := make(chan metric)
+	out := f.Connect(in)
+	start := time.Unix(0, 0)
+	go func() {
+		// The second metric expires the first one's window, then leaves a
+		// gap of three windows to fill.
+		in <- metric{Timestamp: start, Series: "web", Value: 1}
+		in <- metric{Timestamp: start.Add(4 * time.Minute), Series: "web", Value: 1}
+		close(in)
+	}()
+
+	var starts []time.Time
+	for win := range out {
+		if win.Start.Before(start) {
+			t.Fatalf("got a window starting at %v, before the series' first metric", win.Start)
+		}
+		starts = append(starts, win.Start)
+	}
+	if len(starts) != 4 {
+		t.Fatalf("got windows starting at %v, want one a minute from %v", starts, start)
+	}
+	for i, s := range starts {
+		if want := start.Add(time.Duration(i) * time.Minute); !s.Equal(want) {
+			t.Errorf("window %d starts at %v, want %v", i, s, want)
+		}
+	}
+}
+
+func TestCombineWindows(t *testing.T) {
+	f := newTestWindowFilter(t, func(conf *WindowConfig) {
+		conf.WindowWidth = "2m"
+		conf.Input = inputWindows
+		conf.WindowStatistic = "Max"
+		conf.AlignWindows = true
+	})
+	in := make(chan window)
+	out := f.ConnectWindows(in)
+	start := time.Unix(0, 0)
+	go func() {
+		for i, value := range []float64{5, 3, 7} {
+			winStart := start.Add(time.Duration(i+1) * time.Minute)
+			in <- window{Series: "web", Start: winStart, End: winStart.Add(time.Minute), Value: value}
+		}
+		close(in)
+	}()
+
+	var got []window
+	for win := range out {
+		got = append(got, win)
+	}
+	// The last window is partial, but the input has ended.
+	want := []window{
+		{Start: start, End: start.Add(2 * time.Minute), Value: 5},
+		{Start: start.Add(2 * time.Minute), End: start.Add(4 * time.Minute), Value: 7},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d windows, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if !got[i].Start.Equal(w.Start) || !got[i].End.Equal(w.End) || got[i].Value != w.Value {
+			t.Errorf("got a window from %v to %v of %v, want one from %v to %v of %v",
+				got[i].Start, got[i].End, got[i].Value, w.Start, w.End, w.Value)
+		}
+	}
+}
+
+func TestCombineWindowsRejectsPercentiles(t *testing.T) {
+	f := &windowFilter{}
+	conf := f.ConfigStruct().(*WindowConfig)
+	conf.WindowWidth = "2m"
+	conf.Input = inputWindows
+	conf.WindowStatistic = "P99"
+	if err := f.Init(conf); err == nil {
+		t.Error("a percentile of pre-aggregated windows should be an error")
+	}
+}
+
+func TestCombinedWindowsExpire(t *testing.T) {
+	f := newTestWindowFilter(t, func(conf *WindowConfig) {
+		conf.WindowWidth = "2m"
+		conf.Input = inputWindows
+		conf.FlushExpired = true
+	})
+	in := make(chan window)
+	out := f.ConnectWindows(in)
+	start := time.Unix(0, 0)
+	go func() {
+		for i := 0; i < 2; i++ {
+			winStart := start.Add(time.Duration(i) * time.Minute)
+			in <- window{Series: "web", Start: winStart, End: winStart.Add(time.Minute), Value: 1}
+		}
+		// Another series moves time on past the end of web's window.
+		in <- window{Series: "db", Start: start.Add(3 * time.Minute), End: start.Add(4 * time.Minute), Value: 1}
+	}()
+	defer func() {
+		close(in)
+		for range out {
+		}
+	}()
+
+	// Web's window expires without waiting for its next one.
+	select {
+	case win := <-out:
+		if !win.End.Equal(start.Add(2*time.Minute)) || win.Value != 2 {
+			t.Errorf("got a window ending at %v of %v, want one ending at %v of 2", win.End, win.Value, start.Add(2*time.Minute))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the combined window never expired")
+	}
+}
+
+func TestForgetCombinedSeries(t *testing.T) {
+	f := newTestWindowFilter(t, func(conf *WindowConfig) {
+		conf.WindowWidth = "2m"
+		conf.Input = inputWindows
+		conf.FlushEvicted = true
+	})
+	in := make(chan window)
+	out := f.ConnectWindows(in)
+	defer func() {
+		close(in)
+		for range out {
+		}
+	}()
+	start := time.Unix(0, 0)
+	in <- window{Series: "web", Start: start, End: start.Add(time.Minute), Value: 1}
+	f.Forget("web")
+
+	// The partial window is flushed, then the stages after this one are told
+	// to forget the series.
+	for _, evicted := range []bool{false, true} {
+		select {
+		case win := <-out:
+			if win.Series != "web" || win.evicted != evicted {
+				t.Fatalf("got %+v, want a window of web with evicted %v", win, evicted)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the series was never forgotten")
+		}
+	}
+	if _, ok := f.windows["web"]; ok {
+		t.Error("the series' window is still open")
+	}
+}
@@ -0,0 +1,79 @@
+package hekaanom
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of metrics that can be queued for each window worker.
+const windowWorkerQueueSize = 1000
+
+// newWorker returns a windowFilter with the same configuration, interval
+// tracker and catalog as this one, but its own per-series state.
+func (f *windowFilter) newWorker() *windowFilter {
+	worker := &windowFilter{
+		WindowConfig: f.WindowConfig,
+		intervals:    f.intervals,
+		catalog:      f.catalog,
+		lastDate:     f.lastDate,
+		windowWidth:  f.windowWidth,
+		quantiles:    f.quantiles,
+	}
+	worker.initState()
+	return worker
+}
+
+// instances returns the windowFilters that hold per-series state: the
+// workers, if there are any, or else this one.
+func (f *windowFilter) instances() []*windowFilter {
+	if len(f.workers) > 0 {
+		return f.workers
+	}
+	return []*windowFilter{f}
+}
+
+// connectWorkers spreads metrics across the workers by series, closing out
+// once every worker has finished. If expired windows are to be flushed, each
+// time the latest metric time seen across all series passes another window
+// width, the workers that didn't get that metric are sent a clock tick in
+// line with their metrics. Workers whose series have all gone quiet still
+// flush their expired windows, just as a single window filter would.
+func (f *windowFilter) connectWorkers(in <-chan metric, out chan window) {
+	var wg sync.WaitGroup
+	chans := make([]chan metric, len(f.workers))
+	for i, worker := range f.workers {
+		chans[i] = make(chan metric, windowWorkerQueueSize)
+		wg.Add(1)
+		go func(worker *windowFilter, in chan metric) {
+			defer wg.Done()
+			worker.run(in, out)
+		}(worker, chans[i])
+	}
+
+	go func() {
+		var clock, nextTick time.Time
+		for metric := range in {
+			i := SeriesShard(metric.Series, len(chans))
+			chans[i] <- metric
+
+			if !f.WindowConfig.FlushExpired || !metric.Timestamp.After(clock) {
+				continue
+			}
+			clock = metric.Timestamp
+			if clock.Before(nextTick) {
+				continue
+			}
+			nextTick = clock.Add(f.windowWidth)
+			for j, ch := range chans {
+				if j != i {
+					ch <- clockTick(clock)
+				}
+			}
+		}
+		for _, ch := range chans {
+			close(ch)
+		}
+		wg.Wait()
+		close(out)
+	}()
+}
@@ -0,0 +1,55 @@
+package hekaanom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// seriesOnOtherShard returns a series that isn't on the same one of shards
+// shards as series.
+func seriesOnOtherShard(series string, shards int) string {
+	for i := 0; ; i++ {
+		other := fmt.Sprintf("series-%d", i)
+		if SeriesShard(other, shards) != SeriesShard(series, shards) {
+			return other
+		}
+	}
+}
+
+func TestQuietWorkerFlushesExpiredWindows(t *testing.T) {
+	f := newTestWindowFilter(t, func(conf *WindowConfig) {
+		conf.Workers = 2
+		conf.FlushExpired = true
+	})
+	quiet := "quiet"
+	busy := seriesOnOtherShard(quiet, 2)
+
+	in := make(chan metric)
+	out := f.Connect(in)
+	start := time.Unix(0, 0)
+	go func() {
+		in <- metric{Timestamp: start, Series: quiet, Value: 1}
+		for i := 0; i < 10; i++ {
+			in <- metric{Timestamp: start.Add(time.Duration(i) * time.Minute), Series: busy, Value: 1}
+		}
+		// With no last date, the end of the input flushes nothing.
+		close(in)
+	}()
+	defer func() {
+		for range out {
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case win := <-out:
+			if win.Series == quiet {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the quiet series' window was never flushed")
+		}
+	}
+}